@@ -0,0 +1,150 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/pprof"
+	"strconv"
+	"sync"
+	"time"
+
+	routes "github.com/srinandan/envoy-router/server/routes"
+	token "github.com/srinandan/envoy-router/server/token"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+//check reports why a component is not ready, nil when it is
+type check struct {
+	name  string
+	check func() error
+}
+
+var checks []check
+var checksLock sync.Mutex
+
+//AddReadinessCheck registers a check for /readyz. The server is ready when all
+//checks return nil
+func AddReadinessCheck(name string, readiness func() error) {
+	checksLock.Lock()
+	defer checksLock.Unlock()
+	checks = append(checks, check{name: name, check: readiness})
+}
+
+//Server is the admin HTTP server. It serves metrics, the state of the routing
+//table and of the token cache, health and optionally pprof
+type Server struct {
+	server *http.Server
+}
+
+//NewServer returns an admin server for the port. pprof handlers are only
+//installed when enablePprof is set
+func NewServer(port int, enablePprof bool) *Server {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/routes", routesHandler)
+	mux.HandleFunc("/tokens", tokensHandler)
+	mux.HandleFunc("/healthz", healthzHandler)
+	mux.HandleFunc("/readyz", readyzHandler)
+
+	if enablePprof {
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	}
+
+	return &Server{
+		server: &http.Server{
+			Addr:              ":" + strconv.Itoa(port),
+			Handler:           mux,
+			ReadHeaderTimeout: 10 * time.Second,
+		},
+	}
+}
+
+//Start listens in the background
+func (s *Server) Start() {
+	slog.Info("starting admin server", "address", s.server.Addr)
+	go func() {
+		if err := s.server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			slog.Error("admin server", "error", err)
+		}
+	}()
+}
+
+//Shutdown stops the server, waiting for in-flight requests until the context expires
+func (s *Server) Shutdown(ctx context.Context) error {
+	return s.server.Shutdown(ctx)
+}
+
+func routesHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, struct {
+		Version    string             `json:"version"`
+		RouteRules []routes.RouteRule `json:"routerules"`
+	}{
+		Version:    routes.GetVersion(),
+		RouteRules: routes.GetRouteRules(),
+	})
+}
+
+func tokensHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, struct {
+		Tokens []token.TokenState `json:"tokens"`
+	}{
+		Tokens: token.GetTokenStates(),
+	})
+}
+
+//healthzHandler reports the process is alive
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte("ok\n"))
+}
+
+//readyzHandler runs the readiness checks, it returns 503 if one of them fails
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	checksLock.Lock()
+	registered := checks
+	checksLock.Unlock()
+
+	status := http.StatusOK
+	results := map[string]string{}
+	for _, c := range registered {
+		if err := c.check(); err != nil {
+			status = http.StatusServiceUnavailable
+			results[c.name] = err.Error()
+		} else {
+			results[c.name] = "ok"
+		}
+	}
+
+	writeJSON(w, status, results)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(v); err != nil {
+		slog.Error("admin server", "error", err)
+	}
+}
@@ -0,0 +1,209 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apikeys
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	auth "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	watcher "github.com/srinandan/envoy-router/server/watcher"
+)
+
+type Status string
+
+const (
+	ACTIVE  Status = "active"
+	REVOKED Status = "revoked"
+)
+
+//defaultHeader carries the api key when the route does not say where to find it
+const defaultHeader = "x-api-key"
+
+//ErrInvalidKey is returned when the key is missing, unknown, revoked, expired
+//or not allowed on the route
+var ErrInvalidKey = errors.New("invalid api key")
+
+//Key is an entry of the key store. Only the sha256 hash of the key is stored
+type Key struct {
+	ID     string    `json:"id,omitempty"`
+	Hash   string    `json:"hash,omitempty"`
+	App    string    `json:"app,omitempty"`
+	Routes []string  `json:"routes,omitempty"`
+	Expiry time.Time `json:"expiry,omitempty"`
+	Status Status    `json:"status,omitempty"`
+}
+
+//Requirement says where a route reads the api key from. The header is checked
+//before the query parameter
+type Requirement struct {
+	Header string `json:"header,omitempty"`
+	Query  string `json:"query,omitempty"`
+}
+
+type keystore struct {
+	Keys   []Key `json:"keys,omitempty"`
+	byHash map[string]*Key
+}
+
+//keyStore holds the active *keystore, it is replaced as a whole on reload
+var keyStore atomic.Value
+
+func init() {
+	keyStore.Store(&keystore{byHash: map[string]*Key{}})
+}
+
+func getKeyStore() *keystore {
+	return keyStore.Load().(*keystore)
+}
+
+//Hash returns the hex encoded sha256 hash of an api key, as written in the key store
+func Hash(apiKey string) string {
+	sum := sha256.Sum256([]byte(apiKey))
+	return hex.EncodeToString(sum[:])
+}
+
+//Compile checks the requirement, by default the key is read from x-api-key
+func (r *Requirement) Compile() error {
+	if r.Header == "" && r.Query == "" {
+		r.Header = defaultHeader
+	}
+	//envoy sends header names in lower case
+	r.Header = strings.ToLower(r.Header)
+	return nil
+}
+
+//Verify looks up the api key sent with the request and checks it may be used
+//on the route
+func (r *Requirement) Verify(req *auth.AttributeContext_HttpRequest, route string) (Key, error) {
+	apiKey := r.read(req)
+	if apiKey == "" {
+		return Key{}, fmt.Errorf("%w: api key missing", ErrInvalidKey)
+	}
+
+	key, found := getKeyStore().byHash[Hash(apiKey)]
+	if !found {
+		return Key{}, fmt.Errorf("%w: api key not found", ErrInvalidKey)
+	}
+	if key.Status != ACTIVE {
+		return Key{}, fmt.Errorf("%w: api key %s is %s", ErrInvalidKey, key.ID, key.Status)
+	}
+	if !key.Expiry.IsZero() && time.Now().After(key.Expiry) {
+		return Key{}, fmt.Errorf("%w: api key %s expired", ErrInvalidKey, key.ID)
+	}
+	if !key.allows(route) {
+		return Key{}, fmt.Errorf("%w: api key %s is not allowed on route %s", ErrInvalidKey, key.ID, route)
+	}
+
+	return *key, nil
+}
+
+func (r *Requirement) read(req *auth.AttributeContext_HttpRequest) string {
+	if r.Header != "" {
+		if value := req.Headers[r.Header]; value != "" {
+			return value
+		}
+	}
+	if r.Query != "" {
+		rawQuery := req.Query
+		if rawQuery == "" {
+			if i := strings.Index(req.Path, "?"); i != -1 {
+				rawQuery = req.Path[i+1:]
+			}
+		}
+		query, _ := url.ParseQuery(rawQuery)
+		return query.Get(r.Query)
+	}
+	return ""
+}
+
+//allows returns true if the key may be used on the route. A key without
+//routes may be used on every route
+func (k *Key) allows(route string) bool {
+	if len(k.Routes) == 0 {
+		return true
+	}
+	for _, name := range k.Routes {
+		if name == route {
+			return true
+		}
+	}
+	return false
+}
+
+//ReadKeysFile loads the key store. The active store is only replaced if the
+//new one is valid
+func ReadKeysFile(keysFile string) error {
+	keysBytes, err := ioutil.ReadFile(keysFile)
+	if err != nil {
+		return err
+	}
+
+	newKeyStore := &keystore{}
+	if err = json.Unmarshal(keysBytes, newKeyStore); err != nil {
+		return err
+	}
+
+	newKeyStore.byHash = make(map[string]*Key, len(newKeyStore.Keys))
+	for i := range newKeyStore.Keys {
+		k := &newKeyStore.Keys[i]
+		k.Hash = strings.ToLower(strings.TrimPrefix(k.Hash, "sha256:"))
+		if b, err := hex.DecodeString(k.Hash); err != nil || len(b) != sha256.Size {
+			return fmt.Errorf("keys[%d] (%s): hash must be a hex encoded sha256 hash", i, k.ID)
+		}
+		if k.App == "" {
+			return fmt.Errorf("keys[%d] (%s): app is empty", i, k.ID)
+		}
+		if k.Status == "" {
+			k.Status = ACTIVE
+		}
+		if k.Status != ACTIVE && k.Status != REVOKED {
+			return fmt.Errorf("keys[%d] (%s): unknown status %s", i, k.ID, k.Status)
+		}
+		if _, found := newKeyStore.byHash[k.Hash]; found {
+			return fmt.Errorf("keys[%d] (%s): hash is used by another key", i, k.ID)
+		}
+		newKeyStore.byHash[k.Hash] = k
+	}
+
+	keyStore.Store(newKeyStore)
+	return nil
+}
+
+//WatchKeysFile reloads the key store when the file changes. If the new file is
+//invalid, the last good store remains active
+func WatchKeysFile(keysFile string) (stop func(), err error) {
+	return watcher.Watch(keysFile, func() {
+		ReloadKeysFile(keysFile)
+	})
+}
+
+//ReloadKeysFile reloads the key store and logs the outcome
+func ReloadKeysFile(keysFile string) {
+	if err := ReadKeysFile(keysFile); err != nil {
+		slog.Error("unable to reload api keys, keeping the last good keys", "file", keysFile, "error", err)
+		return
+	}
+	slog.Info("reloaded api keys", "file", keysFile, "keys", len(getKeyStore().Keys))
+}
@@ -0,0 +1,258 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"sigs.k8s.io/yaml"
+)
+
+//Schema is the JSON schema of the configuration file
+//go:embed schema.json
+var Schema []byte
+
+//Config is the configuration of envoy-router. It is read from a YAML or JSON
+//file, then overridden by environment variables, then by flags
+type Config struct {
+	Routes    string          `json:"routes"`
+	APIKeys   string          `json:"apiKeys,omitempty"`
+	FailFast  bool            `json:"failFast"`
+	GRPC      GRPCConfig      `json:"grpc"`
+	Auth      AuthConfig      `json:"auth"`
+	ExtProc   ExtProcConfig   `json:"extProc"`
+	XDS       XDSConfig       `json:"xds"`
+	RateLimit RateLimitConfig `json:"rateLimit"`
+	Quota     QuotaConfig     `json:"quota"`
+	Admin     AdminConfig     `json:"admin"`
+	Health    HealthConfig    `json:"health"`
+	Log       LogConfig       `json:"log"`
+	Tracing   TracingConfig   `json:"tracing"`
+}
+
+type GRPCConfig struct {
+	Port                 int      `json:"port"`
+	Key                  string   `json:"key,omitempty"`
+	Cert                 string   `json:"cert,omitempty"`
+	MaxConcurrentStreams uint32   `json:"maxConcurrentStreams"`
+	MaxConnectionAge     Duration `json:"maxConnectionAge"`
+}
+
+type AuthConfig struct {
+	Disabled       bool     `json:"disabled"`
+	ServiceAccount string   `json:"serviceAccount"`
+	RefreshAhead   Duration `json:"refreshAhead"`
+}
+
+type ExtProcConfig struct {
+	Routing bool `json:"routing"`
+}
+
+type XDSConfig struct {
+	Enabled        bool   `json:"enabled"`
+	DynamicCluster string `json:"dynamicCluster"`
+}
+
+type RateLimitConfig struct {
+	Redis string `json:"redis,omitempty"`
+}
+
+type QuotaConfig struct {
+	File         string   `json:"file,omitempty"`
+	SaveInterval Duration `json:"saveInterval"`
+}
+
+type AdminConfig struct {
+	Port  int  `json:"port"`
+	Pprof bool `json:"pprof"`
+}
+
+type HealthConfig struct {
+	Interval         Duration `json:"interval"`
+	TokenGracePeriod Duration `json:"tokenGracePeriod"`
+	DrainPeriod      Duration `json:"drainPeriod"`
+}
+
+type LogConfig struct {
+	Level        string   `json:"level"`
+	Format       string   `json:"format"`
+	RedactFields []string `json:"redactFields,omitempty"`
+}
+
+type TracingConfig struct {
+	Endpoint    string  `json:"endpoint,omitempty"`
+	Insecure    bool    `json:"insecure"`
+	SampleRatio float64 `json:"sampleRatio"`
+}
+
+//Default returns the configuration used when nothing is set
+func Default() *Config {
+	return &Config{
+		Routes: "/etc/routes/routes.json",
+		GRPC: GRPCConfig{
+			Port:                 50051,
+			MaxConcurrentStreams: 10,
+			MaxConnectionAge:     Duration(10 * time.Minute),
+		},
+		Auth: AuthConfig{
+			ServiceAccount: "/etc/secrets/sa.json",
+			RefreshAhead:   Duration(5 * time.Minute),
+		},
+		XDS: XDSConfig{
+			DynamicCluster: "dynamic_forward_proxy_cluster",
+		},
+		Quota: QuotaConfig{
+			SaveInterval: Duration(10 * time.Second),
+		},
+		Admin: AdminConfig{
+			Port: 8081,
+		},
+		Health: HealthConfig{
+			Interval:         Duration(10 * time.Second),
+			TokenGracePeriod: Duration(2 * time.Minute),
+			DrainPeriod:      Duration(5 * time.Second),
+		},
+		Log: LogConfig{
+			Level:  "info",
+			Format: "json",
+		},
+		Tracing: TracingConfig{
+			Insecure:    true,
+			SampleRatio: 1,
+		},
+	}
+}
+
+//ReadFile overrides the configuration with the YAML or JSON file. Unknown
+//fields are rejected
+func (c *Config) ReadFile(file string) error {
+	configBytes, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	if err = yaml.UnmarshalStrict(configBytes, c); err != nil {
+		return fmt.Errorf("%s: %v", file, err)
+	}
+	return nil
+}
+
+//Validate checks the values the schema cannot
+func (c *Config) Validate() error {
+	if c.Routes == "" {
+		return fmt.Errorf("routes is required")
+	}
+	if c.GRPC.Port < 1 || c.GRPC.Port > 65535 {
+		return fmt.Errorf("grpc.port %d is not a valid port", c.GRPC.Port)
+	}
+	if (c.GRPC.Key == "") != (c.GRPC.Cert == "") {
+		return fmt.Errorf("both grpc.key and grpc.cert must be specified")
+	}
+	if c.GRPC.MaxConcurrentStreams == 0 {
+		return fmt.Errorf("grpc.maxConcurrentStreams must be greater than zero")
+	}
+	if c.GRPC.MaxConnectionAge <= 0 {
+		return fmt.Errorf("grpc.maxConnectionAge must be greater than zero")
+	}
+	if c.Auth.RefreshAhead < 0 {
+		return fmt.Errorf("auth.refreshAhead must not be negative")
+	}
+	if c.XDS.Enabled && c.XDS.DynamicCluster == "" {
+		return fmt.Errorf("xds.dynamicCluster is required when xds is enabled")
+	}
+	if c.Quota.SaveInterval <= 0 {
+		return fmt.Errorf("quota.saveInterval must be greater than zero")
+	}
+	if c.Admin.Port < 0 || c.Admin.Port > 65535 {
+		return fmt.Errorf("admin.port %d is not a valid port", c.Admin.Port)
+	}
+	if c.Admin.Port == c.GRPC.Port {
+		return fmt.Errorf("admin.port and grpc.port must be different")
+	}
+	if c.Health.Interval <= 0 {
+		return fmt.Errorf("health.interval must be greater than zero")
+	}
+	if c.Health.TokenGracePeriod < 0 {
+		return fmt.Errorf("health.tokenGracePeriod must not be negative")
+	}
+	if c.Health.DrainPeriod < 0 {
+		return fmt.Errorf("health.drainPeriod must not be negative")
+	}
+	switch strings.ToLower(c.Log.Level) {
+	case "debug", "info", "warn", "error":
+	default:
+		return fmt.Errorf("log.level must be debug, info, warn or error")
+	}
+	if c.Log.Format != "json" && c.Log.Format != "text" {
+		return fmt.Errorf("log.format must be json or text")
+	}
+	if c.Tracing.SampleRatio < 0 || c.Tracing.SampleRatio > 1 {
+		return fmt.Errorf("tracing.sampleRatio must be between 0 and 1")
+	}
+	return nil
+}
+
+//Redacted returns a copy of the configuration without secrets, for printing
+func (c *Config) Redacted() *Config {
+	redacted := *c
+	if u, err := url.Parse(c.RateLimit.Redis); err == nil && u.User != nil {
+		if _, ok := u.User.Password(); ok {
+			u.User = url.UserPassword(u.User.Username(), "REDACTED")
+			redacted.RateLimit.Redis = u.String()
+		}
+	}
+	return &redacted
+}
+
+//Duration is a time.Duration written as a string, ex: 10m or 30s
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		//plain numbers are seconds
+		seconds, numberErr := strconv.ParseFloat(string(b), 64)
+		if numberErr != nil {
+			return fmt.Errorf("invalid duration %s", string(b))
+		}
+		*d = Duration(seconds * float64(time.Second))
+		return nil
+	}
+	return d.Set(s)
+}
+
+//Set parses a duration, it lets Duration be used as a flag
+func (d *Duration) Set(s string) error {
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return fmt.Errorf("invalid duration %s", s)
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
@@ -0,0 +1,291 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+//envPrefix is the prefix of the environment variables that override the file
+const envPrefix = "ENVOY_ROUTER_"
+
+//configEnv names the configuration file when -config is not set
+const configEnv = envPrefix + "CONFIG"
+
+//setting is a configuration value that can be set by a flag and environment
+//variables. path is the field in the configuration file
+type setting struct {
+	path   string
+	flag   string
+	usage  string
+	legacy []string
+	value  func(c *Config) flag.Value
+}
+
+var settings = []setting{
+	{"routes", "routes", "A file containing routes", nil,
+		func(c *Config) flag.Value { return (*stringValue)(&c.Routes) }},
+	{"apiKeys", "apikeys", "A file containing hashed api keys", nil,
+		func(c *Config) flag.Value { return (*stringValue)(&c.APIKeys) }},
+	{"failFast", "fail-fast", "Exit if the routing table is invalid at startup", nil,
+		func(c *Config) flag.Value { return (*boolValue)(&c.FailFast) }},
+	{"grpc.port", "grpc-port", "The gRPC port", []string{"GRPC_PORT"},
+		func(c *Config) flag.Value { return (*intValue)(&c.GRPC.Port) }},
+	{"grpc.key", "key", "A file containing the private key", nil,
+		func(c *Config) flag.Value { return (*stringValue)(&c.GRPC.Key) }},
+	{"grpc.cert", "cert", "A file containing the public key key", nil,
+		func(c *Config) flag.Value { return (*stringValue)(&c.GRPC.Cert) }},
+	{"grpc.maxConcurrentStreams", "max-concurrent-streams", "Maximum concurrent streams per gRPC connection", nil,
+		func(c *Config) flag.Value { return (*uint32Value)(&c.GRPC.MaxConcurrentStreams) }},
+	{"grpc.maxConnectionAge", "max-connection-age", "Maximum age of a gRPC connection", nil,
+		func(c *Config) flag.Value { return &c.GRPC.MaxConnectionAge }},
+	{"auth.disabled", "disable-auth", "Do not warm the upstream token cache at startup", []string{"DISABLE_AUTH"},
+		func(c *Config) flag.Value { return (*boolValue)(&c.Auth.Disabled) }},
+	{"auth.serviceAccount", "sa", "GCP Service Account JSON file", nil,
+		func(c *Config) flag.Value { return (*stringValue)(&c.Auth.ServiceAccount) }},
+	{"auth.refreshAhead", "refresh-ahead", "Refresh upstream tokens this long before they expire", nil,
+		func(c *Config) flag.Value { return &c.Auth.RefreshAhead }},
+	{"extProc.routing", "extproc-routing", "Route requests in the external processing server", []string{"ENABLE_ROUTING"},
+		func(c *Config) flag.Value { return (*boolValue)(&c.ExtProc.Routing) }},
+	{"xds.enabled", "xds", "Serve the routing table to Envoy over xDS (RDS and CDS)", nil,
+		func(c *Config) flag.Value { return (*boolValue)(&c.XDS.Enabled) }},
+	{"xds.dynamicCluster", "xds-cluster", "Envoy cluster for routes that need the ext_authz callout", nil,
+		func(c *Config) flag.Value { return (*stringValue)(&c.XDS.DynamicCluster) }},
+	{"rateLimit.redis", "ratelimit-redis", "Share rate limits between replicas through redis at host:port or redis://[:password@]host:port[/db]", nil,
+		func(c *Config) flag.Value { return (*stringValue)(&c.RateLimit.Redis) }},
+	{"quota.file", "quota-file", "A file to save quota counters to, so they survive restarts", nil,
+		func(c *Config) flag.Value { return (*stringValue)(&c.Quota.File) }},
+	{"quota.saveInterval", "quota-save-interval", "How often quota counters are saved", nil,
+		func(c *Config) flag.Value { return &c.Quota.SaveInterval }},
+	{"admin.port", "admin-port", "The admin HTTP port for metrics, health and debugging, 0 disables it", nil,
+		func(c *Config) flag.Value { return (*intValue)(&c.Admin.Port) }},
+	{"admin.pprof", "admin-pprof", "Serve /debug/pprof on the admin port", nil,
+		func(c *Config) flag.Value { return (*boolValue)(&c.Admin.Pprof) }},
+	{"health.interval", "health-interval", "How often the gRPC health status is updated and failed token fetches are retried", nil,
+		func(c *Config) flag.Value { return &c.Health.Interval }},
+	{"health.tokenGracePeriod", "health-token-grace-period", "How long upstream token fetches may fail before the authorization service is not serving", nil,
+		func(c *Config) flag.Value { return &c.Health.TokenGracePeriod }},
+	{"health.drainPeriod", "health-drain-period", "How long the services report not serving on shutdown before the gRPC server stops", nil,
+		func(c *Config) flag.Value { return &c.Health.DrainPeriod }},
+	{"log.level", "log-level", "Log level: debug, info, warn or error", nil,
+		func(c *Config) flag.Value { return (*stringValue)(&c.Log.Level) }},
+	{"log.format", "log-format", "Log format: json or text", nil,
+		func(c *Config) flag.Value { return (*stringValue)(&c.Log.Format) }},
+	{"log.redactFields", "log-redact-fields", "Comma separated header names and body fields to redact from logs", nil,
+		func(c *Config) flag.Value { return (*stringListValue)(&c.Log.RedactFields) }},
+	{"tracing.endpoint", "tracing-endpoint", "host:port of an OTLP gRPC collector to export spans to", nil,
+		func(c *Config) flag.Value { return (*stringValue)(&c.Tracing.Endpoint) }},
+	{"tracing.insecure", "tracing-insecure", "Export spans without TLS", nil,
+		func(c *Config) flag.Value { return (*boolValue)(&c.Tracing.Insecure) }},
+	{"tracing.sampleRatio", "tracing-sample-ratio", "Share of traces sampled when envoy did not decide, between 0 and 1", nil,
+		func(c *Config) flag.Value { return (*float64Value)(&c.Tracing.SampleRatio) }},
+}
+
+//Load builds the configuration. Later sources override earlier ones:
+//defaults, the configuration file, environment variables, then flags set on
+//the command line
+func Load(fs *flag.FlagSet, args []string) (*Config, error) {
+	var configFile string
+	fs.StringVar(&configFile, "config", "", "A YAML or JSON configuration file, also read from $"+configEnv)
+
+	defaults := Default()
+	raw := make([]rawValue, len(settings))
+	for i, s := range settings {
+		raw[i].isBool = isBool(s.value(defaults))
+		raw[i].value = s.value(defaults).String()
+		fs.Var(&raw[i], s.flag, fmt.Sprintf("%s (%s, $%s)", s.usage, s.path, EnvName(s.path)))
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	cfg := Default()
+
+	if configFile == "" {
+		configFile = os.Getenv(configEnv)
+	}
+	if configFile != "" {
+		if err := cfg.ReadFile(configFile); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, s := range settings {
+		//the documented name wins over the legacy ones
+		names := append(append([]string{}, s.legacy...), EnvName(s.path))
+		for _, name := range names {
+			if value, found := os.LookupEnv(name); found && value != "" {
+				if err := s.value(cfg).Set(value); err != nil {
+					return nil, fmt.Errorf("$%s: %v", name, err)
+				}
+			}
+		}
+	}
+
+	var err error
+	fs.Visit(func(f *flag.Flag) {
+		for i, s := range settings {
+			if s.flag == f.Name && err == nil {
+				if setErr := s.value(cfg).Set(raw[i].value); setErr != nil {
+					err = fmt.Errorf("-%s: %v", f.Name, setErr)
+				}
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return cfg, cfg.Validate()
+}
+
+//EnvName returns the environment variable for a configuration path, ex:
+//grpc.maxConcurrentStreams is ENVOY_ROUTER_GRPC_MAX_CONCURRENT_STREAMS
+func EnvName(path string) string {
+	var b strings.Builder
+	b.WriteString(envPrefix)
+	for i, r := range path {
+		switch {
+		case r == '.':
+			b.WriteByte('_')
+		case unicode.IsUpper(r) && i > 0 && path[i-1] != '.' && !unicode.IsUpper(rune(path[i-1])):
+			b.WriteByte('_')
+			b.WriteRune(r)
+		default:
+			b.WriteRune(unicode.ToUpper(r))
+		}
+	}
+	return b.String()
+}
+
+//rawValue holds a flag as typed until the configuration file is read
+type rawValue struct {
+	value  string
+	isBool bool
+}
+
+func (r *rawValue) String() string {
+	if r == nil {
+		return ""
+	}
+	return r.value
+}
+
+func (r *rawValue) Set(s string) error {
+	r.value = s
+	return nil
+}
+
+func (r *rawValue) IsBoolFlag() bool {
+	return r.isBool
+}
+
+func isBool(v flag.Value) bool {
+	_, ok := v.(*boolValue)
+	return ok
+}
+
+type stringValue string
+
+func (s *stringValue) Set(v string) error {
+	*s = stringValue(v)
+	return nil
+}
+
+func (s *stringValue) String() string {
+	return string(*s)
+}
+
+type boolValue bool
+
+func (b *boolValue) Set(v string) error {
+	parsed, err := strconv.ParseBool(v)
+	if err != nil {
+		return fmt.Errorf("invalid boolean %s", v)
+	}
+	*b = boolValue(parsed)
+	return nil
+}
+
+func (b *boolValue) String() string {
+	return strconv.FormatBool(bool(*b))
+}
+
+type intValue int
+
+func (i *intValue) Set(v string) error {
+	parsed, err := strconv.Atoi(v)
+	if err != nil {
+		return fmt.Errorf("invalid number %s", v)
+	}
+	*i = intValue(parsed)
+	return nil
+}
+
+func (i *intValue) String() string {
+	return strconv.Itoa(int(*i))
+}
+
+type uint32Value uint32
+
+func (u *uint32Value) Set(v string) error {
+	parsed, err := strconv.ParseUint(v, 10, 32)
+	if err != nil {
+		return fmt.Errorf("invalid number %s", v)
+	}
+	*u = uint32Value(parsed)
+	return nil
+}
+
+func (u *uint32Value) String() string {
+	return strconv.FormatUint(uint64(*u), 10)
+}
+
+type float64Value float64
+
+func (f *float64Value) Set(v string) error {
+	parsed, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return fmt.Errorf("invalid number %s", v)
+	}
+	*f = float64Value(parsed)
+	return nil
+}
+
+func (f *float64Value) String() string {
+	return strconv.FormatFloat(float64(*f), 'g', -1, 64)
+}
+
+type stringListValue []string
+
+func (l *stringListValue) Set(v string) error {
+	*l = nil
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*l = append(*l, item)
+		}
+	}
+	return nil
+}
+
+func (l *stringListValue) String() string {
+	return strings.Join(*l, ",")
+}
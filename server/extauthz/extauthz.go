@@ -15,25 +15,59 @@
 package extauthz
 
 import (
-	"encoding/json"
+	"errors"
+	"log/slog"
+	"strconv"
 	"strings"
+	"time"
 
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
+	"google.golang.org/protobuf/types/known/structpb"
 	"google.golang.org/protobuf/types/known/wrapperspb"
 
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
+	jwtauth "github.com/srinandan/envoy-router/server/jwtauth"
+	logging "github.com/srinandan/envoy-router/server/logging"
+	metrics "github.com/srinandan/envoy-router/server/metrics"
+	quota "github.com/srinandan/envoy-router/server/quota"
+	ratelimit "github.com/srinandan/envoy-router/server/ratelimit"
 	routes "github.com/srinandan/envoy-router/server/routes"
 	token "github.com/srinandan/envoy-router/server/token"
+	tracing "github.com/srinandan/envoy-router/server/tracing"
 	rpcstatus "google.golang.org/genproto/googleapis/rpc/status"
 
 	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
 	auth "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	typev3 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
 	"github.com/gogo/googleapis/google/rpc"
-	"github.com/srinandan/sample-apps/common"
 )
 
 const unAuthErrString = "Failed to obtain upstream access token"
 
+//variantHeader is returned to the client with the backend variant picked for the request
+const variantHeader = "x-envoy-router-variant"
+
+//appHeader and keyIDHeader are sent upstream with the app identity of the api key
+const appHeader = "x-envoy-router-app"
+const keyIDHeader = "x-envoy-router-key-id"
+
+//upstream is the routing decision for a request
+type upstream struct {
+	route     string
+	variant   string
+	backend   string
+	basepath  string
+	auth      routes.Auth
+	audience  string
+	app       string
+	keyID     string
+	rateLimit *ratelimit.Result
+	quota     *quota.Result
+}
+
 // inspired by https://github.com/salrashid123/envoy_external_authz/blob/master/authz_server/grpc_server.go
 
 // Register registers
@@ -45,45 +79,146 @@ func (a *AuthorizationServer) Register(s *grpc.Server) {
 type AuthorizationServer struct{}
 
 func (a *AuthorizationServer) Check(ctx context.Context, req *auth.CheckRequest) (*auth.CheckResponse, error) {
-	common.Info.Println(">>> Authorization called check()")
+	start := time.Now()
+	headers := req.GetAttributes().GetRequest().GetHttp().GetHeaders()
+
+	ctx, span := tracing.Start(tracing.Extract(ctx, headers), "ext_authz.Check", trace.WithSpanKind(trace.SpanKindServer))
+	defer span.End()
+
+	log := logging.ForRequest(headers)
+	if sc := span.SpanContext(); sc.IsValid() {
+		log = log.With("trace_id", sc.TraceID().String())
+	}
+	ctx = logging.NewContext(ctx, log)
+
+	labels := metrics.Check{}
+	resp := check(ctx, req, &labels)
+
+	elapsed := time.Since(start)
+	outcome := decision(resp)
+	metrics.ObserveCheck(labels, outcome, elapsed)
+	log.Info("check", "route", labels.Route, "backend", labels.Backend, "decision", outcome, "duration", elapsed)
+
+	span.SetAttributes(
+		tracing.RouteKey.String(labels.Route),
+		tracing.BackendKey.String(labels.Backend),
+		tracing.DecisionKey.String(outcome),
+	)
+	if outcome == metrics.DECISION_ERROR {
+		span.SetStatus(codes.Error, outcome)
+	}
+	return resp, nil
+}
+
+//check authorizes and routes the request, it fills in the metric labels as
+//the route and backend become known
+func check(ctx context.Context, req *auth.CheckRequest, labels *metrics.Check) *auth.CheckResponse {
+	log := logging.FromContext(ctx)
 
 	if req.Attributes != nil &&
 		req.Attributes.Request != nil &&
 		req.Attributes.Request.Http != nil &&
 		req.Attributes.Request.Http.Headers != nil {
-		common.Info.Printf(">>>> ExtAuthz_Request_headers: %v \n", req.Attributes.Request.Http.Headers)
+		log.Debug("ext_authz request headers", "headers", logging.Headers(req.Attributes.Request.Http.Headers))
 	}
 
 	if req.Attributes != nil && req.Attributes.ContextExtensions != nil {
-		if ct, err := json.MarshalIndent(req.Attributes.ContextExtensions, "", "  "); err == nil {
-			common.Info.Printf(">>>> Context Extensions: %s\n", string(ct))
-		}
+		log.Debug("ext_authz context extensions", "extensions", logging.Headers(req.Attributes.ContextExtensions))
 	}
 
 	if req.Attributes != nil &&
 		req.Attributes.Request != nil &&
 		req.Attributes.Request.Http != nil {
 
-		if req.Attributes.Request.Http.Body != "" {
-			common.Info.Printf(">>>> Payload: %s\n", req.Attributes.Request.Http.Body)
+		if body := req.Attributes.Request.Http.RawBody; len(body) > 0 || req.Attributes.Request.Http.Body != "" {
+			if len(body) == 0 {
+				body = []byte(req.Attributes.Request.Http.Body)
+			}
+			log.Debug("ext_authz request body", "body", logging.Body{
+				Raw:         body,
+				ContentType: req.Attributes.Request.Http.Headers["content-type"],
+			})
 		}
 
-		if r, found := routes.GetRoute(req.Attributes.Request.Http.Path); found {
-			basepath := routes.ReplacePrefix(req.Attributes.Request.Http.Path, r.Prefix)
-			basepath = routes.GetFullPath(basepath, r.BackendPrefix)
-			common.Info.Printf(">>>> Path: %s\n", basepath)
-			return checkResponse(r.Backend, basepath, r.Authentication), nil
+		if r, found := routes.GetRouteContext(ctx, req.Attributes.Request.Http); found {
+			labels.Route, labels.Backend, labels.Auth = r.Name, r.Backend, r.Authentication.String()
+			caller := ratelimit.Caller{
+				IP:      getClientID(req),
+				Headers: req.Attributes.Request.Http.Headers,
+			}
+			if r.JWT != nil {
+				claims, err := r.JWT.Verify(ctx, req.Attributes.Request.Http.Headers)
+				if err != nil {
+					log.Info("client jwt rejected", "route", r.Name, "error", err)
+					return checkJWTDeniedResponse(err)
+				}
+				caller.Subject, _ = claims["sub"].(string)
+			}
+			u := upstream{
+				route:    r.Name,
+				basepath: r.GetBackendPath(req.Attributes.Request.Http.Path),
+				auth:     r.Authentication,
+			}
+			if r.APIKey != nil {
+				key, err := r.APIKey.Verify(req.Attributes.Request.Http, r.Name)
+				if err != nil {
+					log.Info("api key rejected", "route", r.Name, "error", err)
+					return checkDeniedResponse(rpc.UNAUTHENTICATED, typev3.StatusCode_Unauthorized, "Invalid API key")
+				}
+				u.app, u.keyID = key.App, key.ID
+				caller.APIKey = key.Hash
+			}
+			if r.RateLimit != nil {
+				limited := r.RateLimit.Allow(ctx, r.Name, caller)
+				if !limited.Allowed {
+					log.Info("rate limited", "route", r.Name, "client", caller.IP)
+					return checkDeniedResponse(rpc.RESOURCE_EXHAUSTED, typev3.StatusCode_TooManyRequests, "Too Many Requests",
+						append(rateLimitHeaders(limited), setHeader("retry-after", ratelimit.Seconds(limited.RetryAfter), false))...)
+				}
+				u.rateLimit = &limited
+			}
+			if r.Quota != nil {
+				used := r.Quota.Allow(caller)
+				if !used.Allowed {
+					log.Info("quota exhausted", "route", r.Name, "product", r.Quota.Product, "client", caller.IP)
+					return checkDeniedResponse(rpc.RESOURCE_EXHAUSTED, typev3.StatusCode_TooManyRequests, r.Quota.DenyBody,
+						append(quotaHeaders(used),
+							setHeader("content-type", r.Quota.DenyContentType, false),
+							setHeader("retry-after", ratelimit.Seconds(used.Reset), false))...)
+				}
+				u.quota = &used
+			}
+			u.variant, u.backend = r.SelectBackend(req.Attributes.Request.Http, caller.IP)
+			labels.Backend = u.backend
+			u.audience = r.GetAudience(u.backend)
+			return checkResponse(ctx, log, u)
 		} else {
-			return checkNotFoundResponse(), nil
+			return checkNotFoundResponse()
 		}
 
 	}
 
-	return checkNotFoundResponse(), nil
+	return checkNotFoundResponse()
+}
+
+//decision names the outcome of a check for metrics
+func decision(resp *auth.CheckResponse) string {
+	switch rpc.Code(resp.GetStatus().GetCode()) {
+	case rpc.OK:
+		return metrics.DECISION_OK
+	case rpc.NOT_FOUND:
+		return metrics.DECISION_NOT_FOUND
+	case rpc.UNAUTHENTICATED:
+		return metrics.DECISION_UNAUTHENTICATED
+	case rpc.PERMISSION_DENIED:
+		return metrics.DECISION_DENIED
+	case rpc.RESOURCE_EXHAUSTED:
+		return metrics.DECISION_RATE_LIMITED
+	}
+	return metrics.DECISION_ERROR
 }
 
 func checkNotFoundResponse() *auth.CheckResponse {
-	common.Info.Println(">>> Authorization CheckResponse_NOTFOUND")
 	return &auth.CheckResponse{
 		Status: &rpcstatus.Status{
 			Code: int32(rpc.NOT_FOUND),
@@ -91,45 +226,107 @@ func checkNotFoundResponse() *auth.CheckResponse {
 	}
 }
 
-func checkResponse(backend string, basepath string, a routes.Auth) *auth.CheckResponse {
-	common.Info.Println(">>> Authorization CheckResponse_OkResponse")
-	common.Info.Printf(">>>> Selecting route %s %s %d\n", backend, basepath, a)
+func checkResponse(ctx context.Context, log *slog.Logger, u upstream) *auth.CheckResponse {
+	log.Debug("selected backend", "route", u.route, "backend", u.backend, "path", u.basepath, "auth", u.auth.String(), "variant", u.variant)
 
 	var accessToken string
+	var err error
 
-	if a == routes.ACCESS_TOKEN {
-		common.Info.Println(">>>> Route has access token auth model")
-		oauthToken := token.AccessToken{}
-		if accessToken = oauthToken.GetAccessToken(); accessToken == "" {
-			if err := oauthToken.ObtainAccessToken(); err != nil {
-				common.Error.Println(err)
-				return &auth.CheckResponse{
-					Status: &rpcstatus.Status{
-						Code: int32(rpc.UNAUTHENTICATED),
-					},
-					HttpResponse: &auth.CheckResponse_DeniedResponse{
-						DeniedResponse: &auth.DeniedHttpResponse{
-							Body: unAuthErrString,
-						},
-					},
-				}
-			}
-			accessToken = oauthToken.GetAccessToken()
-			common.Info.Println(">>>> Access token ", accessToken)
+	switch u.auth {
+	case routes.ACCESS_TOKEN:
+		if accessToken, err = token.GetAccessToken(ctx); err != nil {
+			log.Error("unable to fetch an upstream access token", "route", u.route, "error", err)
+			return checkUnauthenticatedResponse()
+		}
+	case routes.OIDC_TOKEN:
+		if accessToken, err = token.GetIDToken(ctx, u.audience); err != nil {
+			log.Error("unable to fetch an upstream id token", "route", u.route, "audience", u.audience, "error", err)
+			return checkUnauthenticatedResponse()
 		}
 	}
 
-	return &auth.CheckResponse{
+	okResponse := &auth.OkHttpResponse{
+		Headers: headers(
+			setHeader("host", u.backend, false),
+			setHeader(":path", u.basepath, false),
+			setAuthHeader(accessToken),
+			setHeader(appHeader, u.app, false),
+			setHeader(keyIDHeader, u.keyID, false),
+			setHeader(routes.RouteHeader, u.route, false),
+		),
+	}
+
+	if u.app == "" {
+		//the app identity headers are only trusted when set by the router
+		okResponse.HeadersToRemove = []string{appHeader, keyIDHeader}
+	}
+	if u.route == "" {
+		okResponse.HeadersToRemove = append(okResponse.HeadersToRemove, routes.RouteHeader)
+	}
+
+	resp := &auth.CheckResponse{
 		Status: &rpcstatus.Status{
 			Code: int32(rpc.OK),
 		},
 		HttpResponse: &auth.CheckResponse_OkResponse{
-			OkResponse: &auth.OkHttpResponse{
-				Headers: []*corev3.HeaderValueOption{
-					setHeader("host", backend, false),
-					setHeader(":path", basepath, false),
-					setAuthHeader(accessToken),
-				},
+			OkResponse: okResponse,
+		},
+	}
+
+	if u.rateLimit != nil {
+		okResponse.ResponseHeadersToAdd = append(okResponse.ResponseHeadersToAdd, rateLimitHeaders(*u.rateLimit)...)
+	}
+
+	if u.quota != nil {
+		okResponse.ResponseHeadersToAdd = append(okResponse.ResponseHeadersToAdd, quotaHeaders(*u.quota)...)
+	}
+
+	if u.variant != "" {
+		okResponse.ResponseHeadersToAdd = append(okResponse.ResponseHeadersToAdd, setHeader(variantHeader, u.variant, false))
+		resp.DynamicMetadata, _ = structpb.NewStruct(map[string]interface{}{
+			"route":   u.route,
+			"variant": u.variant,
+			"backend": u.backend,
+		})
+	}
+
+	return resp
+}
+
+func checkUnauthenticatedResponse() *auth.CheckResponse {
+	return &auth.CheckResponse{
+		Status: &rpcstatus.Status{
+			Code: int32(rpc.UNAUTHENTICATED),
+		},
+		HttpResponse: &auth.CheckResponse_DeniedResponse{
+			DeniedResponse: &auth.DeniedHttpResponse{
+				Body: unAuthErrString,
+			},
+		},
+	}
+}
+
+//checkJWTDeniedResponse returns 401 when the client token is missing or invalid
+//and 403 when it does not carry the claims the route requires
+func checkJWTDeniedResponse(err error) *auth.CheckResponse {
+	if errors.Is(err, jwtauth.ErrForbidden) {
+		return checkDeniedResponse(rpc.PERMISSION_DENIED, typev3.StatusCode_Forbidden, "Forbidden",
+			setHeader("www-authenticate", `Bearer error="insufficient_scope"`, false))
+	}
+	return checkDeniedResponse(rpc.UNAUTHENTICATED, typev3.StatusCode_Unauthorized, "Unauthorized",
+		setHeader("www-authenticate", `Bearer realm="envoy-router"`, false))
+}
+
+func checkDeniedResponse(code rpc.Code, status typev3.StatusCode, body string, options ...*corev3.HeaderValueOption) *auth.CheckResponse {
+	return &auth.CheckResponse{
+		Status: &rpcstatus.Status{
+			Code: int32(code),
+		},
+		HttpResponse: &auth.CheckResponse_DeniedResponse{
+			DeniedResponse: &auth.DeniedHttpResponse{
+				Status:  &typev3.HttpStatus{Code: status},
+				Headers: headers(options...),
+				Body:    body,
 			},
 		},
 	}
@@ -152,6 +349,42 @@ func setHeader(name string, value string, append bool) *corev3.HeaderValueOption
 	}
 }
 
+//rateLimitHeaders tells the client how many requests it has left
+func rateLimitHeaders(r ratelimit.Result) []*corev3.HeaderValueOption {
+	return headers(
+		setHeader("x-ratelimit-limit", strconv.FormatUint(uint64(r.Limit), 10), false),
+		setHeader("x-ratelimit-remaining", strconv.FormatUint(uint64(r.Remaining), 10), false),
+		setHeader("x-ratelimit-reset", ratelimit.Seconds(r.Reset), false),
+	)
+}
+
+//quotaHeaders tells the client how many requests are left in the quota window
+func quotaHeaders(q quota.Result) []*corev3.HeaderValueOption {
+	return headers(
+		setHeader("x-quota-limit", strconv.FormatUint(q.Limit, 10), false),
+		setHeader("x-quota-remaining", strconv.FormatUint(q.Remaining, 10), false),
+		setHeader("x-quota-reset", ratelimit.Seconds(q.Reset), false),
+	)
+}
+
+//headers drops the headers that were not set
+func headers(options ...*corev3.HeaderValueOption) []*corev3.HeaderValueOption {
+	var set []*corev3.HeaderValueOption
+	for _, option := range options {
+		if option != nil {
+			set = append(set, option)
+		}
+	}
+	return set
+}
+
+//getClientID returns the address of the downstream client as envoy sees it.
+//x-forwarded-for is not read, the client sets it. Behind a load balancer, set
+//xff_num_trusted_hops in envoy so that the source address is the client's
+func getClientID(req *auth.CheckRequest) string {
+	return req.Attributes.GetSource().GetAddress().GetSocketAddress().GetAddress()
+}
+
 func setAuthHeader(accessToken string) *corev3.HeaderValueOption {
 	if accessToken != "" {
 		return setHeader("authorization", strings.Join([]string{"Bearer", accessToken}, " "), false)
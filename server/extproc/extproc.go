@@ -15,16 +15,28 @@
 package extproc
 
 import (
+	"context"
+	"fmt"
 	"io"
-	"os"
+	"net/http"
+	"sort"
 	"strconv"
+	"time"
 
 	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
 	ext_proc "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/ext_proc/v3"
+	auth "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
 	proc "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
+	typev3 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
 	"github.com/golang/protobuf/ptypes/wrappers"
+	logging "github.com/srinandan/envoy-router/server/logging"
+	metrics "github.com/srinandan/envoy-router/server/metrics"
+	mock "github.com/srinandan/envoy-router/server/mock"
+	openapi "github.com/srinandan/envoy-router/server/openapi"
 	routes "github.com/srinandan/envoy-router/server/routes"
-	common "github.com/srinandan/sample-apps/common"
+	tracing "github.com/srinandan/envoy-router/server/tracing"
+	transform "github.com/srinandan/envoy-router/server/transform"
+	"go.opentelemetry.io/otel/trace"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
@@ -32,7 +44,9 @@ import (
 
 const statusField = ":status"
 
-var routing = os.Getenv("ENABLE_ROUTING")
+const contentTypeHeader = "content-type"
+
+const contentLengthHeader = "content-length"
 
 // Register registers
 func (e *ExternalProcessingServer) Register(s *grpc.Server) {
@@ -40,12 +54,18 @@ func (e *ExternalProcessingServer) Register(s *grpc.Server) {
 }
 
 // ExternalProcessingServer server
-type ExternalProcessingServer struct{}
+type ExternalProcessingServer struct {
+	//Routing sets the backend host and path from the routing table
+	Routing bool
+}
 
 func (e *ExternalProcessingServer) Process(srv proc.ExternalProcessor_ProcessServer) error {
 	var resp *proc.ProcessingResponse
 
 	ctx := srv.Context()
+	s := newStream(ctx)
+	defer s.finish()
+
 	for {
 		select {
 		case <-ctx.Done():
@@ -60,115 +80,448 @@ func (e *ExternalProcessingServer) Process(srv proc.ExternalProcessor_ProcessSer
 			return status.Errorf(codes.Unknown, "cannot receive stream request: %v", err)
 		}
 
+		if v, ok := req.Request.(*proc.ProcessingRequest_RequestHeaders); ok {
+			s.setRequest(getHttpRequest(v), v.RequestHeaders.GetEndOfStream())
+		}
+
+		phase := getPhase(req)
+		metrics.ObserveExtProcMessage(phase)
+		phaseCtx, span := tracing.Start(s.ctx, "ext_proc."+phase, trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(tracing.PhaseKey.String(phase)))
+
 		switch v := req.Request.(type) {
 		case *proc.ProcessingRequest_RequestHeaders:
-			resp = processRequestHeaders(v)
+			resp = s.processRequestHeaders(phaseCtx, e.Routing)
 		case *proc.ProcessingRequest_RequestBody:
-			resp = processRequestBody(v)
+			resp = s.processRequestBody(v)
 		case *proc.ProcessingRequest_ResponseHeaders:
-			resp = processResponseHeaders(v)
+			resp = s.processResponseHeaders(v)
 		case *proc.ProcessingRequest_ResponseBody:
-			resp = processResponseBody(v)
+			resp = s.processResponseBody(v)
 		default:
-			common.Error.Printf("Unknown Request type %v\n", v)
+			s.log.Error("unknown ext_proc request type", "type", fmt.Sprintf("%T", v))
+			span.End()
+			continue
+		}
+		if s.delay > 0 {
+			//envoy cancels the stream when the client goes away or message_timeout expires
+			if err := wait(ctx, s.delay); err != nil {
+				span.End()
+				return err
+			}
+			s.delay = 0
 		}
 		if err := srv.Send(resp); err != nil {
-			common.Error.Printf("send error %v", err)
+			s.log.Error("unable to send ext_proc response", "error", err)
+			span.RecordError(err)
 		}
+		span.End()
 	}
 }
 
-func processResponseHeaders(headers *proc.ProcessingRequest_ResponseHeaders) *proc.ProcessingResponse {
-	common.Info.Printf("<<< ProcessingRequest_ResponseHeaders %v \n", headers)
-	resp := &proc.ProcessingResponse{}
-	var status int
+//wait returns after d, or the error of ctx if it is done first
+func wait(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
 
-	for _, header := range headers.ResponseHeaders.Headers.Headers {
-		if header.Key == statusField {
-			status, _ = strconv.Atoi(header.Value)
-		}
+//getPhase names the phase of the request for metrics and traces
+func getPhase(req *proc.ProcessingRequest) string {
+	switch req.Request.(type) {
+	case *proc.ProcessingRequest_RequestHeaders:
+		return metrics.PHASE_REQUEST_HEADERS
+	case *proc.ProcessingRequest_RequestBody:
+		return metrics.PHASE_REQUEST_BODY
+	case *proc.ProcessingRequest_ResponseHeaders:
+		return metrics.PHASE_RESPONSE_HEADERS
+	case *proc.ProcessingRequest_ResponseBody:
+		return metrics.PHASE_RESPONSE_BODY
 	}
+	return metrics.PHASE_UNKNOWN
+}
 
-	if status < 300 { //successful response from the upstream
-		responseHeaders := &proc.HeadersResponse{
-			Response: &proc.CommonResponse{
-				HeaderMutation: &proc.HeaderMutation{
-					SetHeaders: []*core.HeaderValueOption{
-						//add a sample header
-						setHeader("x-apigee-response-ext_proc", "test-value", false),
-					},
-				},
-				Status: proc.CommonResponse_CONTINUE,
-			},
-		}
+//processResponseHeaders applies the response headers policies of the rule of
+//the request that apply to the status of the response
+func (s *stream) processResponseHeaders(headers *proc.ProcessingRequest_ResponseHeaders) *proc.ProcessingResponse {
+	s.log.Debug("ext_proc response headers", "headers", headerMap(headers.ResponseHeaders.GetHeaders()))
 
-		resp.Response = &proc.ProcessingResponse_ResponseHeaders{
-			ResponseHeaders: responseHeaders,
+	for _, header := range headers.ResponseHeaders.GetHeaders().GetHeaders() {
+		switch header.Key {
+		case statusField:
+			s.status, _ = strconv.Atoi(header.Value)
+		case contentTypeHeader:
+			s.responseContentType = header.Value
 		}
+	}
+
+	response := &proc.CommonResponse{
+		Status: proc.CommonResponse_CONTINUE,
+	}
 
-		resp.ModeOverride = &ext_proc.ProcessingMode{
-			ResponseHeaderMode: ext_proc.ProcessingMode_SEND,
+	if s.routeFound {
+		mutation := s.route.GetResponseHeaders(s.status, s.attributes())
+		if s.route.ResponseTransform != nil {
+			//the length of the transformed body is not known yet
+			mutation.Remove = append(mutation.Remove, contentLengthHeader)
+		}
+		if !mutation.IsEmpty() {
+			s.log.Debug("ext_proc response headers policy", "route", s.route.Name, "status", s.status)
+			response.HeaderMutation = headerMutation(mutation)
 		}
+	}
 
-	} else {
-		common.Info.Printf("Error from upstream. Status %d\n", status)
+	return &proc.ProcessingResponse{
+		Response: &proc.ProcessingResponse_ResponseHeaders{
+			ResponseHeaders: &proc.HeadersResponse{
+				Response: response,
+			},
+		},
 	}
-	return resp
 }
 
-func processRequestHeaders(headers *proc.ProcessingRequest_RequestHeaders) *proc.ProcessingResponse {
-	common.Info.Printf(">>> ProcessingRequest_RequestHeaders %v \n", headers)
-	resp := &proc.ProcessingResponse{}
-	var path string
+//processRequestHeaders finds the rule of the request. When routing, it sets the
+//backend host and path. The rest of the request and the response are only sent
+//to ext_proc as the rule needs them
+func (s *stream) processRequestHeaders(ctx context.Context, routing bool) *proc.ProcessingResponse {
+	httpRequest := s.request
+	s.log.Debug("ext_proc request headers", "headers", logging.Headers(httpRequest.Headers))
+	path := httpRequest.Path
 
-	for _, header := range headers.RequestHeaders.Headers.Headers {
-		if header.Key == ":path" {
-			path = header.Value
-			break
-		}
-	}
-
-	if routing == "true" {
-		if r, found := routes.GetRoute(path); found {
-			basepath := routes.ReplacePrefix(path, r.Prefix)
-			requestHeaders := &proc.HeadersResponse{
-				Response: &proc.CommonResponse{
-					HeaderMutation: &proc.HeaderMutation{
-						SetHeaders: []*core.HeaderValueOption{
-							// at the time of writing this, host is not modifiable from ext_proc
-							// https://github.com/envoyproxy/envoy/blob/main/source/extensions/filters/http/ext_proc/mutation_utils.cc#L128
-							// this is the warning received in the logs:
-							// [2021-11-28 16:43:04.339][671420][debug][filter] [source/extensions/filters/http/ext_proc/mutation_utils.cc:63] Ignorning improper attempt to set header host
-							setHeader("host", basepath, false),
-							setHeader(":path", basepath, false),
-						},
-					},
-					Status:          proc.CommonResponse_CONTINUE,
-					ClearRouteCache: true,
+	response := &proc.CommonResponse{
+		Status: proc.CommonResponse_CONTINUE,
+	}
+	resp := &proc.ProcessingResponse{
+		Response: &proc.ProcessingResponse_RequestHeaders{
+			RequestHeaders: &proc.HeadersResponse{
+				Response: response,
+			},
+		},
+	}
+
+	var r routes.RouteRule
+	var found bool
+
+	if routing {
+		if r, found = routes.GetRouteContext(ctx, httpRequest); found {
+			metrics.ObserveExtProcRoute(r.Name, metrics.DECISION_OK)
+			basepath := r.GetBackendPath(path)
+			trace.SpanFromContext(ctx).SetAttributes(tracing.RouteKey.String(r.Name), tracing.BackendKey.String(r.Backend))
+			response.HeaderMutation = &proc.HeaderMutation{
+				SetHeaders: []*core.HeaderValueOption{
+					// at the time of writing this, host is not modifiable from ext_proc
+					// https://github.com/envoyproxy/envoy/blob/main/source/extensions/filters/http/ext_proc/mutation_utils.cc#L128
+					// this is the warning received in the logs:
+					// [2021-11-28 16:43:04.339][671420][debug][filter] [source/extensions/filters/http/ext_proc/mutation_utils.cc:63] Ignorning improper attempt to set header host
+					setHeader("host", basepath, false),
+					setHeader(":path", basepath, false),
 				},
 			}
-			resp.Response = &proc.ProcessingResponse_RequestHeaders{
-				RequestHeaders: requestHeaders,
+			response.ClearRouteCache = true
+		} else {
+			metrics.ObserveExtProcRoute("", metrics.DECISION_NOT_FOUND)
+		}
+	} else {
+		r, found, s.pathRewritten = findRoute(ctx, httpRequest)
+	}
+
+	s.setRoute(r, found)
+
+	//the route header is only meant for ext_proc, it is not sent to the backend
+	if _, ok := httpRequest.Headers[routes.RouteHeader]; ok {
+		if response.HeaderMutation == nil {
+			response.HeaderMutation = &proc.HeaderMutation{}
+		}
+		response.HeaderMutation.RemoveHeaders = append(response.HeaderMutation.RemoveHeaders, routes.RouteHeader)
+	}
+
+	if found {
+		trace.SpanFromContext(ctx).SetAttributes(tracing.RouteKey.String(r.Name))
+		resp.ModeOverride = processingMode(r)
+		if r.RequestTransform != nil {
+			//the length of the transformed body is not known yet
+			if response.HeaderMutation == nil {
+				response.HeaderMutation = &proc.HeaderMutation{}
+			}
+			response.HeaderMutation.RemoveHeaders = append(response.HeaderMutation.RemoveHeaders, contentLengthHeader)
+		}
+
+		if r.OpenAPI != nil {
+			if problem := s.validateRequest(ctx, r.OpenAPI, s.backendPath()); problem != nil {
+				return s.reject(problem)
 			}
-			resp.ModeOverride = &ext_proc.ProcessingMode{
-				RequestHeaderMode: ext_proc.ProcessingMode_SEND,
+			if s.operation != nil {
+				resp.ModeOverride.RequestBodyMode = ext_proc.ProcessingMode_BUFFERED
 			}
 		}
+
+		if r.Mock != nil {
+			//the mock answers once the body is buffered if it needs it
+			if s.requestEndOfStream || !r.Mock.UsesBody() {
+				return s.mock(nil)
+			}
+			resp.ModeOverride.RequestBodyMode = ext_proc.ProcessingMode_BUFFERED
+		}
 	}
 
 	return resp
 }
 
-func processRequestBody(body *proc.ProcessingRequest_RequestBody) *proc.ProcessingResponse {
-	resp := &proc.ProcessingResponse{}
-	common.Info.Printf(">>> ProcessingRequest_RequestBody %v \n", body)
-	return resp
+//backendPath returns the path sent to the backend
+func (s *stream) backendPath() string {
+	if s.pathRewritten {
+		return s.request.Path
+	}
+	return s.route.GetBackendPath(s.request.Path)
 }
 
-func processResponseBody(body *proc.ProcessingRequest_ResponseBody) *proc.ProcessingResponse {
-	resp := &proc.ProcessingResponse{}
-	common.Info.Printf("<<< ProcessingRequest_ResponseBody %v \n", body)
-	return resp
+//validateRequest validates the parameters of the request against the OpenAPI
+//document. The body is validated now if the request has none, else the
+//operation is kept to validate it once buffered
+func (s *stream) validateRequest(ctx context.Context, v *openapi.Validation, backendPath string) *openapi.Problem {
+	operation, problem := v.Find(s.request.Method, backendPath, s.request.Headers)
+	if problem != nil {
+		return problem
+	}
+	if problem = operation.ValidateParameters(ctx); problem != nil {
+		return problem
+	}
+	if s.requestEndOfStream {
+		return operation.ValidateBody(ctx, nil)
+	}
+	if operation.HasBody() {
+		s.operation = operation
+	}
+	return nil
+}
+
+//reject answers the request with the problem, it is not sent to the backend
+func (s *stream) reject(problem *openapi.Problem) *proc.ProcessingResponse {
+	s.status = problem.Status
+	metrics.ObserveOpenAPIRejection(s.route.Name, problem.Status)
+	s.log.Info("request rejected by OpenAPI validation", "route", s.route.Name, "status", problem.Status,
+		"detail", problem.Detail, "violations", len(problem.Violations))
+
+	return &proc.ProcessingResponse{
+		Response: &proc.ProcessingResponse_ImmediateResponse{
+			ImmediateResponse: &proc.ImmediateResponse{
+				Status: &typev3.HttpStatus{Code: typev3.StatusCode(problem.Status)},
+				Headers: &proc.HeaderMutation{
+					SetHeaders: []*core.HeaderValueOption{setHeader(contentTypeHeader, openapi.ProblemContentType, false)},
+				},
+				Body:    problem.Body(),
+				Details: "openapi_validation",
+			},
+		},
+	}
+}
+
+//mock answers the request with the mock of the rule. The response headers
+//policies of the rule apply to the response. Its latency is left in s.delay
+//for Process to wait
+func (s *stream) mock(body []byte) *proc.ProcessingResponse {
+	m := s.route.Mock
+	s.delay = m.Latency()
+
+	response, err := m.Respond(mock.Request{
+		Method:     s.request.Method,
+		Path:       s.backendPath(),
+		Headers:    s.request.Headers,
+		Body:       body,
+		Attributes: s.attributes(),
+	})
+	if err != nil {
+		s.log.Error("unable to build the mock response", "route", s.route.Name, "error", err)
+		response = mock.Response{Status: http.StatusInternalServerError, Headers: map[string]string{}}
+	}
+	s.status = response.Status
+	metrics.ObserveMockResponse(s.route.Name, response.Status)
+	s.log.Info("mock response", "route", s.route.Name, "status", response.Status, "example", response.Example,
+		"latency", s.delay)
+
+	policies := s.route.GetResponseHeaders(response.Status, s.attributes())
+	headers := routes.HeaderMutation{Set: response.Headers, Append: policies.Append}
+	for _, name := range policies.Remove {
+		delete(headers.Set, name)
+	}
+	for name, value := range policies.Set {
+		headers.Set[name] = value
+	}
+
+	return &proc.ProcessingResponse{
+		Response: &proc.ProcessingResponse_ImmediateResponse{
+			ImmediateResponse: &proc.ImmediateResponse{
+				Status:  &typev3.HttpStatus{Code: typev3.StatusCode(response.Status)},
+				Headers: headerMutation(headers),
+				Body:    string(response.Body),
+				Details: "mock",
+			},
+		},
+	}
+}
+
+//findRoute returns the rule named by ext_authz, which rewrote the path of the
+//request, or else the rule matching the request. rewritten is true when the
+//rule was named by ext_authz. ext_authz sets or removes the header on every
+//request it allows, and ext_proc is disabled on the xDS routes it does not see,
+//so a value sent by the client does not reach this point
+func findRoute(ctx context.Context, httpRequest *auth.AttributeContext_HttpRequest) (r routes.RouteRule, found bool, rewritten bool) {
+	if r, found = routes.GetRouteByName(httpRequest.Headers[routes.RouteHeader]); found {
+		return r, true, true
+	}
+	r, found = routes.GetRouteContext(ctx, httpRequest)
+	return r, found, false
+}
+
+//processingMode asks envoy for the response headers only on rules with
+//response headers policies or a response transform, and for buffered bodies
+//only on rules with transforms
+func processingMode(r routes.RouteRule) *ext_proc.ProcessingMode {
+	mode := &ext_proc.ProcessingMode{
+		RequestHeaderMode:  ext_proc.ProcessingMode_SEND,
+		ResponseHeaderMode: ext_proc.ProcessingMode_SKIP,
+	}
+	if r.HasResponseHeaders() || r.ResponseTransform != nil {
+		mode.ResponseHeaderMode = ext_proc.ProcessingMode_SEND
+	}
+	if r.RequestTransform != nil {
+		mode.RequestBodyMode = ext_proc.ProcessingMode_BUFFERED
+	}
+	if r.ResponseTransform != nil {
+		mode.ResponseBodyMode = ext_proc.ProcessingMode_BUFFERED
+	}
+	return mode
+}
+
+//processRequestBody applies the request transform of the rule to the buffered body
+func (s *stream) processRequestBody(body *proc.ProcessingRequest_RequestBody) *proc.ProcessingResponse {
+	raw := body.RequestBody.GetBody()
+	contentType := s.request.GetHeaders()[contentTypeHeader]
+	s.log.Debug("ext_proc request body", "body", logging.Body{Raw: raw, ContentType: contentType})
+
+	var response *proc.CommonResponse
+	if s.routeFound && s.route.RequestTransform != nil {
+		response = s.transformBody(s.route.RequestTransform, raw, contentType)
+	}
+
+	//the body is validated and mocked as sent to the backend, after the transform
+	if transformed := response.GetBodyMutation().GetBody(); transformed != nil {
+		raw = transformed
+	}
+	if s.operation != nil {
+		if problem := s.operation.ValidateBody(s.ctx, raw); problem != nil {
+			return s.reject(problem)
+		}
+	}
+	if s.routeFound && s.route.Mock != nil {
+		return s.mock(raw)
+	}
+
+	return &proc.ProcessingResponse{
+		Response: &proc.ProcessingResponse_RequestBody{
+			RequestBody: &proc.BodyResponse{Response: response},
+		},
+	}
+}
+
+//processResponseBody applies the response transform of the rule to the buffered body
+func (s *stream) processResponseBody(body *proc.ProcessingRequest_ResponseBody) *proc.ProcessingResponse {
+	raw := body.ResponseBody.GetBody()
+	s.log.Debug("ext_proc response body", "body", logging.Body{Raw: raw, ContentType: s.responseContentType})
+
+	var response *proc.CommonResponse
+	if s.routeFound && s.route.ResponseTransform != nil {
+		response = s.transformBody(s.route.ResponseTransform, raw, s.responseContentType)
+	}
+	return &proc.ProcessingResponse{
+		Response: &proc.ProcessingResponse_ResponseBody{
+			ResponseBody: &proc.BodyResponse{Response: response},
+		},
+	}
+}
+
+//transformBody replaces the body, and its content type when it changed. The
+//body is sent unchanged if the transform fails
+func (s *stream) transformBody(t *transform.Transform, raw []byte, contentType string) *proc.CommonResponse {
+	response := &proc.CommonResponse{
+		Status: proc.CommonResponse_CONTINUE,
+	}
+
+	transformed, transformedType, err := t.Apply(raw, contentType, s.attributes(), s.request.GetHeaders())
+	if err != nil {
+		s.log.Warn("unable to transform body, sending it unchanged", "route", s.route.Name, "error", err)
+		return response
+	}
+
+	response.BodyMutation = &proc.BodyMutation{
+		Mutation: &proc.BodyMutation_Body{Body: transformed},
+	}
+	if transformedType != contentType {
+		response.HeaderMutation = &proc.HeaderMutation{
+			SetHeaders: []*core.HeaderValueOption{setHeader(contentTypeHeader, transformedType, false)},
+		}
+	}
+	return response
+}
+
+//getHttpRequest converts the request headers into the attributes used by the routing table
+func getHttpRequest(headers *proc.ProcessingRequest_RequestHeaders) *auth.AttributeContext_HttpRequest {
+	httpRequest := &auth.AttributeContext_HttpRequest{
+		Headers: map[string]string{},
+	}
+
+	for _, header := range headers.RequestHeaders.Headers.Headers {
+		switch header.Key {
+		case ":path":
+			httpRequest.Path = header.Value
+		case ":method":
+			httpRequest.Method = header.Value
+		case ":authority":
+			httpRequest.Host = header.Value
+		case ":scheme":
+			httpRequest.Scheme = header.Value
+		}
+		httpRequest.Headers[header.Key] = header.Value
+	}
+
+	return httpRequest
+}
+
+//headerMap converts headers for logging
+func headerMap(headers *core.HeaderMap) logging.Headers {
+	m := logging.Headers{}
+	for _, header := range headers.GetHeaders() {
+		m[header.Key] = header.Value
+	}
+	return m
+}
+
+//headerMutation converts the response headers policies of a rule
+func headerMutation(m routes.HeaderMutation) *proc.HeaderMutation {
+	mutation := &proc.HeaderMutation{
+		RemoveHeaders: m.Remove,
+	}
+	for _, name := range sortedKeys(m.Set) {
+		mutation.SetHeaders = append(mutation.SetHeaders, setHeader(name, m.Set[name], false))
+	}
+	for _, name := range sortedKeys(m.Append) {
+		mutation.SetHeaders = append(mutation.SetHeaders, setHeader(name, m.Append[name], true))
+	}
+	return mutation
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
 }
 
 func setHeader(name string, value string, append bool) *core.HeaderValueOption {
@@ -0,0 +1,136 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extproc
+
+import (
+	"context"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	auth "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	logging "github.com/srinandan/envoy-router/server/logging"
+	metrics "github.com/srinandan/envoy-router/server/metrics"
+	openapi "github.com/srinandan/envoy-router/server/openapi"
+	routes "github.com/srinandan/envoy-router/server/routes"
+	tracing "github.com/srinandan/envoy-router/server/tracing"
+)
+
+//stream is the state of a Process stream. Envoy opens a stream per HTTP
+//request, so it lives from the request headers to the end of the response
+type stream struct {
+	//ctx carries the trace of the request once the request headers are received
+	ctx   context.Context
+	log   *slog.Logger
+	start time.Time
+	//request is nil until the request headers are received
+	request *auth.AttributeContext_HttpRequest
+	//requestEndOfStream is set when the request has no body
+	requestEndOfStream bool
+	client             string
+	//route is the rule of the request, when found
+	route      routes.RouteRule
+	routeFound bool
+	//pathRewritten is set when ext_authz already sent the path to the backend
+	pathRewritten bool
+	//status is the status of the response, 0 until the response headers are received
+	status int
+	//responseContentType is the content type of the response, empty until the
+	//response headers are received
+	responseContentType string
+	//operation validates the body of the request once buffered
+	operation *openapi.Operation
+	//delay is the latency of the mock response, waited by Process before
+	//sending it
+	delay time.Duration
+}
+
+func newStream(ctx context.Context) *stream {
+	return &stream{
+		ctx:   ctx,
+		log:   slog.Default(),
+		start: time.Now(),
+	}
+}
+
+//setRequest records the request headers, the first message of the stream. The
+//request id and the trace context are read from them
+func (s *stream) setRequest(httpRequest *auth.AttributeContext_HttpRequest, endOfStream bool) {
+	s.request = httpRequest
+	s.requestEndOfStream = endOfStream
+	s.client = getClientID(httpRequest)
+	s.log = logging.ForRequest(httpRequest.Headers)
+	s.ctx = tracing.Extract(s.ctx, httpRequest.Headers)
+}
+
+//setRoute records the rule of the request
+func (s *stream) setRoute(r routes.RouteRule, found bool) {
+	s.route = r
+	s.routeFound = found
+}
+
+//attributes are the request attributes that response header values can
+//reference, ex: {request_id}
+func (s *stream) attributes() map[string]string {
+	a := map[string]string{
+		"route":      s.route.Name,
+		"client":     s.client,
+		"latency_ms": strconv.FormatInt(time.Since(s.start).Milliseconds(), 10),
+	}
+	if s.status != 0 {
+		a["status"] = strconv.Itoa(s.status)
+	}
+	if s.request != nil {
+		a["method"] = s.request.Method
+		a["path"] = s.request.Path
+		a["host"] = s.request.Host
+		a["request_id"] = s.request.Headers["x-request-id"]
+	}
+	return a
+}
+
+//finish records the request when the stream ends. The duration covers the
+//upstream call, and the response as far as ext_proc sees it
+func (s *stream) finish() {
+	if s.request == nil {
+		return
+	}
+	elapsed := time.Since(s.start)
+	metrics.ObserveExtProcRequest(s.route.Name, s.status, elapsed)
+	s.log.Info("ext_proc request", "route", s.route.Name, "method", s.request.Method, "path", withoutQuery(s.request.Path),
+		"client", s.client, "status", s.status, "duration", elapsed)
+}
+
+//withoutQuery removes the query string, which may carry API keys or tokens,
+//from a path that is logged
+func withoutQuery(path string) string {
+	if i := strings.IndexAny(path, "?#"); i != -1 {
+		return path[:i]
+	}
+	return path
+}
+
+//getClientID returns the address of the downstream peer from the last hop of
+//x-forwarded-for. envoy appends it when use_remote_address is set in the
+//http_connection_manager (see envoy.yaml), otherwise every hop is sent by the
+//client and can be forged
+func getClientID(httpRequest *auth.AttributeContext_HttpRequest) string {
+	xff := httpRequest.Headers["x-forwarded-for"]
+	if i := strings.LastIndex(xff, ","); i != -1 {
+		xff = xff[i+1:]
+	}
+	return strings.TrimSpace(xff)
+}
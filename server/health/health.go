@@ -0,0 +1,193 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package health
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	routes "github.com/srinandan/envoy-router/server/routes"
+	token "github.com/srinandan/envoy-router/server/token"
+	grpchealth "google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+//gRPC service names, as sent by envoy's grpc_health_check service_name
+const (
+	AuthorizationService     = "envoy.service.auth.v3.Authorization"
+	ExternalProcessorService = "envoy.service.ext_proc.v3.ExternalProcessor"
+)
+
+//overallService is the empty service name, the health of the whole server
+const overallService = ""
+
+//Check reports why a service is not serving, nil when it can serve
+type Check struct {
+	Name  string
+	Check func() error
+}
+
+//Monitor sets the status of the gRPC health server from the state of the
+//routing table, of the upstream tokens and from draining
+type Monitor struct {
+	server           *grpchealth.Server
+	tokenGracePeriod time.Duration
+	checks           []Check
+	services         map[string][]Check
+	draining         int32
+	status           map[string]healthpb.HealthCheckResponse_ServingStatus
+	sync.Mutex
+}
+
+//NewMonitor returns a monitor for the health server. Token fetches may fail for
+//tokenGracePeriod before the authorization service stops serving. The external
+//processor depends on the routing table only when routing is set
+func NewMonitor(server *grpchealth.Server, tokenGracePeriod time.Duration, routing bool) *Monitor {
+	m := &Monitor{
+		server:           server,
+		tokenGracePeriod: tokenGracePeriod,
+		status:           map[string]healthpb.HealthCheckResponse_ServingStatus{},
+	}
+
+	draining := Check{Name: "draining", Check: m.CheckDraining}
+	routeTable := Check{Name: "routes", Check: CheckRoutes}
+	tokens := Check{Name: "tokens", Check: m.CheckTokens}
+
+	m.checks = []Check{draining, routeTable, tokens}
+	m.services = map[string][]Check{
+		AuthorizationService:     {draining, routeTable, tokens},
+		ExternalProcessorService: {draining},
+	}
+	if routing {
+		m.services[ExternalProcessorService] = append(m.services[ExternalProcessorService], routeTable)
+	}
+	return m
+}
+
+//Checks returns the checks of all services, each once
+func (m *Monitor) Checks() []Check {
+	return m.checks
+}
+
+//CheckRoutes fails until a routing table is loaded
+func CheckRoutes() error {
+	if routes.GetVersion() == "" {
+		return errors.New("no routing table loaded")
+	}
+	return nil
+}
+
+//CheckTokens fails when upstream token fetches have been failing for longer
+//than the grace period
+func (m *Monitor) CheckTokens() error {
+	since := token.FailingSince()
+	if since.IsZero() {
+		return nil
+	}
+	if failing := time.Since(since); failing > m.tokenGracePeriod {
+		return fmt.Errorf("upstream token fetches failing for %s", failing.Round(time.Second))
+	}
+	return nil
+}
+
+//CheckDraining fails once the server started shutting down
+func (m *Monitor) CheckDraining() error {
+	if atomic.LoadInt32(&m.draining) != 0 {
+		return errors.New("shutting down")
+	}
+	return nil
+}
+
+//Drain stops serving all services so that envoy moves traffic to other hosts
+//before the server stops
+func (m *Monitor) Drain() {
+	atomic.StoreInt32(&m.draining, 1)
+	m.Update()
+}
+
+//Update runs the checks and sets the status of each service. The server as a
+//whole serves only when all services do
+func (m *Monitor) Update() {
+	m.Lock()
+	defer m.Unlock()
+
+	overall := healthpb.HealthCheckResponse_SERVING
+	for service, checks := range m.services {
+		status := healthpb.HealthCheckResponse_SERVING
+		var reasons []string
+		for _, c := range checks {
+			if err := c.Check(); err != nil {
+				status = healthpb.HealthCheckResponse_NOT_SERVING
+				reasons = append(reasons, c.Name+": "+err.Error())
+			}
+		}
+		if status != healthpb.HealthCheckResponse_SERVING {
+			overall = status
+		}
+		m.set(service, status, reasons)
+	}
+	m.set(overallService, overall, nil)
+}
+
+//set updates the status of the service and logs transitions, the caller must
+//hold the lock
+func (m *Monitor) set(service string, status healthpb.HealthCheckResponse_ServingStatus, reasons []string) {
+	if previous, ok := m.status[service]; ok && previous == status {
+		return
+	}
+	m.status[service] = status
+	m.server.SetServingStatus(service, status)
+
+	if service == overallService {
+		return
+	}
+	if status == healthpb.HealthCheckResponse_SERVING {
+		slog.Info("service serving", "service", service)
+	} else {
+		slog.Warn("service not serving", "service", service, "reasons", reasons)
+	}
+}
+
+//Start updates the status now, when the routing table is reloaded and every
+//interval. Failed token fetches are retried at the same interval, so the
+//status recovers without traffic
+func (m *Monitor) Start(interval time.Duration) (stop func()) {
+	m.Update()
+	routes.OnReload(m.Update)
+
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				token.RetryFailed(interval)
+				m.Update()
+			case <-done:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(done) })
+	}
+}
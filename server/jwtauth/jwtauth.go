@@ -0,0 +1,267 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jwtauth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lestrrat-go/jwx/v2/jwk"
+	"github.com/lestrrat-go/jwx/v2/jws"
+	"github.com/lestrrat-go/jwx/v2/jwt"
+
+	logging "github.com/srinandan/envoy-router/server/logging"
+)
+
+//minRefreshInterval limits how often a JWKS is fetched, in the background and
+//when tokens carry an unknown key id
+const minRefreshInterval = 5 * time.Minute
+
+//clockSkew is the tolerance applied to exp, nbf and iat
+const clockSkew = 30 * time.Second
+
+//ErrUnauthenticated is returned when the token is missing or cannot be verified
+var ErrUnauthenticated = errors.New("unauthenticated")
+
+//ErrForbidden is returned when a valid token does not carry the required claims
+var ErrForbidden = errors.New("forbidden")
+
+//Requirement describes the JWT a route expects from clients. The keys are read
+//from jwksUri or jwksFile
+type Requirement struct {
+	Issuer    string            `json:"issuer,omitempty"`
+	Audiences []string          `json:"audiences,omitempty"`
+	JwksURI   string            `json:"jwksUri,omitempty"`
+	JwksFile  string            `json:"jwksFile,omitempty"`
+	Claims    map[string]string `json:"claims,omitempty"`
+	//Header is the request header carrying the token, defaults to authorization
+	Header string `json:"header,omitempty"`
+}
+
+//Compile checks the requirement and starts caching its JWKS
+func (r *Requirement) Compile() error {
+	if (r.JwksURI == "") == (r.JwksFile == "") {
+		return fmt.Errorf("exactly one of jwksUri or jwksFile is required")
+	}
+	if r.Header == "" {
+		r.Header = "authorization"
+	}
+	r.Header = strings.ToLower(r.Header)
+
+	if r.JwksURI != "" {
+		return keys.register(r.JwksURI)
+	}
+	return nil
+}
+
+//Verify validates the token sent in the request headers and returns its claims
+func (r *Requirement) Verify(ctx context.Context, headers map[string]string) (map[string]interface{}, error) {
+	raw := headers[r.Header]
+	if r.Header == "authorization" {
+		if !strings.HasPrefix(strings.ToLower(raw), "bearer ") {
+			return nil, fmt.Errorf("%w: bearer token missing", ErrUnauthenticated)
+		}
+		raw = strings.TrimSpace(raw[len("bearer "):])
+	}
+	if raw == "" {
+		return nil, fmt.Errorf("%w: token missing", ErrUnauthenticated)
+	}
+
+	set, err := r.keySet(ctx)
+	if err != nil {
+		logging.FromContext(ctx).Error("unable to read jwks", "error", err)
+		return nil, fmt.Errorf("%w: unable to read jwks", ErrUnauthenticated)
+	}
+
+	token, err := r.parse(raw, set)
+	if err != nil && r.JwksURI != "" && isUnknownKey(raw, set) {
+		//the issuer may have rotated its keys
+		if set, err = keys.refresh(ctx, r.JwksURI); err == nil {
+			token, err = r.parse(raw, set)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrUnauthenticated, err)
+	}
+
+	if len(r.Audiences) > 0 && !hasAudience(token.Audience(), r.Audiences) {
+		return nil, fmt.Errorf("%w: audience not allowed", ErrForbidden)
+	}
+
+	claims, err := token.AsMap(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrUnauthenticated, err)
+	}
+
+	for name, expected := range r.Claims {
+		if !hasClaim(claims[name], expected) {
+			return nil, fmt.Errorf("%w: claim %s does not match", ErrForbidden, name)
+		}
+	}
+
+	return claims, nil
+}
+
+func (r *Requirement) parse(raw string, set jwk.Set) (jwt.Token, error) {
+	options := []jwt.ParseOption{
+		jwt.WithKeySet(set, jws.WithInferAlgorithmFromKey(true), jws.WithRequireKid(false)),
+		jwt.WithValidate(true),
+		jwt.WithAcceptableSkew(clockSkew),
+	}
+	if r.Issuer != "" {
+		options = append(options, jwt.WithIssuer(r.Issuer))
+	}
+	return jwt.ParseString(raw, options...)
+}
+
+func (r *Requirement) keySet(ctx context.Context) (jwk.Set, error) {
+	if r.JwksURI != "" {
+		return keys.get(ctx, r.JwksURI)
+	}
+	return keys.readFile(r.JwksFile)
+}
+
+//isUnknownKey returns true if the token was signed with a key id missing from the set
+func isUnknownKey(raw string, set jwk.Set) bool {
+	msg, err := jws.ParseString(raw)
+	if err != nil || len(msg.Signatures()) == 0 {
+		return false
+	}
+	kid := msg.Signatures()[0].ProtectedHeaders().KeyID()
+	if kid == "" {
+		return false
+	}
+	_, found := set.LookupKeyID(kid)
+	return !found
+}
+
+func hasAudience(audiences []string, allowed []string) bool {
+	for _, aud := range audiences {
+		for _, a := range allowed {
+			if aud == a {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+//hasClaim compares the claim with the expected value. For list claims, such as
+//scopes or groups, one of the values must match. Space separated scope
+//strings are treated as lists
+func hasClaim(claim interface{}, expected string) bool {
+	switch v := claim.(type) {
+	case string:
+		if v == expected {
+			return true
+		}
+		for _, s := range strings.Fields(v) {
+			if s == expected {
+				return true
+			}
+		}
+	case []interface{}:
+		for _, item := range v {
+			if fmt.Sprint(item) == expected {
+				return true
+			}
+		}
+	case []string:
+		for _, item := range v {
+			if item == expected {
+				return true
+			}
+		}
+	case nil:
+		return false
+	default:
+		return fmt.Sprint(v) == expected
+	}
+	return false
+}
+
+//keyCache holds the remote JWKS, refreshed in the background, and the local
+//JWKS files, reread when they change
+type keyCache struct {
+	remote *jwk.Cache
+	files  map[string]cachedFile
+	//refreshed is the time of the last forced refresh of each uri
+	refreshed map[string]time.Time
+	sync.Mutex
+}
+
+type cachedFile struct {
+	modTime time.Time
+	set     jwk.Set
+}
+
+var keys = &keyCache{
+	remote:    jwk.NewCache(context.Background()),
+	files:     map[string]cachedFile{},
+	refreshed: map[string]time.Time{},
+}
+
+func (k *keyCache) register(uri string) error {
+	if k.remote.IsRegistered(uri) {
+		return nil
+	}
+	return k.remote.Register(uri, jwk.WithMinRefreshInterval(minRefreshInterval))
+}
+
+func (k *keyCache) get(ctx context.Context, uri string) (jwk.Set, error) {
+	return k.remote.Get(ctx, uri)
+}
+
+//refresh fetches the JWKS again, unless it was forced less than
+//minRefreshInterval ago, then the cached set is returned. Tokens with made up
+//key ids can't make the router hammer the issuer
+func (k *keyCache) refresh(ctx context.Context, uri string) (jwk.Set, error) {
+	k.Lock()
+	if last, ok := k.refreshed[uri]; ok && time.Since(last) < minRefreshInterval {
+		k.Unlock()
+		return k.remote.Get(ctx, uri)
+	}
+	k.refreshed[uri] = time.Now()
+	k.Unlock()
+
+	logging.FromContext(ctx).Info("refreshing jwks", "uri", uri)
+	return k.remote.Refresh(ctx, uri)
+}
+
+func (k *keyCache) readFile(file string) (jwk.Set, error) {
+	info, err := os.Stat(file)
+	if err != nil {
+		return nil, err
+	}
+
+	k.Lock()
+	defer k.Unlock()
+
+	if cached, ok := k.files[file]; ok && cached.modTime.Equal(info.ModTime()) {
+		return cached.set, nil
+	}
+
+	set, err := jwk.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	k.files[file] = cachedFile{modTime: info.ModTime(), set: set}
+	return set, nil
+}
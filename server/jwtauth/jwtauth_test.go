@@ -0,0 +1,128 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jwtauth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/lestrrat-go/jwx/v2/jwk"
+	"github.com/lestrrat-go/jwx/v2/jwt"
+)
+
+func newKey(t *testing.T, kid string) jwk.Key {
+	t.Helper()
+	raw, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := jwk.FromRaw(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = key.Set(jwk.KeyIDKey, kid)
+	_ = key.Set(jwk.AlgorithmKey, jwa.RS256)
+	return key
+}
+
+func sign(t *testing.T, key jwk.Key) string {
+	t.Helper()
+	token, err := jwt.NewBuilder().Issuer("https://issuer.example.com").Subject("client").
+		Expiration(time.Now().Add(time.Hour)).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, err := jwt.Sign(token, jwt.WithKey(jwa.RS256, key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return "Bearer " + string(signed)
+}
+
+func TestVerifyThrottlesRefreshes(t *testing.T) {
+	known := newKey(t, "known")
+	public, err := known.PublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	set := jwk.NewSet()
+	_ = set.AddKey(public)
+
+	var fetches int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		_ = json.NewEncoder(w).Encode(set)
+	}))
+	defer server.Close()
+
+	r := &Requirement{Issuer: "https://issuer.example.com", JwksURI: server.URL}
+	if err := r.Compile(); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	if _, err := r.Verify(ctx, map[string]string{"authorization": sign(t, known)}); err != nil {
+		t.Fatalf("valid token: %v", err)
+	}
+	initial := atomic.LoadInt32(&fetches)
+
+	//the first unknown key id refreshes the set, the next ones don't
+	for _, kid := range []string{"rotated", "forged", "forged-again"} {
+		_, err := r.Verify(ctx, map[string]string{"authorization": sign(t, newKey(t, kid))})
+		if !errors.Is(err, ErrUnauthenticated) {
+			t.Errorf("%s: got %v, want %v", kid, err, ErrUnauthenticated)
+		}
+	}
+	if got := atomic.LoadInt32(&fetches) - initial; got != 1 {
+		t.Errorf("got %d refreshes, want 1", got)
+	}
+
+	//tokens signed with known keys are still accepted
+	if _, err := r.Verify(ctx, map[string]string{"authorization": sign(t, known)}); err != nil {
+		t.Errorf("valid token after refreshes: %v", err)
+	}
+}
+
+func TestHasClaim(t *testing.T) {
+	tests := []struct {
+		name     string
+		claim    interface{}
+		expected string
+		want     bool
+	}{
+		{"string", "admin", "admin", true},
+		{"scopes", "read write", "write", true},
+		{"missing scope", "read write", "delete", false},
+		{"list", []interface{}{"a", "b"}, "b", true},
+		{"missing from list", []interface{}{"a", "b"}, "c", false},
+		{"number", float64(42), "42", true},
+		{"bool", true, "true", true},
+		{"missing", nil, "", false},
+	}
+	for _, test := range tests {
+		if got := hasClaim(test.claim, test.expected); got != test.want {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+//log formats
+const (
+	FORMAT_JSON = "json"
+	FORMAT_TEXT = "text"
+)
+
+//Redacted replaces the value of secrets in logs
+const Redacted = "[REDACTED]"
+
+//requestIDHeader is set by envoy on every request
+const requestIDHeader = "x-request-id"
+
+//sensitive are the attribute keys, header names and body fields that are
+//always redacted
+var sensitive = map[string]bool{
+	"authorization":       true,
+	"proxy-authorization": true,
+	"cookie":              true,
+	"set-cookie":          true,
+	"x-api-key":           true,
+	"token":               true,
+	"access_token":        true,
+	"id_token":            true,
+	"refresh_token":       true,
+	"assertion":           true,
+	"client_secret":       true,
+	"private_key":         true,
+	"password":            true,
+}
+
+//redactFields holds the map[string]bool of fields configured with Options.RedactFields
+var redactFields atomic.Value
+
+var level = new(slog.LevelVar)
+
+//Options configures the default logger
+type Options struct {
+	//Level is debug, info, warn or error
+	Level string
+	//Format is json or text
+	Format string
+	//RedactFields are header names and body fields to redact, in addition to
+	//the credentials that are always redacted
+	RedactFields []string
+}
+
+func init() {
+	_ = Init(Options{Level: "info", Format: FORMAT_JSON})
+}
+
+//Init replaces the default slog logger. Output written with the log package
+//also goes through it
+func Init(o Options) error {
+	return initWriter(os.Stdout, o)
+}
+
+func initWriter(w io.Writer, o Options) error {
+	if err := level.UnmarshalText([]byte(o.Level)); err != nil {
+		return fmt.Errorf("unknown log level %s", o.Level)
+	}
+
+	fields := map[string]bool{}
+	for _, field := range o.RedactFields {
+		fields[strings.ToLower(field)] = true
+	}
+	redactFields.Store(fields)
+
+	options := &slog.HandlerOptions{
+		Level:       level,
+		ReplaceAttr: replaceAttr,
+	}
+
+	var handler slog.Handler
+	switch o.Format {
+	case FORMAT_JSON, "":
+		handler = slog.NewJSONHandler(w, options)
+	case FORMAT_TEXT:
+		handler = slog.NewTextHandler(w, options)
+	default:
+		return fmt.Errorf("unknown log format %s", o.Format)
+	}
+
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
+
+//IsSensitive reports whether the value of the key, header name or body field
+//must not be logged
+func IsSensitive(key string) bool {
+	key = strings.ToLower(key)
+	if sensitive[key] {
+		return true
+	}
+	fields, _ := redactFields.Load().(map[string]bool)
+	return fields[key]
+}
+
+//replaceAttr redacts attributes whose key is sensitive, at any depth
+func replaceAttr(groups []string, a slog.Attr) slog.Attr {
+	if a.Value.Kind() != slog.KindGroup && IsSensitive(a.Key) {
+		return slog.String(a.Key, Redacted)
+	}
+	return a
+}
+
+type contextKey struct{}
+
+//ForRequest returns the default logger with the request id read from the
+//x-request-id header
+func ForRequest(headers map[string]string) *slog.Logger {
+	if id := headers[requestIDHeader]; id != "" {
+		return slog.Default().With("request_id", id)
+	}
+	return slog.Default()
+}
+
+//NewContext returns a context carrying the logger
+func NewContext(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, contextKey{}, logger)
+}
+
+//FromContext returns the logger of the context, or the default logger
+func FromContext(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(contextKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
+
+//Printf returns a printf style function that logs at the level, for libraries
+//that take one
+func Printf(l slog.Level) func(format string, args ...interface{}) {
+	return func(format string, args ...interface{}) {
+		logger := slog.Default()
+		if logger.Enabled(context.Background(), l) {
+			logger.Log(context.Background(), l, strings.TrimSpace(fmt.Sprintf(format, args...)))
+		}
+	}
+}
@@ -0,0 +1,104 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+//Headers logs request or response headers as a group, sensitive headers are redacted
+type Headers map[string]string
+
+func (h Headers) LogValue() slog.Value {
+	names := make([]string, 0, len(h))
+	for name := range h {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	attrs := make([]slog.Attr, 0, len(names))
+	for _, name := range names {
+		value := h[name]
+		if IsSensitive(name) {
+			value = Redacted
+		}
+		attrs = append(attrs, slog.String(name, value))
+	}
+	return slog.GroupValue(attrs...)
+}
+
+//Body logs a request or response body. Sensitive fields of json and form
+//bodies are redacted, other bodies are logged by size only
+type Body struct {
+	Raw         []byte
+	ContentType string
+}
+
+func (b Body) LogValue() slog.Value {
+	if len(b.Raw) == 0 {
+		return slog.StringValue("")
+	}
+
+	contentType := strings.ToLower(b.ContentType)
+	switch {
+	case strings.Contains(contentType, "json"):
+		var doc interface{}
+		decoder := json.NewDecoder(bytes.NewReader(b.Raw))
+		decoder.UseNumber()
+		if err := decoder.Decode(&doc); err == nil {
+			if redacted, err := json.Marshal(redactJSON(doc)); err == nil {
+				return slog.StringValue(string(redacted))
+			}
+		}
+	case strings.Contains(contentType, "x-www-form-urlencoded"):
+		if form, err := url.ParseQuery(string(b.Raw)); err == nil {
+			for field := range form {
+				if IsSensitive(field) {
+					form.Set(field, Redacted)
+				}
+			}
+			return slog.StringValue(form.Encode())
+		}
+	}
+
+	return slog.GroupValue(
+		slog.String("content_type", b.ContentType),
+		slog.Int("size", len(b.Raw)),
+	)
+}
+
+//redactJSON replaces sensitive members at any depth
+func redactJSON(v interface{}) interface{} {
+	switch node := v.(type) {
+	case map[string]interface{}:
+		for key, child := range node {
+			if IsSensitive(key) {
+				node[key] = Redacted
+			} else {
+				node[key] = redactJSON(child)
+			}
+		}
+	case []interface{}:
+		for i, child := range node {
+			node[i] = redactJSON(child)
+		}
+	}
+	return v
+}
@@ -15,94 +15,164 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
+	"log/slog"
 	"net"
 	"os"
 	"os/signal"
 	"strconv"
+	"sync/atomic"
 	"syscall"
 	"time"
 
+	admin "github.com/srinandan/envoy-router/server/admin"
+	apikeys "github.com/srinandan/envoy-router/server/apikeys"
+	config "github.com/srinandan/envoy-router/server/config"
 	extauthz "github.com/srinandan/envoy-router/server/extauthz"
 	extproc "github.com/srinandan/envoy-router/server/extproc"
+	health "github.com/srinandan/envoy-router/server/health"
+	logging "github.com/srinandan/envoy-router/server/logging"
+	quota "github.com/srinandan/envoy-router/server/quota"
+	ratelimit "github.com/srinandan/envoy-router/server/ratelimit"
 	routes "github.com/srinandan/envoy-router/server/routes"
 	token "github.com/srinandan/envoy-router/server/token"
-	common "github.com/srinandan/sample-apps/common"
+	tracing "github.com/srinandan/envoy-router/server/tracing"
+	xds "github.com/srinandan/envoy-router/server/xds"
 
 	grpc_prometheus "github.com/grpc-ecosystem/go-grpc-prometheus"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
-	"google.golang.org/grpc/health"
+	grpchealth "google.golang.org/grpc/health"
 	"google.golang.org/grpc/health/grpc_health_v1"
 	"google.golang.org/grpc/keepalive"
 )
 
-//default file locations
-const defaultServiceAccountFilePath = "/etc/secrets/sa.json"
-const defaultRoutesFile = "/etc/routes/routes.json"
-
-//default interval to obtain new access tokens
-const interval = 25 * 60 //25 mins
+func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "validate":
+			os.Exit(validate(os.Args[2:]))
+		case "print-config":
+			os.Exit(printConfig(os.Args[2:]))
+		}
+	}
 
-//use this flag to disable auth
-var disable_auth_envvar = os.Getenv("DISABLE_AUTH")
-var disable_auth bool
+	cfg, err := config.Load(flag.CommandLine, os.Args[1:])
+	if err != nil {
+		slog.Error("invalid configuration", "error", err)
+		os.Exit(1)
+	}
 
-func main() {
-	var routeFile, key, cert, saFile string
-	oauthtoken := token.AccessToken{}
+	if err := logging.Init(logging.Options{
+		Level:        cfg.Log.Level,
+		Format:       cfg.Log.Format,
+		RedactFields: cfg.Log.RedactFields,
+	}); err != nil {
+		slog.Error("invalid log configuration", "error", err)
+		os.Exit(1)
+	}
 
-	//init logging
-	common.InitLog()
+	stopTracing, err := tracing.Init(context.Background(), tracing.Options{
+		Endpoint:    cfg.Tracing.Endpoint,
+		Insecure:    cfg.Tracing.Insecure,
+		SampleRatio: cfg.Tracing.SampleRatio,
+	})
+	if err != nil {
+		slog.Error("unable to start tracing", "error", err)
+		os.Exit(1)
+	}
 
-	flag.StringVar(&routeFile, "routes", defaultRoutesFile, "A file containing routes")
-	flag.StringVar(&key, "key", "", "A file containing the private key")
-	flag.StringVar(&cert, "cert", "", "A file containing the public key key")
-	flag.StringVar(&saFile, "sa", "", "GCP Service Account JSON file")
-	flag.Parse()
+	if err := routes.ReadRoutesFile(cfg.Routes); err != nil {
+		slog.Error("unable to load routing table", "file", cfg.Routes, "error", err)
+		if cfg.FailFast {
+			os.Exit(1)
+		}
+	}
 
-	if err := routes.ReadRoutesFile(routeFile); err != nil {
-		common.Error.Printf("unable to load routing table %s: %v\n", routeFile, err)
+	if _, err := routes.WatchRoutesFile(cfg.Routes); err != nil {
+		slog.Error("unable to watch routing table", "file", cfg.Routes, "error", err)
 	}
 
-	if (key != "" && cert == "") || (key == "" && cert != "") {
-		common.Error.Println("both key and cert must be specified")
-		os.Exit(1)
+	if cfg.APIKeys != "" {
+		if err := apikeys.ReadKeysFile(cfg.APIKeys); err != nil {
+			slog.Error("unable to load api keys", "file", cfg.APIKeys, "error", err)
+			if cfg.FailFast {
+				os.Exit(1)
+			}
+		}
+		if _, err := apikeys.WatchKeysFile(cfg.APIKeys); err != nil {
+			slog.Error("unable to watch api keys", "file", cfg.APIKeys, "error", err)
+		}
 	}
 
-	if saFile != "" {
-		token.SetServiceAccountFilePath(saFile)
-	} else {
-		token.SetServiceAccountFilePath(defaultServiceAccountFilePath)
+	reloadOnHangup(cfg.Routes, cfg.APIKeys)
+
+	if cfg.RateLimit.Redis != "" {
+		redisStore, err := ratelimit.NewRedisStore(cfg.RateLimit.Redis)
+		if err != nil {
+			slog.Error("invalid rateLimit.redis address", "error", err)
+			os.Exit(1)
+		}
+		ratelimit.SetStore(redisStore)
 	}
 
-	if disable_auth_envvar != "" {
-		disable_auth, _ = strconv.ParseBool(disable_auth_envvar)
+	if cfg.Quota.File != "" {
+		if err := quota.ReadCountersFile(cfg.Quota.File); err != nil {
+			slog.Error("unable to read quota counters", "file", cfg.Quota.File, "error", err)
+		}
+		//counters are also saved on shutdown
+		quota.SaveCountersEvery(time.Duration(cfg.Quota.SaveInterval))
 	}
 
-	if !disable_auth {
-		if err := oauthtoken.ObtainAccessToken(); err != nil {
-			common.Error.Println(err)
+	token.SetServiceAccountFilePath(cfg.Auth.ServiceAccount)
+	token.SetRefreshAhead(time.Duration(cfg.Auth.RefreshAhead))
+
+	if !cfg.Auth.Disabled {
+		//warm the token cache, tokens are refreshed ahead of expiry on use
+		if _, err := token.GetAccessToken(context.Background()); err != nil {
+			slog.Error("unable to fetch an upstream access token", "error", err)
 		}
 	}
 
-	serve(key, cert, &oauthtoken)
+	var xdsServer *xds.Server
+	if cfg.XDS.Enabled {
+		xdsServer = xds.NewServer(cfg.XDS.DynamicCluster)
+	}
+
+	serve(cfg, xdsServer, stopTracing)
 	select {}
 }
 
-func serve(key string, cert string, oauthtoken *token.AccessToken) {
+//reloadOnHangup reloads the routing table and the api keys when the process receives SIGHUP
+func reloadOnHangup(routeFile string, keysFile string) {
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	go func() {
+		for range sighup {
+			slog.Info("received SIGHUP, reloading routing table")
+			routes.ReloadRoutesFile(routeFile)
+			if keysFile != "" {
+				apikeys.ReloadKeysFile(keysFile)
+			}
+		}
+	}()
+}
+
+func serve(cfg *config.Config, xdsServer *xds.Server, stopTracing func(context.Context) error) {
 	// gRPC server
 	opts := []grpc.ServerOption{
 		grpc.KeepaliveParams(keepalive.ServerParameters{
-			MaxConnectionAge: 10 * time.Minute,
+			MaxConnectionAge: time.Duration(cfg.GRPC.MaxConnectionAge),
 		}),
-		grpc.MaxConcurrentStreams(10),
+		grpc.MaxConcurrentStreams(cfg.GRPC.MaxConcurrentStreams),
 		grpc.StreamInterceptor(grpc_prometheus.StreamServerInterceptor),
 		grpc.UnaryInterceptor(grpc_prometheus.UnaryServerInterceptor),
 	}
 
-	if cert != "" && key != "" {
-		creds, err := credentials.NewServerTLSFromFile(cert, key)
+	if cfg.GRPC.Cert != "" && cfg.GRPC.Key != "" {
+		creds, err := credentials.NewServerTLSFromFile(cfg.GRPC.Cert, cfg.GRPC.Key)
 		if err != nil {
 			panic(err)
 		}
@@ -115,25 +185,54 @@ func serve(key string, cert string, oauthtoken *token.AccessToken) {
 	as := &extauthz.AuthorizationServer{}
 	as.Register(grpcServer)
 
-	ep := &extproc.ExternalProcessingServer{}
+	ep := &extproc.ExternalProcessingServer{Routing: cfg.ExtProc.Routing}
 	ep.Register(grpcServer)
 
-	// grpc health
-	grpcHealth := health.NewServer()
+	if xdsServer != nil {
+		xdsServer.Register(grpcServer)
+		if err := xdsServer.Update(); err != nil {
+			slog.Error("unable to publish xds snapshot", "error", err)
+		}
+	}
+
+	// grpc health, per service
+	grpcHealth := grpchealth.NewServer()
 	grpc_health_v1.RegisterHealthServer(grpcServer, grpcHealth)
+	monitor := health.NewMonitor(grpcHealth, time.Duration(cfg.Health.TokenGracePeriod), cfg.ExtProc.Routing)
+	stopMonitor := monitor.Start(time.Duration(cfg.Health.Interval))
+
+	// admin server
+	var serving int32
+	for _, c := range monitor.Checks() {
+		admin.AddReadinessCheck(c.Name, c.Check)
+	}
+	admin.AddReadinessCheck("grpc", func() error {
+		if atomic.LoadInt32(&serving) == 0 {
+			return errors.New("gRPC server not serving")
+		}
+		return nil
+	})
+
+	var adminServer *admin.Server
+	if cfg.Admin.Port != 0 {
+		adminServer = admin.NewServer(cfg.Admin.Port, cfg.Admin.Pprof)
+		adminServer.Start()
+	}
 
-	common.Info.Println("starting gRPC Server at ", common.GetgRPCPort())
+	slog.Info("starting gRPC server", "port", cfg.GRPC.Port)
 
 	// grpc listener
-	grpcListener, err := net.Listen("tcp", ":"+common.GetgRPCPort())
+	grpcListener, err := net.Listen("tcp", ":"+strconv.Itoa(cfg.GRPC.Port))
 	if err != nil {
 		panic(err)
 	}
 
 	go func() {
+		atomic.StoreInt32(&serving, 1)
 		if err := grpcServer.Serve(grpcListener); err != nil {
-			common.Info.Printf("%s", err)
+			slog.Info("gRPC server stopped", "error", err)
 		}
+		atomic.StoreInt32(&serving, 0)
 	}()
 
 	// watch for termination signals
@@ -142,25 +241,36 @@ func serve(key string, cert string, oauthtoken *token.AccessToken) {
 		signal.Notify(sigint, os.Interrupt)    // terminal
 		signal.Notify(sigint, syscall.SIGTERM) // kubernetes
 		sig := <-sigint
-		common.Info.Printf("shutdown signal: %s\n", sig)
+		slog.Info("shutdown signal", "signal", sig.String())
 		signal.Stop(sigint)
 
-		grpcServer.GracefulStop()
+		//let envoy see the services are not serving and move traffic away
+		stopMonitor()
+		monitor.Drain()
+		time.Sleep(time.Duration(cfg.Health.DrainPeriod))
 
-		common.Info.Println("shutdown complete")
-		os.Exit(0)
-	}()
+		grpcServer.GracefulStop()
 
-	if !disable_auth {
-		//obtain a new token every 25 mins
-		stop := token.Every(interval*time.Second, func(time.Time) bool {
-			common.Info.Println("obtaining a new access token")
-			if err := oauthtoken.ObtainAccessToken(); err != nil {
-				common.Error.Println(err)
+		if adminServer != nil {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			if err := adminServer.Shutdown(ctx); err != nil {
+				slog.Error("unable to stop admin server", "error", err)
 			}
-			return true
-		})
+			cancel()
+		}
 
-		<-stop
-	}
+		if err := quota.SaveCounters(); err != nil {
+			slog.Error("unable to save quota counters", "error", err)
+		}
+
+		//flush the spans still buffered
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		if err := stopTracing(ctx); err != nil {
+			slog.Error("unable to flush spans", "error", err)
+		}
+		cancel()
+
+		slog.Info("shutdown complete")
+		os.Exit(0)
+	}()
 }
@@ -0,0 +1,157 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const namespace = "envoy_router"
+
+//decisions of an authorization check
+const (
+	DECISION_OK              = "ok"
+	DECISION_NOT_FOUND       = "not_found"
+	DECISION_UNAUTHENTICATED = "unauthenticated"
+	DECISION_DENIED          = "denied"
+	DECISION_RATE_LIMITED    = "rate_limited"
+	DECISION_ERROR           = "error"
+)
+
+//phases of an external processing stream
+const (
+	PHASE_REQUEST_HEADERS  = "request_headers"
+	PHASE_REQUEST_BODY     = "request_body"
+	PHASE_RESPONSE_HEADERS = "response_headers"
+	PHASE_RESPONSE_BODY    = "response_body"
+	PHASE_UNKNOWN          = "unknown"
+)
+
+var checks = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: namespace,
+	Name:      "check_requests_total",
+	Help:      "ext_authz checks by route, backend, upstream auth and decision",
+}, []string{"route", "backend", "auth", "decision"})
+
+var checkDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: namespace,
+	Name:      "check_duration_seconds",
+	Help:      "Time to answer ext_authz checks, including upstream token fetches",
+	Buckets:   []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+}, []string{"route", "decision"})
+
+var tokenFetchDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: namespace,
+	Name:      "token_fetch_duration_seconds",
+	Help:      "Time to mint an upstream token, failures included",
+	Buckets:   prometheus.DefBuckets,
+}, []string{"kind"})
+
+var tokenFetchFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: namespace,
+	Name:      "token_fetch_failures_total",
+	Help:      "Upstream token fetches that failed",
+}, []string{"kind"})
+
+var extProcMessages = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: namespace,
+	Name:      "extproc_messages_total",
+	Help:      "ext_proc messages received by phase",
+}, []string{"phase"})
+
+var extProcRoutes = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: namespace,
+	Name:      "extproc_routes_total",
+	Help:      "ext_proc routing decisions by route and decision",
+}, []string{"route", "decision"})
+
+var extProcRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: namespace,
+	Name:      "extproc_request_duration_seconds",
+	Help:      "Time from the request headers to the end of the ext_proc stream, by route and response status class",
+	Buckets:   prometheus.DefBuckets,
+}, []string{"route", "status"})
+
+var openAPIRejections = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: namespace,
+	Name:      "openapi_rejections_total",
+	Help:      "Requests rejected by OpenAPI validation, by route and response status",
+}, []string{"route", "status"})
+
+var mockResponses = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: namespace,
+	Name:      "mock_responses_total",
+	Help:      "Responses served by mock routes, by route and response status",
+}, []string{"route", "status"})
+
+//Check holds the labels of an authorization check. They are filled in as
+//the check progresses, a request that matches no route has an empty route
+type Check struct {
+	Route   string
+	Backend string
+	Auth    string
+}
+
+//ObserveCheck records the decision of an authorization check and its duration
+func ObserveCheck(c Check, decision string, elapsed time.Duration) {
+	checks.WithLabelValues(c.Route, c.Backend, c.Auth, decision).Inc()
+	checkDuration.WithLabelValues(c.Route, decision).Observe(elapsed.Seconds())
+}
+
+//ObserveTokenFetch records an upstream token fetch of the kind, ex: access_token
+func ObserveTokenFetch(kind string, elapsed time.Duration, err error) {
+	tokenFetchDuration.WithLabelValues(kind).Observe(elapsed.Seconds())
+	if err != nil {
+		tokenFetchFailures.WithLabelValues(kind).Inc()
+	}
+}
+
+//ObserveExtProcMessage counts a message of an external processing stream
+func ObserveExtProcMessage(phase string) {
+	extProcMessages.WithLabelValues(phase).Inc()
+}
+
+//ObserveExtProcRoute records the routing decision of the external processing server
+func ObserveExtProcRoute(route string, decision string) {
+	extProcRoutes.WithLabelValues(route, decision).Inc()
+}
+
+//ObserveExtProcRequest records the duration of a request seen by the external
+//processing server. status is 0 when the response headers were not received
+func ObserveExtProcRequest(route string, status int, elapsed time.Duration) {
+	extProcRequestDuration.WithLabelValues(route, statusClass(status)).Observe(elapsed.Seconds())
+}
+
+//statusClass returns 2xx, 4xx, ... or unknown
+func statusClass(status int) string {
+	if status < 100 || status > 599 {
+		return "unknown"
+	}
+	return strconv.Itoa(status/100) + "xx"
+}
+
+//ObserveOpenAPIRejection counts a request rejected by the OpenAPI validation of the route
+func ObserveOpenAPIRejection(route string, status int) {
+	openAPIRejections.WithLabelValues(route, strconv.Itoa(status)).Inc()
+}
+
+//ObserveMockResponse counts a response served by a mock route
+func ObserveMockResponse(route string, status int) {
+	mockResponses.WithLabelValues(route, strconv.Itoa(status)).Inc()
+}
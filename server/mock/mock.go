@@ -0,0 +1,190 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mock
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strings"
+	"time"
+
+	openapi "github.com/srinandan/envoy-router/server/openapi"
+	transform "github.com/srinandan/envoy-router/server/transform"
+)
+
+//Mock answers the requests of a route instead of a backend. The response is
+//Body, or Template rendered with the request, or an example of an OpenAPI
+//document
+type Mock struct {
+	//Status is the status of the response, 200 by default
+	Status int `json:"status,omitempty"`
+	//Headers are added to the response, ex: content-type
+	Headers map[string]string `json:"headers,omitempty"`
+	//Body is the body of the response
+	Body string `json:"body,omitempty"`
+	//Template is a Go text/template rendered with a transform.Context of the
+	//request, its output is the body
+	Template string `json:"template,omitempty"`
+	//OpenAPI returns the examples of the operation of the request
+	OpenAPI *openapi.Validation `json:"openapi,omitempty"`
+	//Delay is added before responding, ex: 150ms
+	Delay string `json:"delay,omitempty"`
+	//Jitter adds a random delay up to the duration
+	Jitter   string `json:"jitter,omitempty"`
+	template *transform.Transform
+	delay    time.Duration
+	jitter   time.Duration
+}
+
+//Request is the request answered by the mock
+type Request struct {
+	Method string
+	//Path is the path sent to the backend, query string included
+	Path string
+	//Headers of the request, names are lower case
+	Headers map[string]string
+	Body    []byte
+	//Attributes of the request, ex: route, method, path, request_id
+	Attributes map[string]string
+}
+
+//Response is the response of the mock
+type Response struct {
+	Status int
+	//Headers names are lower case
+	Headers map[string]string
+	Body    []byte
+	//Example is the name of the OpenAPI example, if any
+	Example string
+}
+
+//Compile checks the response and parses the template and the durations
+func (m *Mock) Compile() error {
+	if m.Status != 0 && (m.Status < 200 || m.Status > 599) {
+		return fmt.Errorf("invalid status %d", m.Status)
+	}
+	if m.Body != "" && m.Template != "" {
+		return fmt.Errorf("body and template can't be used together")
+	}
+
+	headers := make(map[string]string, len(m.Headers))
+	for name, value := range m.Headers {
+		if name == "" || strings.HasPrefix(name, ":") {
+			return fmt.Errorf("invalid header name %q", name)
+		}
+		headers[strings.ToLower(name)] = value
+	}
+	m.Headers = headers
+
+	m.template = nil
+	if m.Template != "" {
+		m.template = &transform.Transform{Template: m.Template}
+		if err := m.template.Compile(); err != nil {
+			return err
+		}
+	}
+
+	if m.OpenAPI != nil {
+		if m.Status != 0 || m.Body != "" || m.Template != "" {
+			return fmt.Errorf("status, body and template are taken from the OpenAPI document")
+		}
+		if err := m.OpenAPI.Compile(); err != nil {
+			return fmt.Errorf("openapi: %v", err)
+		}
+	}
+
+	var err error
+	if m.delay, err = parseDuration(m.Delay); err != nil {
+		return fmt.Errorf("delay: %v", err)
+	}
+	if m.jitter, err = parseDuration(m.Jitter); err != nil {
+		return fmt.Errorf("jitter: %v", err)
+	}
+	return nil
+}
+
+func parseDuration(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, err
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("%s is negative", s)
+	}
+	return d, nil
+}
+
+//UsesBody returns true if the response depends on the request body
+func (m *Mock) UsesBody() bool {
+	return m.template != nil || m.OpenAPI != nil
+}
+
+//Latency returns the delay to wait before responding, jitter included
+func (m *Mock) Latency() time.Duration {
+	if m.jitter <= 0 {
+		return m.delay
+	}
+	return m.delay + time.Duration(rand.Int63n(int64(m.jitter)))
+}
+
+//Respond builds the response to the request. Requests that don't match the
+//OpenAPI document are answered with a problem, as by OpenAPI validation
+func (m *Mock) Respond(req Request) (Response, error) {
+	resp := Response{Status: http.StatusOK, Headers: map[string]string{}}
+
+	switch {
+	case m.OpenAPI != nil:
+		example, problem := m.find(req)
+		if problem != nil {
+			resp.Status = problem.Status
+			resp.Headers["content-type"] = openapi.ProblemContentType
+			resp.Body = []byte(problem.Body())
+			return resp, nil
+		}
+		resp.Status, resp.Body, resp.Example = example.Status, example.Body, example.Name
+		for name, value := range example.Headers {
+			resp.Headers[name] = value
+		}
+	case m.template != nil:
+		body, _, err := m.template.Apply(req.Body, "", req.Attributes, req.Headers)
+		if err != nil {
+			return resp, err
+		}
+		resp.Body = body
+	default:
+		resp.Body = []byte(m.Body)
+	}
+
+	if m.Status != 0 {
+		resp.Status = m.Status
+	}
+	for name, value := range m.Headers {
+		resp.Headers[name] = value
+	}
+	return resp, nil
+}
+
+//find returns the example of the operation of the request
+func (m *Mock) find(req Request) (*openapi.Example, *openapi.Problem) {
+	operation, problem := m.OpenAPI.Find(req.Method, req.Path, req.Headers)
+	if problem != nil {
+		return nil, problem
+	}
+	return operation.Example(req.Body)
+}
@@ -0,0 +1,349 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package openapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/getkin/kin-openapi/openapi3"
+)
+
+const jsonContentType = "application/json"
+
+//Example is a response built from the examples of an operation
+type Example struct {
+	//Name is the name of the example, empty for an unnamed example
+	Name   string
+	Status int
+	//Headers are the documented response headers that have an example, and
+	//content-type. Names are lower case
+	Headers map[string]string
+	Body    []byte
+}
+
+//Example returns the response to the request from the examples of the
+//operation. The client picks it with the Prefer header, ex: Prefer: code=404,
+//example=notFound. Otherwise the request body and parameters are compared with
+//the named request examples, and the response example with the same name is
+//returned. Otherwise it is the first example of the first success response
+func (o *Operation) Example(body []byte) (*Example, *Problem) {
+	prefer := parsePrefer(o.input.Request.Header.Values("prefer"))
+	responses := o.input.Route.Operation.Responses
+
+	codes := sortedCodes(responses)
+	status := 0
+	if code, ok := prefer["code"]; ok {
+		status, _ = strconv.Atoi(code)
+		documented := codeOf(responses, status)
+		if documented == "" {
+			return nil, newProblem(http.StatusBadRequest, fmt.Sprintf("the operation has no %s response", code), nil)
+		}
+		codes = []string{documented}
+	}
+
+	example := o.pick(codes, prefer, body)
+	if example == nil {
+		return nil, newProblem(http.StatusBadRequest, fmt.Sprintf("the operation has no response example %s", prefer["example"]), nil)
+	}
+	if status != 0 {
+		//the code asked for, not the first code of a range like 2XX
+		example.Status = status
+	}
+	return example, nil
+}
+
+//pick returns the example named by the client or by the request, else the
+//first example of the first success response. It is nil if the client named an
+//example that is not documented
+func (o *Operation) pick(codes []string, prefer map[string]string, body []byte) *Example {
+	name, preferred := prefer["example"]
+	if !preferred {
+		name = o.matchRequest(body)
+	}
+	if name != "" {
+		for _, code := range codes {
+			if example := o.example(code, name); example != nil {
+				return example
+			}
+		}
+		if preferred {
+			return nil
+		}
+	}
+
+	if len(codes) == 0 {
+		return &Example{Status: http.StatusOK, Headers: map[string]string{}}
+	}
+	code := codes[0]
+	for _, c := range codes {
+		if status := statusOf(c); status >= 200 && status < 300 {
+			code = c
+			break
+		}
+	}
+	return o.example(code, "")
+}
+
+//example builds the response documented by code. With a name, it is nil if the
+//response has no example with that name
+func (o *Operation) example(code string, name string) *Example {
+	response := o.input.Route.Operation.Responses[code].Value
+	example := &Example{Name: name, Status: statusOf(code), Headers: map[string]string{}}
+	if response == nil {
+		if name != "" {
+			return nil
+		}
+		return example
+	}
+
+	for header, ref := range response.Headers {
+		if ref.Value == nil {
+			continue
+		}
+		if value, found := parameterExample(&ref.Value.Parameter); found {
+			example.Headers[strings.ToLower(header)] = fmt.Sprint(value)
+		}
+	}
+
+	mediaType, content := o.mediaType(response.Content)
+	if content == nil {
+		if name != "" {
+			return nil
+		}
+		return example
+	}
+
+	var value interface{}
+	var found bool
+	if name != "" {
+		ref, ok := content.Examples[name]
+		if !ok || ref.Value == nil {
+			return nil
+		}
+		value, found = ref.Value.Value, true
+	} else if content.Example != nil {
+		value, found = content.Example, true
+	} else if names := sortedExamples(content.Examples); len(names) > 0 {
+		example.Name = names[0]
+		value, found = content.Examples[names[0]].Value.Value, true
+	} else if content.Schema != nil && content.Schema.Value != nil && content.Schema.Value.Example != nil {
+		value, found = content.Schema.Value.Example, true
+	}
+	if !found {
+		return example
+	}
+
+	example.Headers["content-type"] = mediaType
+	if s, ok := value.(string); ok && !isJSON(mediaType) {
+		example.Body = []byte(s)
+	} else {
+		example.Body, _ = json.Marshal(value)
+	}
+	return example
+}
+
+//mediaType picks the content the client accepts, else JSON, else the first one
+func (o *Operation) mediaType(content openapi3.Content) (string, *openapi3.MediaType) {
+	if len(content) == 0 {
+		return "", nil
+	}
+	for _, accept := range strings.Split(o.input.Request.Header.Get("accept"), ",") {
+		accept = strings.TrimSpace(strings.Split(accept, ";")[0])
+		if mediaType, ok := content[accept]; ok {
+			return accept, mediaType
+		}
+	}
+	if mediaType, ok := content[jsonContentType]; ok {
+		return jsonContentType, mediaType
+	}
+	names := make([]string, 0, len(content))
+	for name := range content {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names[0], content[names[0]]
+}
+
+//matchRequest returns the name of the request example equal to the body, or
+//else to a parameter of the request. It is empty if none matches
+func (o *Operation) matchRequest(body []byte) string {
+	operation := o.input.Route.Operation
+
+	if len(bytes.TrimSpace(body)) > 0 && operation.RequestBody != nil && operation.RequestBody.Value != nil {
+		contentType := o.input.Request.Header.Get("content-type")
+		if contentType == "" {
+			contentType = jsonContentType
+		}
+		if content := operation.RequestBody.Value.Content.Get(contentType); content != nil {
+			var decoded interface{}
+			if err := json.Unmarshal(body, &decoded); err == nil {
+				for _, name := range sortedExamples(content.Examples) {
+					if equalJSON(decoded, content.Examples[name].Value.Value) {
+						return name
+					}
+				}
+			}
+		}
+	}
+
+	parameters := append(openapi3.Parameters{}, o.input.Route.PathItem.Parameters...)
+	parameters = append(parameters, operation.Parameters...)
+	for _, ref := range parameters {
+		if ref.Value == nil {
+			continue
+		}
+		value, present := o.parameter(ref.Value)
+		if !present {
+			continue
+		}
+		for _, name := range sortedExamples(ref.Value.Examples) {
+			if fmt.Sprint(ref.Value.Examples[name].Value.Value) == value {
+				return name
+			}
+		}
+	}
+	return ""
+}
+
+//parameter returns the value of the parameter in the request
+func (o *Operation) parameter(p *openapi3.Parameter) (string, bool) {
+	switch p.In {
+	case openapi3.ParameterInPath:
+		value, ok := o.input.PathParams[p.Name]
+		return value, ok
+	case openapi3.ParameterInQuery:
+		values, ok := o.input.Request.URL.Query()[p.Name]
+		if !ok || len(values) == 0 {
+			return "", false
+		}
+		return values[0], true
+	case openapi3.ParameterInHeader:
+		values := o.input.Request.Header.Values(p.Name)
+		if len(values) == 0 {
+			return "", false
+		}
+		return values[0], true
+	}
+	return "", false
+}
+
+//parameterExample returns the example of a parameter or header, or of its schema
+func parameterExample(p *openapi3.Parameter) (interface{}, bool) {
+	if p.Example != nil {
+		return p.Example, true
+	}
+	if names := sortedExamples(p.Examples); len(names) > 0 {
+		return p.Examples[names[0]].Value.Value, true
+	}
+	if p.Schema != nil && p.Schema.Value != nil && p.Schema.Value.Example != nil {
+		return p.Schema.Value.Example, true
+	}
+	return nil, false
+}
+
+//parsePrefer reads the preferences of the Prefer headers, RFC 7240
+func parsePrefer(headers []string) map[string]string {
+	prefer := map[string]string{}
+	for _, header := range headers {
+		for _, preference := range strings.FieldsFunc(header, func(r rune) bool { return r == ',' || r == ';' }) {
+			name, value, _ := strings.Cut(strings.TrimSpace(preference), "=")
+			prefer[strings.ToLower(name)] = strings.Trim(value, `"`)
+		}
+	}
+	return prefer
+}
+
+//sortedCodes orders the codes of the responses: status codes, ranges like
+//2XX, then default
+func sortedCodes(responses openapi3.Responses) []string {
+	codes := make([]string, 0, len(responses))
+	for code := range responses {
+		codes = append(codes, code)
+	}
+	sort.Slice(codes, func(i, j int) bool {
+		if codes[i] == "default" || codes[j] == "default" {
+			return codes[j] == "default" && codes[i] != "default"
+		}
+		_, iErr := strconv.Atoi(codes[i])
+		_, jErr := strconv.Atoi(codes[j])
+		if (iErr == nil) != (jErr == nil) {
+			return iErr == nil
+		}
+		return codes[i] < codes[j]
+	})
+	return codes
+}
+
+//statusOf returns the status of a response code: 200 for 2XX, 500 for default
+func statusOf(code string) int {
+	if status, err := strconv.Atoi(code); err == nil {
+		return status
+	}
+	if len(code) == 3 && strings.EqualFold(code[1:], "xx") && code[0] >= '1' && code[0] <= '5' {
+		return int(code[0]-'0') * 100
+	}
+	return http.StatusInternalServerError
+}
+
+//codeOf returns the code of the response that documents the status, empty if
+//none does
+func codeOf(responses openapi3.Responses, status int) string {
+	if status < 100 || status > 599 {
+		return ""
+	}
+	code := strconv.Itoa(status)
+	for _, documented := range []string{code, code[:1] + "XX", code[:1] + "xx", "default"} {
+		if responses[documented] != nil {
+			return documented
+		}
+	}
+	return ""
+}
+
+func sortedExamples(examples openapi3.Examples) []string {
+	names := make([]string, 0, len(examples))
+	for name, ref := range examples {
+		if ref != nil && ref.Value != nil {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+//equalJSON compares a decoded body with an example, which may have been read
+//from YAML
+func equalJSON(a interface{}, b interface{}) bool {
+	encoded, err := json.Marshal(b)
+	if err != nil {
+		return false
+	}
+	var decoded interface{}
+	if err := json.Unmarshal(encoded, &decoded); err != nil {
+		return false
+	}
+	return reflect.DeepEqual(a, decoded)
+}
+
+func isJSON(mediaType string) bool {
+	return mediaType == jsonContentType || strings.HasSuffix(mediaType, "+json")
+}
@@ -0,0 +1,289 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package openapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/getkin/kin-openapi/openapi3filter"
+	"github.com/getkin/kin-openapi/routers"
+	"github.com/getkin/kin-openapi/routers/legacy"
+)
+
+//ProblemContentType is the content type of validation errors, RFC 7807
+const ProblemContentType = "application/problem+json"
+
+//Validation validates the requests of a route against an OpenAPI 3 document.
+//Requests are matched to operations by the path sent to the backend
+type Validation struct {
+	//File is the OpenAPI 3 document, YAML or JSON
+	File      string `json:"file"`
+	router    routers.Router
+	basePaths []string
+}
+
+//Compile loads and validates the document. It is read again every time the
+//routing table is loaded
+func (v *Validation) Compile() error {
+	if v.File == "" {
+		return fmt.Errorf("file is required")
+	}
+
+	loader := openapi3.NewLoader()
+	loader.IsExternalRefsAllowed = true
+	doc, err := loader.LoadFromFile(v.File)
+	if err != nil {
+		return fmt.Errorf("unable to load %s: %v", v.File, err)
+	}
+
+	//the router sees the path sent to the backend, not the server url. The
+	//paths of the servers are removed from it instead
+	v.basePaths = nil
+	for _, server := range doc.Servers {
+		if u, err := url.Parse(server.URL); err == nil {
+			if basePath := strings.TrimRight(u.Path, "/"); basePath != "" {
+				v.basePaths = append(v.basePaths, basePath)
+			}
+		}
+	}
+	sort.Slice(v.basePaths, func(i, j int) bool { return len(v.basePaths[i]) > len(v.basePaths[j]) })
+	doc.Servers = nil
+
+	if v.router, err = legacy.NewRouter(doc); err != nil {
+		return fmt.Errorf("%s: %v", v.File, err)
+	}
+	return nil
+}
+
+//Violation is a part of the request that does not match the document
+type Violation struct {
+	//In is path, query, header, cookie or body
+	In string `json:"in"`
+	//Name is the parameter, or the JSON pointer of the body field
+	Name   string `json:"name,omitempty"`
+	Detail string `json:"detail"`
+}
+
+//Problem is the RFC 7807 response to an invalid request
+type Problem struct {
+	Type       string      `json:"type"`
+	Title      string      `json:"title"`
+	Status     int         `json:"status"`
+	Detail     string      `json:"detail,omitempty"`
+	Violations []Violation `json:"violations,omitempty"`
+}
+
+//Body returns the problem as JSON
+func (p *Problem) Body() string {
+	b, _ := json.Marshal(p)
+	return string(b)
+}
+
+func newProblem(status int, detail string, violations []Violation) *Problem {
+	return &Problem{
+		Type:       "about:blank",
+		Title:      http.StatusText(status),
+		Status:     status,
+		Detail:     detail,
+		Violations: violations,
+	}
+}
+
+var methods = []string{
+	http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+	http.MethodDelete, http.MethodOptions, http.MethodTrace,
+}
+
+//Operation is the operation of the document that matches a request
+type Operation struct {
+	input *openapi3filter.RequestValidationInput
+}
+
+//Find returns the operation for the method and the path sent to the backend,
+//query string included. Requests that match no path are rejected with 404, and
+//with 405 if the path has no operation for the method
+func (v *Validation) Find(method string, path string, headers map[string]string) (*Operation, *Problem) {
+	u, err := url.ParseRequestURI(path)
+	if err != nil {
+		return nil, newProblem(http.StatusBadRequest, "invalid path", nil)
+	}
+	for _, basePath := range v.basePaths {
+		if u.Path == basePath || strings.HasPrefix(u.Path, basePath+"/") {
+			u.Path = strings.TrimPrefix(u.Path, basePath)
+			u.RawPath = ""
+			break
+		}
+	}
+
+	req := &http.Request{
+		Method: method,
+		URL:    u,
+		Header: http.Header{},
+	}
+	for name, value := range headers {
+		if !strings.HasPrefix(name, ":") {
+			req.Header.Set(name, value)
+		}
+	}
+
+	route, pathParams, err := v.router.FindRoute(req)
+	if err == nil && hasEmptyParam(pathParams) {
+		//the router matches /orders to /orders/{id}
+		err = routers.ErrPathNotFound
+	}
+	if err != nil {
+		if v.pathExists(req) {
+			return nil, newProblem(http.StatusMethodNotAllowed, fmt.Sprintf("%s is not allowed on %s", method, u.Path), nil)
+		}
+		return nil, newProblem(http.StatusNotFound, fmt.Sprintf("no operation for %s %s", method, u.Path), nil)
+	}
+
+	return &Operation{
+		input: &openapi3filter.RequestValidationInput{
+			Request:    req,
+			PathParams: pathParams,
+			Route:      route,
+			Options: &openapi3filter.Options{
+				MultiError: true,
+				//credentials are checked by the router or the backend
+				AuthenticationFunc: openapi3filter.NoopAuthenticationFunc,
+			},
+		},
+	}, nil
+}
+
+//pathExists returns true if the path of the request has an operation for
+//another method. The router only tells paths without parameters apart
+func (v *Validation) pathExists(req *http.Request) bool {
+	for _, method := range methods {
+		if method == req.Method {
+			continue
+		}
+		other := *req
+		other.Method = method
+		if _, pathParams, err := v.router.FindRoute(&other); err == nil && !hasEmptyParam(pathParams) {
+			return true
+		}
+	}
+	return false
+}
+
+func hasEmptyParam(pathParams map[string]string) bool {
+	for _, value := range pathParams {
+		if value == "" {
+			return true
+		}
+	}
+	return false
+}
+
+//HasBody returns true if the operation documents a request body
+func (o *Operation) HasBody() bool {
+	return o.input.Route.Operation.RequestBody != nil && o.input.Route.Operation.RequestBody.Value != nil
+}
+
+//ValidateParameters validates the path parameters, query and headers
+func (o *Operation) ValidateParameters(ctx context.Context) *Problem {
+	options := *o.input.Options
+	options.ExcludeRequestBody = true
+	input := *o.input
+	input.Options = &options
+
+	return problem(openapi3filter.ValidateRequest(ctx, &input))
+}
+
+//ValidateBody validates the body, empty if the request has none
+func (o *Operation) ValidateBody(ctx context.Context, body []byte) *Problem {
+	if !o.HasBody() {
+		return nil
+	}
+	req := o.input.Request.Clone(ctx)
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	req.ContentLength = int64(len(body))
+	input := *o.input
+	input.Request = req
+
+	return problem(openapi3filter.ValidateRequestBody(ctx, &input, o.input.Route.Operation.RequestBody.Value))
+}
+
+//problem lists the violations of a validation error, nil if the request is valid
+func problem(err error) *Problem {
+	if err == nil {
+		return nil
+	}
+
+	var violations []Violation
+	var collect func(err error)
+	collect = func(err error) {
+		//errors.As is not used, a MultiError matches any type it holds
+		if multi, ok := err.(openapi3.MultiError); ok {
+			for _, e := range multi {
+				collect(e)
+			}
+			return
+		}
+
+		requestErr, ok := err.(*openapi3filter.RequestError)
+		if !ok {
+			violations = append(violations, Violation{In: "request", Detail: err.Error()})
+			return
+		}
+
+		violation := Violation{In: "body", Detail: requestErr.Reason}
+		if requestErr.Parameter != nil {
+			violation.In = requestErr.Parameter.In
+			violation.Name = requestErr.Parameter.Name
+		}
+		violations = append(violations, causes(violation, requestErr.Err)...)
+	}
+	collect(err)
+
+	return newProblem(http.StatusBadRequest, "the request does not match the OpenAPI document", violations)
+}
+
+//causes details the violation with the schema errors that caused it
+func causes(violation Violation, err error) []Violation {
+	if multi, ok := err.(openapi3.MultiError); ok {
+		var violations []Violation
+		for _, e := range multi {
+			violations = append(violations, causes(violation, e)...)
+		}
+		return violations
+	}
+
+	var schemaErr *openapi3.SchemaError
+	if errors.As(err, &schemaErr) {
+		violation.Detail = schemaErr.Reason
+		if pointer := schemaErr.JSONPointer(); violation.In == "body" && len(pointer) > 0 {
+			violation.Name = "/" + strings.Join(pointer, "/")
+		}
+	} else if err != nil && err.Error() != violation.Detail {
+		if violation.Detail != "" {
+			violation.Detail += ": "
+		}
+		violation.Detail += err.Error()
+	}
+	return []Violation{violation}
+}
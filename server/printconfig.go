@@ -0,0 +1,70 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	config "github.com/srinandan/envoy-router/server/config"
+	"sigs.k8s.io/yaml"
+)
+
+//printConfig implements the print-config subcommand. It accepts the same
+//flags as the server and prints the configuration it would run with
+func printConfig(args []string) int {
+	var output string
+	var schema bool
+
+	fs := flag.NewFlagSet("print-config", flag.ExitOnError)
+	fs.StringVar(&output, "o", "yaml", "Output format, yaml or json")
+	fs.BoolVar(&schema, "schema", false, "Print the JSON schema of the configuration file")
+
+	cfg, err := config.Load(fs, args)
+	if schema {
+		os.Stdout.Write(config.Schema)
+		return 0
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		if cfg == nil {
+			return 1
+		}
+	}
+
+	var out []byte
+	switch output {
+	case "json":
+		out, err = json.MarshalIndent(cfg.Redacted(), "", "  ")
+		out = append(out, '\n')
+	case "yaml":
+		out, err = yaml.Marshal(cfg.Redacted())
+	default:
+		fmt.Fprintf(os.Stderr, "unknown output format %s\n", output)
+		return 1
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	os.Stdout.Write(out)
+	if cfg.Validate() != nil {
+		return 1
+	}
+	return 0
+}
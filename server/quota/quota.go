@@ -0,0 +1,131 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package quota
+
+import (
+	"fmt"
+	"time"
+
+	ratelimit "github.com/srinandan/envoy-router/server/ratelimit"
+)
+
+//calendar windows start on the minute, hour, day or month in the quota time zone
+const (
+	MINUTE = "minute"
+	HOUR   = "hour"
+	DAY    = "day"
+	MONTH  = "month"
+)
+
+//rollingSlots is the number of counters a rolling window is split into
+const rollingSlots = 60
+
+const defaultDenyBody = `{"error": "quota exceeded"}`
+const defaultDenyContentType = "application/json"
+
+//Quota is the number of requests a consumer can send to an api product in a
+//window. Window is a calendar window (minute, hour, day or month) or, for a
+//rolling window, a duration such as 24h
+type Quota struct {
+	Product         string          `json:"product,omitempty"`
+	KeyBy           ratelimit.KeyBy `json:"keyBy,omitempty"`
+	Header          string          `json:"header,omitempty"`
+	Limit           uint64          `json:"limit,omitempty"`
+	Window          string          `json:"window,omitempty"`
+	TimeZone        string          `json:"timeZone,omitempty"`
+	DenyBody        string          `json:"denyBody,omitempty"`
+	DenyContentType string          `json:"denyContentType,omitempty"`
+	location        *time.Location
+	rolling         time.Duration
+}
+
+//Result is the outcome of a quota check
+type Result struct {
+	Allowed   bool
+	Limit     uint64
+	Remaining uint64
+	//Reset is how long until requests are available again
+	Reset time.Duration
+}
+
+//Compile checks the quota, it is called when the routing table is loaded. The
+//product defaults to the route name
+func (q *Quota) Compile(route string) error {
+	var err error
+	if q.KeyBy, q.Header, err = ratelimit.CheckKeyBy(q.KeyBy, q.Header); err != nil {
+		return err
+	}
+
+	if q.Limit == 0 {
+		return fmt.Errorf("limit is required")
+	}
+
+	if q.Product == "" {
+		q.Product = route
+	}
+
+	q.rolling = 0
+	switch q.Window {
+	case MINUTE, HOUR, DAY, MONTH:
+	case "":
+		return fmt.Errorf("window is required")
+	default:
+		if q.rolling, err = time.ParseDuration(q.Window); err != nil || q.rolling < rollingSlots*time.Second {
+			return fmt.Errorf("window must be minute, hour, day, month or a duration of at least %ds", rollingSlots)
+		}
+	}
+
+	if q.location, err = time.LoadLocation(q.TimeZone); err != nil {
+		return fmt.Errorf("invalid timeZone %s", q.TimeZone)
+	}
+
+	if q.DenyBody == "" {
+		q.DenyBody = defaultDenyBody
+		q.DenyContentType = defaultDenyContentType
+	} else if q.DenyContentType == "" {
+		q.DenyContentType = "text/plain"
+	}
+
+	return nil
+}
+
+//Allow counts a request of the caller against the quota, unless it is exhausted
+func (q *Quota) Allow(c ratelimit.Caller) Result {
+	key := q.Product + ":" + q.Window + ":" + c.Identity(q.KeyBy, q.Header)
+	return counters.take(key, q, time.Now())
+}
+
+//calendarWindow returns the calendar window that contains now. Minutes and
+//hours are counted back from now, since the local time of the start is
+//ambiguous in the hour repeated when daylight saving time ends
+func (q *Quota) calendarWindow(now time.Time) (start time.Time, end time.Time) {
+	t := now.In(q.location)
+	intoMinute := time.Duration(t.Second())*time.Second + time.Duration(t.Nanosecond())
+	switch q.Window {
+	case MINUTE:
+		start = t.Add(-intoMinute)
+		end = start.Add(time.Minute)
+	case HOUR:
+		start = t.Add(-time.Duration(t.Minute())*time.Minute - intoMinute)
+		end = start.Add(time.Hour)
+	case DAY:
+		start = time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, q.location)
+		end = start.AddDate(0, 0, 1)
+	default:
+		start = time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, q.location)
+		end = start.AddDate(0, 1, 0)
+	}
+	return start, end
+}
@@ -0,0 +1,194 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package quota
+
+import (
+	"testing"
+	"time"
+)
+
+func parseTime(t *testing.T, value string) time.Time {
+	t.Helper()
+	parsed, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parsed
+}
+
+func compile(t *testing.T, q Quota) *Quota {
+	t.Helper()
+	if err := q.Compile("orders"); err != nil {
+		t.Fatal(err)
+	}
+	return &q
+}
+
+func TestCompile(t *testing.T) {
+	tests := []struct {
+		name    string
+		quota   Quota
+		wantErr bool
+	}{
+		{"calendar", Quota{Limit: 10, Window: DAY}, false},
+		{"rolling", Quota{Limit: 10, Window: "24h"}, false},
+		{"time zone", Quota{Limit: 10, Window: MONTH, TimeZone: "Europe/Paris"}, false},
+		{"no limit", Quota{Window: DAY}, true},
+		{"no window", Quota{Limit: 10}, true},
+		{"unknown window", Quota{Limit: 10, Window: "week"}, true},
+		{"rolling window too short", Quota{Limit: 10, Window: "30s"}, true},
+		{"unknown time zone", Quota{Limit: 10, Window: DAY, TimeZone: "Mars/Olympus"}, true},
+		{"header without name", Quota{Limit: 10, Window: DAY, KeyBy: "header"}, true},
+	}
+	for _, test := range tests {
+		if err := test.quota.Compile("orders"); (err != nil) != test.wantErr {
+			t.Errorf("%s: got error %v, want error %v", test.name, err, test.wantErr)
+		}
+	}
+
+	q := compile(t, Quota{Limit: 10, Window: DAY})
+	if q.Product != "orders" || q.DenyBody != defaultDenyBody || q.location != time.UTC {
+		t.Errorf("defaults not set: %+v", q)
+	}
+}
+
+func TestCalendarWindow(t *testing.T) {
+	tests := []struct {
+		name     string
+		window   string
+		timeZone string
+		now      string
+		start    string
+		end      string
+	}{
+		{"minute", MINUTE, "", "2023-05-10T10:15:42.5Z", "2023-05-10T10:15:00Z", "2023-05-10T10:16:00Z"},
+		{"hour", HOUR, "", "2023-05-10T10:15:42Z", "2023-05-10T10:00:00Z", "2023-05-10T11:00:00Z"},
+		{"hour half hour offset", HOUR, "Asia/Kolkata", "2023-05-10T10:15:00Z", "2023-05-10T09:30:00Z", "2023-05-10T10:30:00Z"},
+		{"hour repeated at the end of daylight saving time", HOUR, "America/New_York", "2023-11-05T06:30:00Z", "2023-11-05T06:00:00Z", "2023-11-05T07:00:00Z"},
+		{"day", DAY, "", "2023-05-10T23:59:59Z", "2023-05-10T00:00:00Z", "2023-05-11T00:00:00Z"},
+		{"day local date differs", DAY, "America/New_York", "2023-05-10T02:00:00Z", "2023-05-09T04:00:00Z", "2023-05-10T04:00:00Z"},
+		{"day of 23 hours", DAY, "America/New_York", "2023-03-12T12:00:00Z", "2023-03-12T05:00:00Z", "2023-03-13T04:00:00Z"},
+		{"day of 25 hours", DAY, "America/New_York", "2023-11-05T12:00:00Z", "2023-11-05T04:00:00Z", "2023-11-06T05:00:00Z"},
+		{"month", MONTH, "", "2023-05-10T10:00:00Z", "2023-05-01T00:00:00Z", "2023-06-01T00:00:00Z"},
+		{"month year rollover", MONTH, "", "2023-12-31T23:59:59Z", "2023-12-01T00:00:00Z", "2024-01-01T00:00:00Z"},
+		{"month local year rollover", MONTH, "Pacific/Auckland", "2023-12-31T12:00:00Z", "2023-12-31T11:00:00Z", "2024-01-31T11:00:00Z"},
+		{"leap february", MONTH, "", "2024-02-29T10:00:00Z", "2024-02-01T00:00:00Z", "2024-03-01T00:00:00Z"},
+	}
+
+	for _, test := range tests {
+		q := compile(t, Quota{Limit: 1, Window: test.window, TimeZone: test.timeZone})
+		now := parseTime(t, test.now)
+		start, end := q.calendarWindow(now)
+		if !start.Equal(parseTime(t, test.start)) || !end.Equal(parseTime(t, test.end)) {
+			t.Errorf("%s: got %s - %s, want %s - %s", test.name, start.UTC().Format(time.RFC3339),
+				end.UTC().Format(time.RFC3339), test.start, test.end)
+		}
+		if now.Before(start) || !now.Before(end) {
+			t.Errorf("%s: %s is not in the window", test.name, test.now)
+		}
+	}
+}
+
+func TestCalendarTake(t *testing.T) {
+	store := &counterStore{Counters: map[string]*counter{}}
+	q := compile(t, Quota{Limit: 2, Window: DAY, TimeZone: "America/New_York"})
+	//22:00 on May 9 in New York
+	now := parseTime(t, "2023-05-10T02:00:00Z")
+
+	steps := []struct {
+		after     time.Duration
+		allowed   bool
+		remaining uint64
+		reset     time.Duration
+	}{
+		{0, true, 1, 2 * time.Hour},
+		{time.Minute, true, 0, 2*time.Hour - time.Minute},
+		{time.Hour, false, 0, time.Hour},
+		//midnight in New York
+		{2 * time.Hour, true, 1, 24 * time.Hour},
+		{3 * time.Hour, true, 0, 23 * time.Hour},
+		{4 * time.Hour, false, 0, 22 * time.Hour},
+		//the clock went back to the previous day
+		{time.Hour + 30*time.Minute, true, 1, 30 * time.Minute},
+	}
+	for i, step := range steps {
+		result := store.take("orders:day:ip:10.0.0.1", q, now.Add(step.after))
+		if result.Allowed != step.allowed || result.Remaining != step.remaining || result.Reset != step.reset || result.Limit != 2 {
+			t.Errorf("step %d: got %+v, want allowed %v, remaining %d, reset %s", i, result, step.allowed, step.remaining, step.reset)
+		}
+	}
+
+	//consumers are counted separately
+	if result := store.take("orders:day:ip:10.0.0.2", q, now.Add(4*time.Hour)); !result.Allowed {
+		t.Errorf("another consumer: got %+v, want allowed", result)
+	}
+}
+
+func TestRollingTake(t *testing.T) {
+	store := &counterStore{Counters: map[string]*counter{}}
+	q := compile(t, Quota{Limit: 3, Window: "1h"})
+	now := parseTime(t, "2023-05-10T10:00:30Z")
+
+	steps := []struct {
+		after     time.Duration
+		allowed   bool
+		remaining uint64
+		reset     time.Duration
+	}{
+		{0, true, 2, time.Hour - 30*time.Second},
+		{10 * time.Minute, true, 1, 50*time.Minute - 30*time.Second},
+		{20 * time.Minute, true, 0, 40*time.Minute - 30*time.Second},
+		//the first request leaves the window at 11:00
+		{30 * time.Minute, false, 0, 29*time.Minute + 30*time.Second},
+		{59*time.Minute + 29*time.Second, false, 0, time.Second},
+		{60 * time.Minute, true, 0, 9*time.Minute + 30*time.Second},
+		{65 * time.Minute, false, 0, 4*time.Minute + 30*time.Second},
+		//the window is empty after an hour without requests
+		{3 * time.Hour, true, 2, time.Hour - 30*time.Second},
+	}
+	for i, step := range steps {
+		result := store.take("orders:1h:ip:10.0.0.1", q, now.Add(step.after))
+		if result.Allowed != step.allowed || result.Remaining != step.remaining || result.Reset != step.reset {
+			t.Errorf("step %d: got %+v, want allowed %v, remaining %d, reset %s", i, result, step.allowed, step.remaining, step.reset)
+		}
+	}
+
+	c := store.Counters["orders:1h:ip:10.0.0.1"]
+	if len(c.Slots) != 1 {
+		t.Errorf("got %d slots, want 1: %v", len(c.Slots), c.Slots)
+	}
+}
+
+func TestExpired(t *testing.T) {
+	store := &counterStore{Counters: map[string]*counter{}}
+	day := compile(t, Quota{Limit: 5, Window: DAY})
+	rolling := compile(t, Quota{Limit: 5, Window: "10m"})
+	now := parseTime(t, "2023-05-10T23:50:00Z")
+
+	store.take("day", day, now)
+	store.take("rolling", rolling, now)
+
+	store.expired(now.Add(5 * time.Minute))
+	if len(store.Counters) != 2 {
+		t.Errorf("got %d counters, want 2", len(store.Counters))
+	}
+	store.expired(now.Add(10 * time.Minute))
+	if _, found := store.Counters["day"]; found {
+		t.Error("the counter of the previous day is kept")
+	}
+	if _, found := store.Counters["rolling"]; found {
+		t.Error("the rolling counter is kept after its last request left the window")
+	}
+}
@@ -0,0 +1,253 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package quota
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+//counter counts the requests of a consumer. Calendar windows use start, end
+//and count, rolling windows count per slot, indexed by the slot start in unix seconds
+type counter struct {
+	Start time.Time        `json:"start,omitempty"`
+	End   time.Time        `json:"end,omitempty"`
+	Count uint64           `json:"count,omitempty"`
+	Slots map[int64]uint64 `json:"slots,omitempty"`
+}
+
+//counterStore holds the counters of every consumer. It is saved to file, if
+//one is set, so quotas survive restarts
+type counterStore struct {
+	Counters  map[string]*counter `json:"counters"`
+	file      string
+	dirty     bool
+	lastSweep time.Time
+	sync.Mutex
+}
+
+//sweepInterval is how often the counters of windows that are over are dropped
+const sweepInterval = time.Minute
+
+var counters = &counterStore{Counters: map[string]*counter{}}
+
+func (s *counterStore) take(key string, q *Quota, now time.Time) Result {
+	s.Lock()
+	defer s.Unlock()
+
+	if now.Sub(s.lastSweep) > sweepInterval {
+		s.expired(now)
+	}
+
+	c, found := s.Counters[key]
+	if !found {
+		c = &counter{}
+		s.Counters[key] = c
+	}
+
+	if q.rolling > 0 {
+		return s.takeRolling(c, q, now)
+	}
+
+	if !now.Before(c.End) || now.Before(c.Start) {
+		c.Start, c.End = q.calendarWindow(now)
+		c.Count = 0
+		c.Slots = nil
+	}
+
+	result := Result{Limit: q.Limit, Reset: c.End.Sub(now)}
+	if c.Count >= q.Limit {
+		return result
+	}
+
+	c.Count++
+	s.dirty = true
+	result.Allowed = true
+	result.Remaining = q.Limit - c.Count
+	return result
+}
+
+//takeRolling counts the requests in the slots that overlap the window. The
+//window moves one slot at a time
+func (s *counterStore) takeRolling(c *counter, q *Quota, now time.Time) Result {
+	slot := q.rolling / rollingSlots
+	current := now.Truncate(slot)
+	oldest := current.Add(-slot * (rollingSlots - 1))
+
+	if c.Slots == nil {
+		c.Slots = map[int64]uint64{}
+	}
+
+	var total uint64
+	next := current
+	for start, count := range c.Slots {
+		t := time.Unix(start, 0)
+		if t.Before(oldest) {
+			delete(c.Slots, start)
+			continue
+		}
+		total += count
+		if t.Before(next) {
+			next = t
+		}
+	}
+
+	//requests become available again when the oldest slot leaves the window
+	result := Result{Limit: q.Limit, Reset: next.Add(q.rolling).Sub(now)}
+	if total >= q.Limit {
+		return result
+	}
+
+	c.Slots[current.Unix()]++
+	c.End = current.Add(q.rolling)
+	s.dirty = true
+	result.Allowed = true
+	result.Remaining = q.Limit - total - 1
+	return result
+}
+
+//expired drops the counters of windows that are over. For rolling windows,
+//end is when the last request counted leaves the window
+func (s *counterStore) expired(now time.Time) {
+	for key, c := range s.Counters {
+		if !now.Before(c.End) {
+			delete(s.Counters, key)
+		}
+	}
+	s.lastSweep = now
+}
+
+//ReadCountersFile loads the counters saved by a previous run and saves them to
+//the same file from now on
+func ReadCountersFile(file string) error {
+	counters.Lock()
+	defer counters.Unlock()
+
+	counters.file = file
+
+	countersBytes, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	saved := &counterStore{}
+	if err = json.Unmarshal(countersBytes, saved); err != nil {
+		return err
+	}
+	if saved.Counters != nil {
+		counters.Counters = saved.Counters
+	}
+	counters.expired(time.Now())
+	return nil
+}
+
+//snapshot copies the counters so they can be saved without holding the lock
+func (s *counterStore) snapshot() *counterStore {
+	saved := &counterStore{Counters: make(map[string]*counter, len(s.Counters))}
+	for key, c := range s.Counters {
+		copied := *c
+		if c.Slots != nil {
+			copied.Slots = make(map[int64]uint64, len(c.Slots))
+			for slot, count := range c.Slots {
+				copied.Slots[slot] = count
+			}
+		}
+		saved.Counters[key] = &copied
+	}
+	return saved
+}
+
+//saveLock keeps saves in order, an older snapshot never replaces a newer one
+var saveLock sync.Mutex
+
+//SaveCounters writes the counters to file if they changed since the last save.
+//The file is replaced as a whole so a crash never leaves it half written. Only
+//the copy of the counters is done under the lock, quotas aren't held up by disk I/O
+func SaveCounters() error {
+	saveLock.Lock()
+	defer saveLock.Unlock()
+
+	counters.Lock()
+	if counters.file == "" || !counters.dirty {
+		counters.Unlock()
+		return nil
+	}
+	counters.expired(time.Now())
+	saved, file := counters.snapshot(), counters.file
+	counters.dirty = false
+	counters.Unlock()
+
+	if err := writeCountersFile(saved, file); err != nil {
+		//save again next time
+		counters.Lock()
+		counters.dirty = true
+		counters.Unlock()
+		return err
+	}
+	return nil
+}
+
+//writeCountersFile replaces file with the counters of saved
+func writeCountersFile(saved *counterStore, file string) error {
+	countersBytes, err := json.Marshal(saved)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(file), filepath.Base(file)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err = tmp.Write(countersBytes); err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), file)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+//SaveCountersEvery saves the counters periodically
+func SaveCountersEvery(interval time.Duration) (stop func()) {
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				if err := SaveCounters(); err != nil {
+					slog.Error("unable to save quota counters", "error", err)
+				}
+			case <-done:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+	return func() { close(done) }
+}
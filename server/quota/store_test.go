@@ -0,0 +1,172 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package quota
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	ratelimit "github.com/srinandan/envoy-router/server/ratelimit"
+)
+
+//resetCounters replaces the counters of the process until the test ends
+func resetCounters(t *testing.T) {
+	t.Helper()
+	previous := counters
+	counters = &counterStore{Counters: map[string]*counter{}}
+	t.Cleanup(func() { counters = previous })
+}
+
+func TestReadCountersFile(t *testing.T) {
+	resetCounters(t)
+	file := filepath.Join(t.TempDir(), "counters.json")
+	caller := ratelimit.Caller{IP: "10.0.0.1", APIKey: "key-1"}
+	calendar := compile(t, Quota{Limit: 2, Window: MONTH, KeyBy: ratelimit.API_KEY})
+	rolling := compile(t, Quota{Limit: 2, Window: "24h"})
+
+	//a missing file is created on the first save
+	if err := ReadCountersFile(file); err != nil {
+		t.Fatal(err)
+	}
+	for _, q := range []*Quota{calendar, rolling} {
+		q.Allow(caller)
+		if result := q.Allow(caller); !result.Allowed || result.Remaining != 0 {
+			t.Fatalf("%s: got %+v, want the last request allowed", q.Window, result)
+		}
+	}
+	if err := SaveCounters(); err != nil {
+		t.Fatal(err)
+	}
+
+	//a restart
+	counters = &counterStore{Counters: map[string]*counter{}}
+	if err := ReadCountersFile(file); err != nil {
+		t.Fatal(err)
+	}
+	for _, q := range []*Quota{calendar, rolling} {
+		if result := q.Allow(caller); result.Allowed {
+			t.Errorf("%s: got %+v, want the quota exhausted after reloading", q.Window, result)
+		}
+	}
+	if result := calendar.Allow(ratelimit.Caller{IP: "10.0.0.1", APIKey: "key-2"}); !result.Allowed {
+		t.Errorf("another consumer: got %+v, want allowed", result)
+	}
+}
+
+func TestReadCountersFileDropsExpiredCounters(t *testing.T) {
+	resetCounters(t)
+	now := time.Now()
+	saved := counterStore{Counters: map[string]*counter{
+		"over":     {Start: now.Add(-2 * time.Hour), End: now.Add(-time.Hour), Count: 5},
+		"current":  {Start: now.Add(-time.Hour), End: now.Add(time.Hour), Count: 3},
+		"rolling":  {End: now.Add(time.Hour), Slots: map[int64]uint64{now.Unix(): 2}},
+		"finished": {End: now.Add(-time.Minute), Slots: map[int64]uint64{now.Add(-time.Hour).Unix(): 2}},
+	}}
+	content, err := json.Marshal(&saved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(t.TempDir(), "counters.json")
+	if err := os.WriteFile(file, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ReadCountersFile(file); err != nil {
+		t.Fatal(err)
+	}
+	if len(counters.Counters) != 2 || counters.Counters["current"] == nil || counters.Counters["rolling"] == nil {
+		t.Errorf("got counters %v, want current and rolling", counters.Counters)
+	}
+	if c := counters.Counters["rolling"]; c != nil && c.Slots[now.Unix()] != 2 {
+		t.Errorf("rolling slots not reloaded: %v", c.Slots)
+	}
+}
+
+func TestReadCountersFileInvalid(t *testing.T) {
+	resetCounters(t)
+	file := filepath.Join(t.TempDir(), "counters.json")
+	if err := os.WriteFile(file, []byte(`{"counters": [`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ReadCountersFile(file); err == nil {
+		t.Error("got no error")
+	}
+}
+
+func TestSaveCountersOnlyWhenChanged(t *testing.T) {
+	resetCounters(t)
+	file := filepath.Join(t.TempDir(), "counters.json")
+	if err := ReadCountersFile(file); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := SaveCounters(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(file); !os.IsNotExist(err) {
+		t.Errorf("the counters were saved without changes: %v", err)
+	}
+
+	compile(t, Quota{Limit: 5, Window: DAY}).Allow(ratelimit.Caller{IP: "10.0.0.1"})
+	if err := SaveCounters(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(file); err != nil {
+		t.Errorf("the counters were not saved: %v", err)
+	}
+	if matches, _ := filepath.Glob(file + ".tmp*"); len(matches) != 0 {
+		t.Errorf("temporary files left: %v", matches)
+	}
+}
+
+func TestSaveCountersAgainAfterFailure(t *testing.T) {
+	resetCounters(t)
+	dir := filepath.Join(t.TempDir(), "missing")
+	file := filepath.Join(dir, "counters.json")
+	if err := ReadCountersFile(file); err != nil {
+		t.Fatal(err)
+	}
+
+	compile(t, Quota{Limit: 5, Window: DAY}).Allow(ratelimit.Caller{IP: "10.0.0.1"})
+	if err := SaveCounters(); err == nil {
+		t.Fatal("saving to a missing directory must fail")
+	}
+
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := SaveCounters(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(file); err != nil {
+		t.Errorf("the counters were not saved after the failure: %v", err)
+	}
+}
+
+func TestSnapshotCopiesSlots(t *testing.T) {
+	store := &counterStore{Counters: map[string]*counter{
+		"10.0.0.1": {Count: 1, Slots: map[int64]uint64{60: 1}},
+	}}
+	saved := store.snapshot()
+	store.Counters["10.0.0.1"].Count = 2
+	store.Counters["10.0.0.1"].Slots[60] = 2
+
+	if c := saved.Counters["10.0.0.1"]; c.Count != 1 || c.Slots[60] != 1 {
+		t.Errorf("the snapshot changed with the counters: %+v", c)
+	}
+}
@@ -0,0 +1,225 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	logging "github.com/srinandan/envoy-router/server/logging"
+)
+
+type KeyBy string
+
+const (
+	IP          KeyBy = "ip"
+	API_KEY     KeyBy = "apiKey"
+	JWT_SUBJECT KeyBy = "jwtSubject"
+	HEADER      KeyBy = "header"
+)
+
+//keyPrefix namespaces the buckets in a shared store
+const keyPrefix = "envoy-router:ratelimit:"
+
+//spikeArrestRate is written as <n>ps or <n>pm, ex: 10ps or 600pm
+var spikeArrestRate = regexp.MustCompile(`^([0-9]+)(ps|pm)$`)
+
+//Limit is the rate limit of a route. requests per period are allowed, with
+//bursts of up to burst requests. spikeArrest smooths traffic to an even rate
+//and has no burst
+type Limit struct {
+	KeyBy       KeyBy  `json:"keyBy,omitempty"`
+	Header      string `json:"header,omitempty"`
+	Requests    uint32 `json:"requests,omitempty"`
+	Period      string `json:"period,omitempty"`
+	Burst       uint32 `json:"burst,omitempty"`
+	SpikeArrest string `json:"spikeArrest,omitempty"`
+	rate        *Bucket
+	spike       *Bucket
+}
+
+//Bucket is a token bucket. A token is added every interval, up to capacity
+type Bucket struct {
+	Interval time.Duration
+	Capacity uint32
+}
+
+//Caller identifies the client of a request
+type Caller struct {
+	IP      string
+	APIKey  string
+	Subject string
+	Headers map[string]string
+}
+
+//Result is the outcome of a rate limit check
+type Result struct {
+	Allowed bool
+	//Limit is the capacity of the bucket
+	Limit uint32
+	//Remaining is the number of requests that can be sent right away
+	Remaining uint32
+	//RetryAfter is how long to wait before the next request is allowed
+	RetryAfter time.Duration
+	//Reset is how long until the bucket is full again
+	Reset time.Duration
+}
+
+//Compile checks the limit, it is called when the routing table is loaded
+func (l *Limit) Compile() error {
+	var err error
+	if l.KeyBy, l.Header, err = CheckKeyBy(l.KeyBy, l.Header); err != nil {
+		return err
+	}
+
+	if l.Requests == 0 && l.SpikeArrest == "" {
+		return fmt.Errorf("one of requests or spikeArrest is required")
+	}
+
+	l.rate, l.spike = nil, nil
+
+	if l.Requests > 0 {
+		period := time.Second
+		if l.Period != "" {
+			if period, err = time.ParseDuration(l.Period); err != nil || period <= 0 {
+				return fmt.Errorf("invalid period %s", l.Period)
+			}
+		}
+		burst := l.Burst
+		if burst == 0 {
+			burst = l.Requests
+		}
+		l.rate = &Bucket{Interval: period / time.Duration(l.Requests), Capacity: burst}
+	}
+
+	if l.SpikeArrest != "" {
+		m := spikeArrestRate.FindStringSubmatch(l.SpikeArrest)
+		if m == nil {
+			return fmt.Errorf("invalid spikeArrest %s, ex: 10ps or 600pm", l.SpikeArrest)
+		}
+		n, err := strconv.ParseUint(m[1], 10, 32)
+		if err != nil || n == 0 {
+			return fmt.Errorf("invalid spikeArrest %s", l.SpikeArrest)
+		}
+		unit := time.Second
+		if m[2] == "pm" {
+			unit = time.Minute
+		}
+		l.spike = &Bucket{Interval: unit / time.Duration(n), Capacity: 1}
+	}
+
+	if (l.rate != nil && l.rate.Interval <= 0) || (l.spike != nil && l.spike.Interval <= 0) {
+		return fmt.Errorf("rate is too high")
+	}
+
+	return nil
+}
+
+//CheckKeyBy checks the identity a limit is keyed by and returns the header
+//name in lower case
+func CheckKeyBy(keyBy KeyBy, header string) (KeyBy, string, error) {
+	switch keyBy {
+	case "":
+		return IP, header, nil
+	case IP, API_KEY, JWT_SUBJECT:
+		return keyBy, header, nil
+	case HEADER:
+		if header == "" {
+			return keyBy, header, fmt.Errorf("header is required when keyBy is header")
+		}
+		return keyBy, strings.ToLower(header), nil
+	}
+	return keyBy, header, fmt.Errorf("unknown keyBy %s", keyBy)
+}
+
+//Identity returns the identity of the caller a limit is keyed by. Callers
+//without it, ex: a missing header, are identified by their address
+func (c Caller) Identity(keyBy KeyBy, header string) string {
+	var id string
+	switch keyBy {
+	case API_KEY:
+		id = c.APIKey
+	case JWT_SUBJECT:
+		id = c.Subject
+	case HEADER:
+		id = c.Headers[header]
+	}
+	if id == "" {
+		return string(IP) + ":" + c.IP
+	}
+	return string(keyBy) + ":" + id
+}
+
+//Allow takes a token from the buckets of the caller on the route, from both or
+//from none when there is a spike arrest and a rate. If the store cannot be
+//reached, the request is allowed
+func (l *Limit) Allow(ctx context.Context, route string, c Caller) Result {
+	key := keyPrefix + route + ":" + c.Identity(l.KeyBy, l.Header)
+
+	var keys []string
+	var buckets []Bucket
+	if l.spike != nil {
+		keys, buckets = append(keys, key+":spike"), append(buckets, *l.spike)
+	}
+	if l.rate != nil {
+		keys, buckets = append(keys, key), append(buckets, *l.rate)
+	}
+	if len(keys) == 0 {
+		return Result{Allowed: true}
+	}
+
+	result, err := getStore().Take(ctx, keys, buckets, time.Now())
+	if err != nil {
+		logging.FromContext(ctx).Error("unable to check rate limit, allowing the request", "route", route, "error", err)
+		return Result{Allowed: true}
+	}
+	return result
+}
+
+//Seconds rounds a duration up to whole seconds, as used in Retry-After
+func Seconds(d time.Duration) string {
+	return strconv.FormatInt(int64(math.Ceil(d.Seconds())), 10)
+}
+
+//gcra implements the token bucket as a generic cell rate algorithm. Instead
+//of a token count, it stores tat, the time at which the bucket will be full
+//again. It returns the outcome and the new tat
+func gcra(b Bucket, tat time.Time, now time.Time) (Result, time.Time) {
+	if tat.Before(now) {
+		tat = now
+	}
+	newTat := tat.Add(b.Interval)
+	allowAt := newTat.Add(-time.Duration(b.Capacity) * b.Interval)
+
+	if now.Before(allowAt) {
+		return Result{
+			Limit:      b.Capacity,
+			RetryAfter: allowAt.Sub(now),
+			Reset:      tat.Sub(now),
+		}, tat
+	}
+
+	return Result{
+		Allowed:   true,
+		Limit:     b.Capacity,
+		Remaining: uint32(now.Sub(allowAt) / b.Interval),
+		Reset:     newTat.Sub(now),
+	}, newTat
+}
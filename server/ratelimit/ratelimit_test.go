@@ -0,0 +1,157 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestCompile(t *testing.T) {
+	tests := []struct {
+		name  string
+		limit Limit
+		rate  *Bucket
+		spike *Bucket
+		err   bool
+	}{
+		{"requests per second", Limit{Requests: 10}, &Bucket{100 * time.Millisecond, 10}, nil, false},
+		{"burst", Limit{Requests: 60, Period: "1m", Burst: 5}, &Bucket{time.Second, 5}, nil, false},
+		{"spike arrest per second", Limit{SpikeArrest: "10ps"}, nil, &Bucket{100 * time.Millisecond, 1}, false},
+		{"spike arrest per minute", Limit{SpikeArrest: "600pm"}, nil, &Bucket{100 * time.Millisecond, 1}, false},
+		{"both", Limit{Requests: 1, SpikeArrest: "1ps"}, &Bucket{time.Second, 1}, &Bucket{time.Second, 1}, false},
+		{"nothing", Limit{}, nil, nil, true},
+		{"invalid period", Limit{Requests: 1, Period: "-1s"}, nil, nil, true},
+		{"invalid spike arrest", Limit{SpikeArrest: "10/s"}, nil, nil, true},
+		{"zero spike arrest", Limit{SpikeArrest: "0ps"}, nil, nil, true},
+		{"header without name", Limit{Requests: 1, KeyBy: HEADER}, nil, nil, true},
+		{"unknown key", Limit{Requests: 1, KeyBy: "cookie"}, nil, nil, true},
+	}
+	for _, test := range tests {
+		err := test.limit.Compile()
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: no error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !sameBucket(test.limit.rate, test.rate) || !sameBucket(test.limit.spike, test.spike) {
+			t.Errorf("%s: got rate %v spike %v, want %v %v", test.name, test.limit.rate, test.limit.spike, test.rate, test.spike)
+		}
+		if test.limit.KeyBy != IP {
+			t.Errorf("%s: keyBy %s, want ip by default", test.name, test.limit.KeyBy)
+		}
+	}
+}
+
+func sameBucket(a *Bucket, b *Bucket) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+func TestGCRA(t *testing.T) {
+	b := Bucket{Interval: time.Second, Capacity: 3}
+	now := time.Unix(1700000000, 0)
+	var tat time.Time
+	var result Result
+
+	for i := uint32(0); i < b.Capacity; i++ {
+		if result, tat = gcra(b, tat, now); !result.Allowed || result.Remaining != b.Capacity-i-1 {
+			t.Fatalf("request %d: %+v", i, result)
+		}
+	}
+	if result, tat = gcra(b, tat, now); result.Allowed || result.RetryAfter != time.Second || result.Reset != 3*time.Second {
+		t.Errorf("over the burst: %+v", result)
+	}
+	if result, _ = gcra(b, tat, now.Add(time.Second)); !result.Allowed || result.Remaining != 0 {
+		t.Errorf("after a refill: %+v", result)
+	}
+}
+
+func TestMemoryStoreTakesAllOrNothing(t *testing.T) {
+	m := NewMemoryStore()
+	ctx := context.Background()
+	spike := Bucket{Interval: 100 * time.Millisecond, Capacity: 1}
+	rate := Bucket{Interval: time.Second, Capacity: 1}
+	keys := []string{"key:spike", "key"}
+	now := time.Unix(1700000000, 0)
+
+	if result, _ := m.Take(ctx, keys, []Bucket{spike, rate}, now); !result.Allowed {
+		t.Fatalf("first take: %+v", result)
+	}
+	spikeTat := m.tats["key:spike"]
+
+	//the spike arrest allows it, the rate does not
+	result, _ := m.Take(ctx, keys, []Bucket{spike, rate}, now.Add(200*time.Millisecond))
+	if result.Allowed || result.RetryAfter != 800*time.Millisecond {
+		t.Errorf("got %+v, want denied by the rate bucket", result)
+	}
+	if !m.tats["key:spike"].Equal(spikeTat) {
+		t.Errorf("spike arrest token taken by a denied request")
+	}
+
+	//the spike arrest denies it, the rate is not touched
+	rateTat := m.tats["key"]
+	if result, _ = m.Take(ctx, keys, []Bucket{spike, rate}, now.Add(50*time.Millisecond)); result.Allowed {
+		t.Errorf("got %+v, want denied by the spike arrest", result)
+	}
+	if !m.tats["key"].Equal(rateTat) {
+		t.Errorf("rate token taken by a denied request")
+	}
+}
+
+func TestMemoryStoreSweep(t *testing.T) {
+	m := NewMemoryStore()
+	b := Bucket{Interval: time.Second, Capacity: 1}
+	now := time.Unix(1700000000, 0)
+
+	m.Take(context.Background(), []string{"old"}, []Bucket{b}, now)
+	m.Take(context.Background(), []string{"new"}, []Bucket{b}, now.Add(2*sweepInterval))
+	if _, ok := m.tats["old"]; ok {
+		t.Errorf("full bucket not swept")
+	}
+	if _, ok := m.tats["new"]; !ok {
+		t.Errorf("bucket in use swept")
+	}
+}
+
+func TestIdentity(t *testing.T) {
+	c := Caller{IP: "10.0.0.1", APIKey: "hash", Subject: "alice", Headers: map[string]string{"x-tenant": "acme"}}
+	tests := []struct {
+		keyBy  KeyBy
+		header string
+		caller Caller
+		want   string
+	}{
+		{IP, "", c, "ip:10.0.0.1"},
+		{API_KEY, "", c, "apiKey:hash"},
+		{JWT_SUBJECT, "", c, "jwtSubject:alice"},
+		{HEADER, "x-tenant", c, "header:acme"},
+		{HEADER, "x-missing", c, "ip:10.0.0.1"},
+		{API_KEY, "", Caller{IP: "10.0.0.2"}, "ip:10.0.0.2"},
+	}
+	for _, test := range tests {
+		if got := test.caller.Identity(test.keyBy, test.header); got != test.want {
+			t.Errorf("%s %s: got %s, want %s", test.keyBy, test.header, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,283 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ratelimit
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//redisTimeout bounds a call to redis when the context has no deadline
+const redisTimeout = time.Second
+
+//redisPoolSize is the number of idle connections kept open
+const redisPoolSize = 8
+
+//takeScript runs gcra in redis so replicas update the buckets atomically. A
+//token is taken from every bucket, or from none if one is empty. ARGV holds
+//now, then the interval and capacity of each bucket. Times are in
+//microseconds since the epoch. The last value of the reply is the index of
+//the bucket the result is for
+const takeScript = `
+local now = tonumber(ARGV[1])
+local tats = {}
+local result
+for i, key in ipairs(KEYS) do
+  local interval = tonumber(ARGV[2 * i])
+  local capacity = tonumber(ARGV[2 * i + 1])
+  local tat = tonumber(redis.call('GET', key) or 0)
+  if tat < now then tat = now end
+  local newtat = tat + interval
+  local allowat = newtat - capacity * interval
+  if now < allowat then
+    return {0, 0, allowat - now, tat - now, i}
+  end
+  tats[i] = newtat
+  result = {1, math.floor((now - allowat) / interval), 0, newtat - now, i}
+end
+for i, key in ipairs(KEYS) do
+  redis.call('SET', key, string.format('%d', tats[i]), 'PX', string.format('%d', math.ceil((tats[i] - now) / 1000)))
+end
+return result
+`
+
+var takeScriptSHA = func() string {
+	sum := sha1.Sum([]byte(takeScript))
+	return hex.EncodeToString(sum[:])
+}()
+
+//RedisStore keeps the buckets in redis, or any server speaking the redis
+//protocol, so they are shared between replicas
+type RedisStore struct {
+	address  string
+	password string
+	db       int
+	pool     chan *redisConn
+}
+
+//NewRedisStore returns a store for the redis server at address, written as
+//host:port or redis://[:password@]host:port[/db]
+func NewRedisStore(address string) (*RedisStore, error) {
+	r := &RedisStore{address: address, pool: make(chan *redisConn, redisPoolSize)}
+
+	if strings.Contains(address, "://") {
+		u, err := url.Parse(address)
+		if err != nil {
+			return nil, err
+		}
+		if u.Scheme != "redis" {
+			return nil, fmt.Errorf("unsupported scheme %s", u.Scheme)
+		}
+		r.address = u.Host
+		if password, ok := u.User.Password(); ok {
+			r.password = password
+		}
+		if db := strings.TrimPrefix(u.Path, "/"); db != "" {
+			if r.db, err = strconv.Atoi(db); err != nil {
+				return nil, fmt.Errorf("invalid database %s", db)
+			}
+		}
+	}
+
+	if _, _, err := net.SplitHostPort(r.address); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *RedisStore) Take(ctx context.Context, keys []string, buckets []Bucket, now time.Time) (Result, error) {
+	args := append([]string{strconv.Itoa(len(keys))}, keys...)
+	args = append(args, strconv.FormatInt(now.UnixMicro(), 10))
+	for _, b := range buckets {
+		args = append(args, strconv.FormatInt(b.Interval.Microseconds(), 10), strconv.FormatUint(uint64(b.Capacity), 10))
+	}
+
+	reply, err := r.do(ctx, append([]string{"EVALSHA", takeScriptSHA}, args...)...)
+	if e, ok := err.(redisError); ok && strings.HasPrefix(string(e), "NOSCRIPT") {
+		reply, err = r.do(ctx, append([]string{"EVAL", takeScript}, args...)...)
+	}
+	if err != nil {
+		return Result{}, err
+	}
+
+	values, ok := reply.([]interface{})
+	if !ok || len(values) != 5 {
+		return Result{}, fmt.Errorf("unexpected reply %v", reply)
+	}
+	n := make([]int64, len(values))
+	for i, v := range values {
+		if n[i], ok = v.(int64); !ok {
+			return Result{}, fmt.Errorf("unexpected reply %v", reply)
+		}
+	}
+	if n[4] < 1 || n[4] > int64(len(buckets)) {
+		return Result{}, fmt.Errorf("unexpected reply %v", reply)
+	}
+
+	return Result{
+		Allowed:    n[0] == 1,
+		Limit:      buckets[n[4]-1].Capacity,
+		Remaining:  uint32(n[1]),
+		RetryAfter: time.Duration(n[2]) * time.Microsecond,
+		Reset:      time.Duration(n[3]) * time.Microsecond,
+	}, nil
+}
+
+//do sends a command on a pooled connection and reads the reply. Connections
+//are dropped after a network error
+func (r *RedisStore) do(ctx context.Context, args ...string) (interface{}, error) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(redisTimeout)
+	}
+
+	var c *redisConn
+	select {
+	case c = <-r.pool:
+	default:
+		var err error
+		if c, err = r.dial(deadline); err != nil {
+			return nil, err
+		}
+	}
+
+	reply, err := c.do(deadline, args...)
+	if _, ok := err.(redisError); err != nil && !ok {
+		c.Close()
+		return nil, err
+	}
+
+	select {
+	case r.pool <- c:
+	default:
+		c.Close()
+	}
+	return reply, err
+}
+
+func (r *RedisStore) dial(deadline time.Time) (*redisConn, error) {
+	conn, err := net.DialTimeout("tcp", r.address, time.Until(deadline))
+	if err != nil {
+		return nil, err
+	}
+	c := &redisConn{Conn: conn, reader: bufio.NewReader(conn)}
+
+	if r.password != "" {
+		if _, err = c.do(deadline, "AUTH", r.password); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	if r.db != 0 {
+		if _, err = c.do(deadline, "SELECT", strconv.Itoa(r.db)); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+//redisError is an error reply. The connection can still be used
+type redisError string
+
+func (e redisError) Error() string {
+	return string(e)
+}
+
+//redisConn is a connection speaking RESP, the redis serialization protocol
+type redisConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *redisConn) do(deadline time.Time, args ...string) (interface{}, error) {
+	if err := c.SetDeadline(deadline); err != nil {
+		return nil, err
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := io.WriteString(c, b.String()); err != nil {
+		return nil, err
+	}
+
+	return c.readReply()
+}
+
+func (c *redisConn) readReply() (interface{}, error) {
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || !strings.HasSuffix(line, "\r\n") {
+		return nil, fmt.Errorf("malformed reply %q", line)
+	}
+	kind, payload := line[0], line[1:len(line)-2]
+
+	switch kind {
+	case '+':
+		return payload, nil
+	case '-':
+		return nil, redisError(payload)
+	case ':':
+		return strconv.ParseInt(payload, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(payload)
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		data := make([]byte, n+2)
+		if _, err = io.ReadFull(c.reader, data); err != nil {
+			return nil, err
+		}
+		return string(data[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(payload)
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		values := make([]interface{}, n)
+		for i := range values {
+			//read every element, even after an error reply, to keep the connection in sync
+			if values[i], err = c.readReply(); err != nil {
+				if e, ok := err.(redisError); ok {
+					values[i] = e
+					continue
+				}
+				return nil, err
+			}
+		}
+		return values, nil
+	}
+	return nil, fmt.Errorf("malformed reply %q", line)
+}
@@ -0,0 +1,229 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ratelimit
+
+import (
+	"bufio"
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+//newTestRedis starts a stand-in redis server that runs the lua script
+func newTestRedis(t *testing.T) (*miniredis.Miniredis, *RedisStore) {
+	t.Helper()
+	server := miniredis.RunT(t)
+	store, err := NewRedisStore(server.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return server, store
+}
+
+func TestRedisStoreTake(t *testing.T) {
+	_, store := newTestRedis(t)
+	ctx := context.Background()
+	b := Bucket{Interval: 100 * time.Millisecond, Capacity: 2}
+	now := time.Unix(1700000000, 0)
+
+	tests := []struct {
+		at         time.Duration
+		allowed    bool
+		remaining  uint32
+		retryAfter time.Duration
+	}{
+		{0, true, 1, 0},
+		{0, true, 0, 0},
+		{0, false, 0, 100 * time.Millisecond},
+		{50 * time.Millisecond, false, 0, 50 * time.Millisecond},
+		{100 * time.Millisecond, true, 0, 0},
+		{time.Second, true, 1, 0},
+	}
+	for i, test := range tests {
+		result, err := store.Take(ctx, []string{"key"}, []Bucket{b}, now.Add(test.at))
+		if err != nil {
+			t.Fatalf("take %d: %v", i, err)
+		}
+		if result.Allowed != test.allowed || result.Remaining != test.remaining || result.RetryAfter != test.retryAfter {
+			t.Errorf("take %d at %v: got %+v, want allowed %v, remaining %d, retry after %v",
+				i, test.at, result, test.allowed, test.remaining, test.retryAfter)
+		}
+		if result.Limit != b.Capacity {
+			t.Errorf("take %d: limit %d, want %d", i, result.Limit, b.Capacity)
+		}
+	}
+}
+
+func TestRedisStoreTakesAllOrNothing(t *testing.T) {
+	server, store := newTestRedis(t)
+	ctx := context.Background()
+	spike := Bucket{Interval: 100 * time.Millisecond, Capacity: 1}
+	rate := Bucket{Interval: time.Second, Capacity: 1}
+	keys := []string{"key:spike", "key"}
+	now := time.Unix(1700000000, 0)
+
+	if result, err := store.Take(ctx, keys, []Bucket{spike, rate}, now); err != nil || !result.Allowed {
+		t.Fatalf("first take: %+v, %v", result, err)
+	}
+	spikeTat, _ := server.Get("key:spike")
+
+	//the spike arrest allows it, the rate does not
+	result, err := store.Take(ctx, keys, []Bucket{spike, rate}, now.Add(200*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Allowed || result.Limit != rate.Capacity || result.RetryAfter != 800*time.Millisecond {
+		t.Errorf("got %+v, want denied by the rate bucket", result)
+	}
+	if tat, _ := server.Get("key:spike"); tat != spikeTat {
+		t.Errorf("spike arrest token taken by a denied request, tat %s, want %s", tat, spikeTat)
+	}
+}
+
+func TestRedisStoreExpiry(t *testing.T) {
+	server, store := newTestRedis(t)
+	b := Bucket{Interval: time.Second, Capacity: 5}
+	now := time.Unix(1700000000, 0)
+
+	if _, err := store.Take(context.Background(), []string{"key"}, []Bucket{b}, now); err != nil {
+		t.Fatal(err)
+	}
+	//the key lives until the bucket is full again
+	if ttl := server.TTL("key"); ttl != time.Second {
+		t.Errorf("ttl %v, want 1s", ttl)
+	}
+}
+
+func TestRedisStoreAuthAndDatabase(t *testing.T) {
+	server := miniredis.RunT(t)
+	server.RequireAuth("secret")
+	b := Bucket{Interval: time.Second, Capacity: 1}
+
+	store, err := NewRedisStore("redis://:secret@" + server.Addr() + "/2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = store.Take(context.Background(), []string{"key"}, []Bucket{b}, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if !server.DB(2).Exists("key") {
+		t.Errorf("key not written to database 2")
+	}
+
+	store, err = NewRedisStore("redis://:wrong@" + server.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = store.Take(context.Background(), []string{"key"}, []Bucket{b}, time.Now()); err == nil {
+		t.Errorf("take with a wrong password succeeded")
+	}
+}
+
+func TestRedisStoreReconnects(t *testing.T) {
+	server, store := newTestRedis(t)
+	ctx := context.Background()
+	b := Bucket{Interval: time.Millisecond, Capacity: 1000}
+
+	if _, err := store.Take(ctx, []string{"key"}, []Bucket{b}, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	server.Close()
+	if _, err := store.Take(ctx, []string{"key"}, []Bucket{b}, time.Now()); err == nil {
+		t.Fatal("take succeeded while the server is down")
+	}
+	if err := server.Restart(); err != nil {
+		t.Fatal(err)
+	}
+	//the broken pooled connection was dropped
+	if _, err := store.Take(ctx, []string{"key"}, []Bucket{b}, time.Now()); err != nil {
+		t.Errorf("take after restart: %v", err)
+	}
+}
+
+func TestNewRedisStore(t *testing.T) {
+	tests := []struct {
+		address  string
+		host     string
+		password string
+		db       int
+		err      bool
+	}{
+		{"localhost:6379", "localhost:6379", "", 0, false},
+		{"redis://redis:6380", "redis:6380", "", 0, false},
+		{"redis://:secret@redis:6379/3", "redis:6379", "secret", 3, false},
+		{"rediss://redis:6379", "", "", 0, true},
+		{"redis://redis:6379/db", "", "", 0, true},
+		{"localhost", "", "", 0, true},
+	}
+	for _, test := range tests {
+		store, err := NewRedisStore(test.address)
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: no error", test.address)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.address, err)
+			continue
+		}
+		if store.address != test.host || store.password != test.password || store.db != test.db {
+			t.Errorf("%s: got %s %q %d", test.address, store.address, store.password, store.db)
+		}
+	}
+}
+
+func TestReadReply(t *testing.T) {
+	tests := []struct {
+		name  string
+		reply string
+		want  interface{}
+		err   string
+	}{
+		{"simple string", "+OK\r\n", "OK", ""},
+		{"error", "-NOSCRIPT No matching script\r\n", nil, "NOSCRIPT No matching script"},
+		{"integer", ":-42\r\n", int64(-42), ""},
+		{"bulk string", "$5\r\nhe\r\no\r\n", "he\r\no", ""},
+		{"null bulk string", "$-1\r\n", nil, ""},
+		{"array", "*3\r\n:1\r\n$1\r\na\r\n*1\r\n:2\r\n", []interface{}{int64(1), "a", []interface{}{int64(2)}}, ""},
+		{"error in array", "*2\r\n-ERR bad\r\n:1\r\n", []interface{}{redisError("ERR bad"), int64(1)}, ""},
+		{"null array", "*-1\r\n", nil, ""},
+		{"unknown type", "?x\r\n", nil, "malformed reply"},
+		{"missing carriage return", "+OK\n", nil, "malformed reply"},
+		{"truncated bulk string", "$5\r\nab", nil, "EOF"},
+		{"truncated array", "*2\r\n:1\r\n", nil, "EOF"},
+	}
+	for _, test := range tests {
+		c := &redisConn{reader: bufio.NewReader(strings.NewReader(test.reply))}
+		got, err := c.readReply()
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: error %v, want %s", test.name, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %#v, want %#v", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//Store holds the buckets. Replicas of the router that use the same shared
+//store enforce the limits together
+type Store interface {
+	//Take removes a token from each bucket at keys, or from none if one of
+	//them is empty. The result is the one of the first empty bucket, or else
+	//of the last bucket
+	Take(ctx context.Context, keys []string, buckets []Bucket, now time.Time) (Result, error)
+}
+
+//sweepInterval is how often full buckets are dropped from the memory store
+const sweepInterval = time.Minute
+
+//MemoryStore keeps the buckets of this replica in memory
+type MemoryStore struct {
+	tats      map[string]time.Time
+	lastSweep time.Time
+	sync.Mutex
+}
+
+//NewMemoryStore returns an empty memory store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{tats: map[string]time.Time{}}
+}
+
+func (m *MemoryStore) Take(_ context.Context, keys []string, buckets []Bucket, now time.Time) (Result, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	if now.Sub(m.lastSweep) > sweepInterval {
+		m.sweep(now)
+	}
+
+	var result Result
+	tats := make([]time.Time, len(keys))
+	for i, key := range keys {
+		result, tats[i] = gcra(buckets[i], m.tats[key], now)
+		if !result.Allowed {
+			return result, nil
+		}
+	}
+	for i, key := range keys {
+		m.tats[key] = tats[i]
+	}
+	return result, nil
+}
+
+//sweep drops the buckets that are full, they are the same as missing ones
+func (m *MemoryStore) sweep(now time.Time) {
+	for key, tat := range m.tats {
+		if !tat.After(now) {
+			delete(m.tats, key)
+		}
+	}
+	m.lastSweep = now
+}
+
+type storeHolder struct {
+	Store
+}
+
+var store atomic.Value
+
+func init() {
+	store.Store(storeHolder{NewMemoryStore()})
+}
+
+//SetStore replaces the store used by every limit, the default is a MemoryStore
+func SetStore(s Store) {
+	store.Store(storeHolder{s})
+}
+
+func getStore() Store {
+	return store.Load().(storeHolder).Store
+}
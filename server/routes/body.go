@@ -0,0 +1,253 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routes
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+
+	auth "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+)
+
+//what a body matcher does when envoy sent only part of the body
+const (
+	TRUNCATED_NO_MATCH = "noMatch"
+	TRUNCATED_MATCH    = "match"
+	TRUNCATED_EVALUATE = "evaluate"
+)
+
+//partialBodyHeader is set by envoy when the body sent to ext_authz was cut at max_request_bytes
+const partialBodyHeader = "x-envoy-auth-partial-body"
+
+//bodyMatcher matches a value read from the request body. Exactly one of
+//jsonPath, form or xpath should be set. The value is compared with exact,
+//prefix, regex or present, like a header. A jsonPath may also carry its own
+//comparison, ex: $.customer.tier == "gold"
+type bodyMatcher struct {
+	JSONPath    string `json:"jsonPath,omitempty"`
+	Form        string `json:"form,omitempty"`
+	XPath       string `json:"xpath,omitempty"`
+	OnTruncated string `json:"onTruncated,omitempty"`
+	matcher
+	path       []pathStep
+	comparison *comparison
+	xpath      []xpathStep
+}
+
+func (m *bodyMatcher) compile() (err error) {
+	set := 0
+	for _, expression := range []string{m.JSONPath, m.Form, m.XPath} {
+		if expression != "" {
+			set++
+		}
+	}
+	if set != 1 {
+		return fmt.Errorf("exactly one of jsonPath, form or xpath is required")
+	}
+
+	switch m.OnTruncated {
+	case "":
+		m.OnTruncated = TRUNCATED_NO_MATCH
+	case TRUNCATED_NO_MATCH, TRUNCATED_MATCH, TRUNCATED_EVALUATE:
+	default:
+		return fmt.Errorf("unknown onTruncated %s", m.OnTruncated)
+	}
+
+	switch {
+	case m.JSONPath != "":
+		m.Name = m.JSONPath
+		if m.path, m.comparison, err = parseJSONPath(m.JSONPath); err != nil {
+			return fmt.Errorf("invalid jsonPath %s: %v", m.JSONPath, err)
+		}
+		if m.comparison != nil && (m.Exact != "" || m.Prefix != "" || m.Regex != "" || m.Present) {
+			return fmt.Errorf("jsonPath %s has a comparison, exact, prefix, regex and present cannot be used", m.JSONPath)
+		}
+	case m.XPath != "":
+		m.Name = m.XPath
+		if m.xpath, err = parseXPath(m.XPath); err != nil {
+			return fmt.Errorf("invalid xpath %s: %v", m.XPath, err)
+		}
+	default:
+		m.Name = m.Form
+	}
+
+	return m.matcher.compile()
+}
+
+//requestBody parses the body of a request once, on first use, for all the
+//body matchers evaluated for the request
+type requestBody struct {
+	raw       []byte
+	truncated bool
+	json      interface{}
+	jsonErr   error
+	jsonDone  bool
+	form      url.Values
+	formDone  bool
+	xml       *xmlNode
+	xmlErr    error
+	xmlDone   bool
+}
+
+func newRequestBody(req *auth.AttributeContext_HttpRequest) *requestBody {
+	b := &requestBody{raw: req.RawBody}
+	if len(b.raw) == 0 {
+		b.raw = []byte(req.Body)
+	}
+	b.truncated = req.Headers[partialBodyHeader] == "true" ||
+		(req.Size > 0 && int64(len(b.raw)) < req.Size)
+	return b
+}
+
+func (b *requestBody) getJSON() (interface{}, error) {
+	if !b.jsonDone {
+		decoder := json.NewDecoder(bytes.NewReader(b.raw))
+		decoder.UseNumber()
+		b.jsonErr = decoder.Decode(&b.json)
+		b.jsonDone = true
+	}
+	return b.json, b.jsonErr
+}
+
+func (b *requestBody) getForm() url.Values {
+	if !b.formDone {
+		b.form, _ = url.ParseQuery(string(b.raw))
+		if b.truncated {
+			//the last field may be cut, only trust fields followed by a separator
+			if i := bytes.LastIndexByte(b.raw, '&'); i != -1 {
+				b.form, _ = url.ParseQuery(string(b.raw[:i]))
+			} else {
+				b.form = url.Values{}
+			}
+		}
+		b.formDone = true
+	}
+	return b.form
+}
+
+func (b *requestBody) getXML() (*xmlNode, error) {
+	if !b.xmlDone {
+		b.xml, b.xmlErr = parseXML(b.raw)
+		b.xmlDone = true
+	}
+	return b.xml, b.xmlErr
+}
+
+//match evaluates the matcher. A truncated body is handled as set by onTruncated.
+//When evaluated, a truncated json or xml body does not parse and so only
+//matches inverted matchers, form fields before the cut are used
+func (m *bodyMatcher) match(body *requestBody) bool {
+	if body.truncated {
+		switch m.OnTruncated {
+		case TRUNCATED_MATCH:
+			return true
+		case TRUNCATED_NO_MATCH:
+			return false
+		}
+	}
+
+	var values []string
+	switch {
+	case m.JSONPath != "":
+		doc, err := body.getJSON()
+		if err != nil {
+			return m.matcher.match("", false)
+		}
+		found := evalJSONPath(doc, m.path)
+		if m.comparison != nil {
+			ok := false
+			for _, v := range found {
+				if m.comparison.eval(v) {
+					ok = true
+					break
+				}
+			}
+			if m.Invert {
+				return !ok
+			}
+			return ok
+		}
+		for _, v := range found {
+			values = append(values, jsonString(v))
+		}
+	case m.XPath != "":
+		root, err := body.getXML()
+		if err != nil {
+			return m.matcher.match("", false)
+		}
+		values = evalXPath(root, m.xpath)
+	default:
+		values = body.getForm()[m.Form]
+	}
+
+	if len(values) == 0 {
+		return m.matcher.match("", false)
+	}
+
+	//with several values, ex: $.items[*].sku, one of them must match. An
+	//inverted matcher must not match any
+	plain := m.matcher
+	plain.Invert = false
+	for _, value := range values {
+		if plain.match(value, true) {
+			return !m.Invert
+		}
+	}
+	return m.Invert
+}
+
+//jsonString returns the value as it is compared: strings as is, numbers,
+//booleans and null as written in json, objects and arrays as compact json
+func jsonString(v interface{}) string {
+	switch value := v.(type) {
+	case string:
+		return value
+	case json.Number:
+		return value.String()
+	case bool:
+		return strconv.FormatBool(value)
+	case nil:
+		return "null"
+	}
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+func (r *routerule) hasBodyMatchers() bool {
+	return len(r.Body) > 0
+}
+
+//compileBody prepares the body matchers of a rule
+func (r *routerule) compileBody() error {
+	for i := range r.Body {
+		if err := r.Body[i].compile(); err != nil {
+			return fmt.Errorf("route %s body: %v", r.Name, err)
+		}
+	}
+	return nil
+}
+
+//matchBody checks the body matchers of a rule
+func (r *routerule) matchBody(body *requestBody) bool {
+	for i := range r.Body {
+		if !r.Body[i].match(body) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,284 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routes
+
+import (
+	"testing"
+
+	auth "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+)
+
+type bodyTest struct {
+	name    string
+	matcher bodyMatcher
+	body    string
+	want    bool
+}
+
+func runBodyTests(t *testing.T, tests []bodyTest) {
+	t.Helper()
+	for _, test := range tests {
+		m := test.matcher
+		if err := m.compile(); err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		body := newRequestBody(&auth.AttributeContext_HttpRequest{Body: test.body})
+		if got := m.match(body); got != test.want {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+const order = `{
+	"customer": {"id": "c-1", "tier": "gold", "vip": true, "manager": null, "score": 12.5},
+	"items": [
+		{"sku": "a-1", "quantity": 2},
+		{"sku": "b-2", "quantity": 10}
+	],
+	"total": 12345678901234567890,
+	"tags": []
+}`
+
+func TestJSONPathMatcher(t *testing.T) {
+	runBodyTests(t, []bodyTest{
+		//comparisons
+		{"string equal", bodyMatcher{JSONPath: `$.customer.tier == "gold"`}, order, true},
+		{"single quoted string", bodyMatcher{JSONPath: `$.customer.tier == 'gold'`}, order, true},
+		{"string not equal", bodyMatcher{JSONPath: `$.customer.tier != "gold"`}, order, false},
+		{"string order", bodyMatcher{JSONPath: `$.customer.tier > "a"`}, order, true},
+		{"number greater", bodyMatcher{JSONPath: `$.customer.score > 12`}, order, true},
+		{"number less or equal", bodyMatcher{JSONPath: `$.customer.score <= 12.5`}, order, true},
+		{"number less", bodyMatcher{JSONPath: `$.customer.score < 12.5`}, order, false},
+		{"number equal written differently", bodyMatcher{JSONPath: `$.customer.score == 1.25e1`}, order, true},
+		{"large number", bodyMatcher{JSONPath: `$.total > 1000`}, order, true},
+		{"boolean", bodyMatcher{JSONPath: `$.customer.vip == true`}, order, true},
+		{"null", bodyMatcher{JSONPath: `$.customer.manager == null`}, order, true},
+		{"boolean has no order", bodyMatcher{JSONPath: `$.customer.vip > false`}, order, false},
+		{"number and string differ", bodyMatcher{JSONPath: `$.customer.score == "12.5"`}, order, false},
+		{"different types are not equal", bodyMatcher{JSONPath: `$.customer.score != "12.5"`}, order, true},
+		{"inverted comparison", bodyMatcher{JSONPath: `$.customer.tier == "gold"`, matcher: matcher{Invert: true}}, order, false},
+		//exact, prefix, regex and present
+		{"exact", bodyMatcher{JSONPath: "$.customer.id", matcher: matcher{Exact: "c-1"}}, order, true},
+		{"exact number", bodyMatcher{JSONPath: "$.total", matcher: matcher{Exact: "12345678901234567890"}}, order, true},
+		{"exact boolean", bodyMatcher{JSONPath: "$.customer.vip", matcher: matcher{Exact: "true"}}, order, true},
+		{"prefix", bodyMatcher{JSONPath: "customer.id", matcher: matcher{Prefix: "c-"}}, order, true},
+		{"regex", bodyMatcher{JSONPath: "$['customer']['tier']", matcher: matcher{Regex: "^(gold|silver)$"}}, order, true},
+		{"present", bodyMatcher{JSONPath: "$.customer"}, order, true},
+		{"object as json", bodyMatcher{JSONPath: "$.items[0]", matcher: matcher{Exact: `{"quantity":2,"sku":"a-1"}`}}, order, true},
+		//missing fields
+		{"missing", bodyMatcher{JSONPath: "$.customer.region"}, order, false},
+		{"missing inverted", bodyMatcher{JSONPath: "$.customer.region", matcher: matcher{Invert: true}}, order, true},
+		{"missing comparison", bodyMatcher{JSONPath: `$.customer.region == "eu"`}, order, false},
+		{"missing not equal", bodyMatcher{JSONPath: `$.customer.region != "eu"`}, order, false},
+		{"missing exact", bodyMatcher{JSONPath: "$.shipping.city", matcher: matcher{Exact: "Paris"}}, order, false},
+		{"member of a string", bodyMatcher{JSONPath: "$.customer.tier.name"}, order, false},
+		//arrays
+		{"index", bodyMatcher{JSONPath: "$.items[1].sku", matcher: matcher{Exact: "b-2"}}, order, true},
+		{"gjson index", bodyMatcher{JSONPath: "items.1.sku", matcher: matcher{Exact: "b-2"}}, order, true},
+		{"negative index", bodyMatcher{JSONPath: "$.items[-1].sku", matcher: matcher{Exact: "b-2"}}, order, true},
+		{"index out of range", bodyMatcher{JSONPath: "$.items[2].sku"}, order, false},
+		{"wildcard one matches", bodyMatcher{JSONPath: "$.items[*].sku", matcher: matcher{Exact: "b-2"}}, order, true},
+		{"gjson wildcard", bodyMatcher{JSONPath: "items.#.sku", matcher: matcher{Prefix: "a-"}}, order, true},
+		{"wildcard comparison", bodyMatcher{JSONPath: "$.items[*].quantity >= 10"}, order, true},
+		{"wildcard none matches", bodyMatcher{JSONPath: "$.items[*].quantity > 10"}, order, false},
+		{"wildcard inverted matches none", bodyMatcher{JSONPath: "$.items[*].sku", matcher: matcher{Exact: "c-3", Invert: true}}, order, true},
+		{"wildcard inverted matches one", bodyMatcher{JSONPath: "$.items[*].sku", matcher: matcher{Exact: "a-1", Invert: true}}, order, false},
+		{"empty array", bodyMatcher{JSONPath: "$.tags[*]"}, order, false},
+		{"root array", bodyMatcher{JSONPath: "$[0].id == 1"}, `[{"id": 1}]`, true},
+		//bodies that are not JSON
+		{"not JSON", bodyMatcher{JSONPath: "$.customer"}, "customer=1", false},
+		{"not JSON inverted", bodyMatcher{JSONPath: "$.customer", matcher: matcher{Invert: true}}, "customer=1", true},
+		{"empty body", bodyMatcher{JSONPath: `$.customer.tier == "gold"`}, "", false},
+	})
+}
+
+func TestParseJSONPath(t *testing.T) {
+	valid := []string{
+		"$.customer.tier",
+		"customer.tier",
+		"$['customer'][\"tier\"]",
+		"$.items[*].sku",
+		"$.items[0]",
+		`$.name == "a == b"`,
+		`$['a>b'] > 1`,
+	}
+	for _, expression := range valid {
+		if _, _, err := parseJSONPath(expression); err != nil {
+			t.Errorf("%s: %v", expression, err)
+		}
+	}
+
+	invalid := []string{
+		"$..customer",
+		"$.items[0",
+		"$.items[first]",
+		"$.customer ==",
+		`$.customer == {"tier": "gold"}`,
+		"$.items == [1]",
+		"$.tier == gold",
+	}
+	for _, expression := range invalid {
+		if _, _, err := parseJSONPath(expression); err == nil {
+			t.Errorf("%s: got no error", expression)
+		}
+	}
+}
+
+const invoice = `<?xml version="1.0"?>
+<inv:invoice xmlns:inv="urn:invoice" id="42">
+	<customer tier="gold">Ada</customer>
+	<items>
+		<item><sku>a-1</sku><quantity>2</quantity></item>
+		<item><sku>b-2</sku><quantity>10</quantity></item>
+	</items>
+	<note>  paid  </note>
+</inv:invoice>`
+
+func TestXPathMatcher(t *testing.T) {
+	runBodyTests(t, []bodyTest{
+		{"attribute", bodyMatcher{XPath: "/invoice/customer/@tier", matcher: matcher{Exact: "gold"}}, invoice, true},
+		{"namespaced root", bodyMatcher{XPath: "/inv:invoice/@id", matcher: matcher{Exact: "42"}}, invoice, true},
+		{"element text", bodyMatcher{XPath: "/invoice/customer", matcher: matcher{Exact: "Ada"}}, invoice, true},
+		{"text is trimmed", bodyMatcher{XPath: "/invoice/note/text()", matcher: matcher{Exact: "paid"}}, invoice, true},
+		{"content of children", bodyMatcher{XPath: "/invoice/items/item[1]", matcher: matcher{Exact: "a-12"}}, invoice, true},
+		{"position", bodyMatcher{XPath: "/invoice/items/item[2]/sku", matcher: matcher{Exact: "b-2"}}, invoice, true},
+		{"position out of range", bodyMatcher{XPath: "/invoice/items/item[3]/sku"}, invoice, false},
+		{"descendants one matches", bodyMatcher{XPath: "//sku", matcher: matcher{Exact: "b-2"}}, invoice, true},
+		{"descendants regex", bodyMatcher{XPath: "//item/quantity", matcher: matcher{Regex: "^[0-9]{2}$"}}, invoice, true},
+		{"wildcard", bodyMatcher{XPath: "/invoice/*/@tier", matcher: matcher{Exact: "gold"}}, invoice, true},
+		{"inverted matches none", bodyMatcher{XPath: "//sku", matcher: matcher{Exact: "c-3", Invert: true}}, invoice, true},
+		{"missing element", bodyMatcher{XPath: "/invoice/shipping"}, invoice, false},
+		{"missing attribute", bodyMatcher{XPath: "/invoice/customer/@region"}, invoice, false},
+		{"missing inverted", bodyMatcher{XPath: "/invoice/shipping", matcher: matcher{Invert: true}}, invoice, true},
+		{"wrong root", bodyMatcher{XPath: "/order/customer"}, invoice, false},
+		{"not XML", bodyMatcher{XPath: "/invoice"}, `{"invoice": 1}`, false},
+		{"not XML inverted", bodyMatcher{XPath: "/invoice", matcher: matcher{Invert: true}}, `{"invoice": 1}`, true},
+	})
+}
+
+func TestParseXPath(t *testing.T) {
+	invalid := []string{
+		"invoice/customer",
+		"/invoice//",
+		"/invoice/item[0]",
+		"/invoice/item[last()]",
+		"/invoice/item[1",
+		"/invoice/@id/customer",
+		"/invoice/text()/customer",
+		"/invoice/@id[1]",
+	}
+	for _, expression := range invalid {
+		if _, err := parseXPath(expression); err == nil {
+			t.Errorf("%s: got no error", expression)
+		}
+	}
+}
+
+func TestFormMatcher(t *testing.T) {
+	const form = "grant_type=client_credentials&scope=read+write&scope=admin&empty="
+	runBodyTests(t, []bodyTest{
+		{"exact", bodyMatcher{Form: "grant_type", matcher: matcher{Exact: "client_credentials"}}, form, true},
+		{"decoded", bodyMatcher{Form: "scope", matcher: matcher{Exact: "read write"}}, form, true},
+		{"repeated field one matches", bodyMatcher{Form: "scope", matcher: matcher{Exact: "admin"}}, form, true},
+		{"empty value is present", bodyMatcher{Form: "empty"}, form, true},
+		{"missing", bodyMatcher{Form: "client_id"}, form, false},
+		{"missing inverted", bodyMatcher{Form: "client_id", matcher: matcher{Invert: true}}, form, true},
+	})
+}
+
+func TestBodyMatcherCompile(t *testing.T) {
+	invalid := []bodyMatcher{
+		{},
+		{JSONPath: "$.a", Form: "a"},
+		{JSONPath: "$.a", OnTruncated: "maybe"},
+		{JSONPath: "$.a == 1", matcher: matcher{Exact: "1"}},
+		{Form: "a", matcher: matcher{Regex: "("}},
+		{XPath: "a"},
+	}
+	for _, m := range invalid {
+		if err := m.compile(); err == nil {
+			t.Errorf("%+v: got no error", m)
+		}
+	}
+}
+
+//TestTruncatedBody covers bodies cut by envoy at max_request_bytes, flagged by
+//the partial body header or by a size larger than the body
+func TestTruncatedBody(t *testing.T) {
+	const cutJSON = `{"customer": {"tier": "gold"}, "items": [{"sku": "a-`
+	const cutForm = "grant_type=client_credentials&scope=rea"
+
+	tests := []struct {
+		name    string
+		matcher bodyMatcher
+		body    string
+		size    int64
+		partial bool
+		want    bool
+	}{
+		{"default is no match", bodyMatcher{JSONPath: `$.customer.tier == "gold"`}, cutJSON, 0, true, false},
+		{"match", bodyMatcher{JSONPath: "$.customer.tier", OnTruncated: TRUNCATED_MATCH, matcher: matcher{Exact: "silver"}}, cutJSON, 0, true, true},
+		{"no match inverted", bodyMatcher{JSONPath: "$.customer.tier", OnTruncated: TRUNCATED_NO_MATCH, matcher: matcher{Invert: true}}, cutJSON, 0, true, false},
+		{"evaluate JSON does not parse", bodyMatcher{JSONPath: `$.customer.tier == "gold"`, OnTruncated: TRUNCATED_EVALUATE}, cutJSON, 0, true, false},
+		{"evaluate JSON inverted", bodyMatcher{JSONPath: "$.customer.tier", OnTruncated: TRUNCATED_EVALUATE, matcher: matcher{Invert: true}}, cutJSON, 0, true, true},
+		{"size larger than the body", bodyMatcher{JSONPath: "$.customer.tier", OnTruncated: TRUNCATED_MATCH, matcher: matcher{Exact: "silver"}}, cutJSON, 4096, false, true},
+		{"size of the body", bodyMatcher{JSONPath: `$.customer.tier == "gold"`}, `{"customer": {"tier": "gold"}}`, 30, false, true},
+		{"evaluate XML does not parse", bodyMatcher{XPath: "/invoice/@id", OnTruncated: TRUNCATED_EVALUATE}, invoice[:60], 0, true, false},
+		{"evaluate form before the cut", bodyMatcher{Form: "grant_type", OnTruncated: TRUNCATED_EVALUATE, matcher: matcher{Exact: "client_credentials"}}, cutForm, 0, true, true},
+		{"evaluate form cut field", bodyMatcher{Form: "scope", OnTruncated: TRUNCATED_EVALUATE}, cutForm, 0, true, false},
+		{"evaluate form single cut field", bodyMatcher{Form: "grant_type", OnTruncated: TRUNCATED_EVALUATE}, "grant_type=client", 0, true, false},
+	}
+
+	for _, test := range tests {
+		m := test.matcher
+		if err := m.compile(); err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		req := &auth.AttributeContext_HttpRequest{Body: test.body, Size: test.size, Headers: map[string]string{}}
+		if test.partial {
+			req.Headers[partialBodyHeader] = "true"
+		}
+		if got := m.match(newRequestBody(req)); got != test.want {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+//TestMatchBody checks that every matcher of a rule must match and that the
+//body is parsed once for all of them
+func TestMatchBody(t *testing.T) {
+	r := routerule{Name: "orders", Body: []bodyMatcher{
+		{JSONPath: `$.customer.tier == "gold"`},
+		{JSONPath: "$.items[*].sku", matcher: matcher{Prefix: "b-"}},
+	}}
+	if err := r.compileBody(); err != nil {
+		t.Fatal(err)
+	}
+
+	body := newRequestBody(&auth.AttributeContext_HttpRequest{Body: order})
+	if !r.matchBody(body) {
+		t.Error("got no match, want match")
+	}
+	if !body.jsonDone || body.jsonErr != nil {
+		t.Errorf("body not parsed: %v", body.jsonErr)
+	}
+
+	r.Body[1].Prefix = "c-"
+	if r.matchBody(newRequestBody(&auth.AttributeContext_HttpRequest{Body: order})) {
+		t.Error("got match, want no match")
+	}
+}
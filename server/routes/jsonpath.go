@@ -0,0 +1,257 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routes
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//pathStep is a step of a json path: a member name, an array index, or a
+//wildcard that selects every member or element
+type pathStep struct {
+	name     string
+	wildcard bool
+}
+
+//comparison compares the values selected by a json path with a literal
+type comparison struct {
+	op      string
+	literal interface{}
+}
+
+//operators are listed so that the two character ones are found first
+var operators = []string{"==", "!=", ">=", "<=", ">", "<"}
+
+//parseJSONPath reads a subset of JSONPath and GJSON paths, optionally followed
+//by a comparison:
+//  $.customer.tier == "gold"
+//  $.items[0].sku, $['items'][*].sku
+//  customer.tier, items.0.sku, items.#.sku
+func parseJSONPath(expression string) ([]pathStep, *comparison, error) {
+	path, cmp, err := splitComparison(expression)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	path = strings.TrimSpace(path)
+	path = strings.TrimPrefix(path, "$")
+
+	var steps []pathStep
+	for i := 0; i < len(path); {
+		switch path[i] {
+		case '.':
+			i++
+			end := i
+			for end < len(path) && path[end] != '.' && path[end] != '[' {
+				end++
+			}
+			name := path[i:end]
+			if name == "" {
+				return nil, nil, fmt.Errorf("empty member name at %d", i)
+			}
+			steps = append(steps, pathStep{name: name, wildcard: name == "*" || name == "#"})
+			i = end
+		case '[':
+			end := strings.IndexByte(path[i:], ']')
+			if end == -1 {
+				return nil, nil, fmt.Errorf("missing ] after %d", i)
+			}
+			inner := strings.TrimSpace(path[i+1 : i+end])
+			i += end + 1
+			switch {
+			case inner == "*":
+				steps = append(steps, pathStep{wildcard: true})
+			case len(inner) >= 2 && (inner[0] == '\'' || inner[0] == '"') && inner[len(inner)-1] == inner[0]:
+				steps = append(steps, pathStep{name: inner[1 : len(inner)-1]})
+			default:
+				if _, err := strconv.Atoi(inner); err != nil {
+					return nil, nil, fmt.Errorf("invalid index [%s]", inner)
+				}
+				steps = append(steps, pathStep{name: inner})
+			}
+		default:
+			if i != 0 {
+				return nil, nil, fmt.Errorf("unexpected %q at %d", path[i], i)
+			}
+			//gjson paths have no leading $ or dot
+			path = "." + path
+		}
+	}
+
+	return steps, cmp, nil
+}
+
+//splitComparison separates the path from a trailing comparison. Operators
+//inside brackets or quotes are part of the path
+func splitComparison(expression string) (string, *comparison, error) {
+	depth, quote := 0, byte(0)
+	for i := 0; i < len(expression); i++ {
+		c := expression[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+			continue
+		case c == '\'' || c == '"':
+			quote = c
+			continue
+		case c == '[':
+			depth++
+			continue
+		case c == ']':
+			depth--
+			continue
+		}
+		if depth > 0 {
+			continue
+		}
+		for _, op := range operators {
+			if strings.HasPrefix(expression[i:], op) {
+				literal, err := parseLiteral(strings.TrimSpace(expression[i+len(op):]))
+				if err != nil {
+					return "", nil, err
+				}
+				return expression[:i], &comparison{op: op, literal: literal}, nil
+			}
+		}
+	}
+	return expression, nil, nil
+}
+
+//parseLiteral reads a json literal. Strings may also be single quoted
+func parseLiteral(s string) (interface{}, error) {
+	if len(s) >= 2 && s[0] == '\'' && s[len(s)-1] == '\'' {
+		return s[1 : len(s)-1], nil
+	}
+	var literal interface{}
+	decoder := json.NewDecoder(strings.NewReader(s))
+	decoder.UseNumber()
+	if err := decoder.Decode(&literal); err != nil {
+		return nil, fmt.Errorf("invalid literal %s", s)
+	}
+	switch literal.(type) {
+	case map[string]interface{}, []interface{}:
+		return nil, fmt.Errorf("only strings, numbers, booleans and null can be compared")
+	}
+	return literal, nil
+}
+
+//evalJSONPath returns the values selected by the path
+func evalJSONPath(doc interface{}, steps []pathStep) []interface{} {
+	current := []interface{}{doc}
+	for _, step := range steps {
+		var next []interface{}
+		for _, v := range current {
+			switch node := v.(type) {
+			case map[string]interface{}:
+				if step.wildcard {
+					keys := make([]string, 0, len(node))
+					for key := range node {
+						keys = append(keys, key)
+					}
+					sort.Strings(keys)
+					for _, key := range keys {
+						next = append(next, node[key])
+					}
+				} else if child, found := node[step.name]; found {
+					next = append(next, child)
+				}
+			case []interface{}:
+				if step.wildcard {
+					next = append(next, node...)
+				} else if i, err := strconv.Atoi(step.name); err == nil {
+					if i < 0 {
+						i += len(node)
+					}
+					if i >= 0 && i < len(node) {
+						next = append(next, node[i])
+					}
+				}
+			}
+		}
+		current = next
+	}
+	return current
+}
+
+//eval compares a value with the literal. Numbers are compared as numbers and
+//strings as strings, values of different types are never equal
+func (c *comparison) eval(v interface{}) bool {
+	var order int
+	comparable := true
+
+	switch literal := c.literal.(type) {
+	case json.Number:
+		value, ok := v.(json.Number)
+		if !ok {
+			comparable = false
+			break
+		}
+		a, errA := value.Float64()
+		b, errB := literal.Float64()
+		if errA != nil || errB != nil {
+			comparable = false
+			break
+		}
+		switch {
+		case a < b:
+			order = -1
+		case a > b:
+			order = 1
+		}
+	case string:
+		value, ok := v.(string)
+		if !ok {
+			comparable = false
+			break
+		}
+		order = strings.Compare(value, literal)
+	default:
+		//booleans and null can only be checked for equality
+		equal := v == c.literal
+		switch c.op {
+		case "==":
+			return equal
+		case "!=":
+			return !equal
+		}
+		return false
+	}
+
+	if !comparable {
+		return c.op == "!="
+	}
+
+	switch c.op {
+	case "==":
+		return order == 0
+	case "!=":
+		return order != 0
+	case ">":
+		return order > 0
+	case "<":
+		return order < 0
+	case ">=":
+		return order >= 0
+	case "<=":
+		return order <= 0
+	}
+	return false
+}
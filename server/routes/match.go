@@ -0,0 +1,189 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routes
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+
+	auth "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+)
+
+//matcher matches a header or a query parameter by name. Exactly one of
+//exact, prefix, regex or present should be set
+type matcher struct {
+	Name    string `json:"name,omitempty"`
+	Exact   string `json:"exact,omitempty"`
+	Prefix  string `json:"prefix,omitempty"`
+	Regex   string `json:"regex,omitempty"`
+	Present bool   `json:"present,omitempty"`
+	Invert  bool   `json:"invert,omitempty"`
+	re      *regexp.Regexp
+}
+
+func (m *matcher) compile() (err error) {
+	if m.Name == "" {
+		return fmt.Errorf("matcher name is required")
+	}
+	if m.Regex != "" {
+		if m.re, err = regexp.Compile(m.Regex); err != nil {
+			return fmt.Errorf("invalid regex for %s: %v", m.Name, err)
+		}
+	}
+	return nil
+}
+
+func (m *matcher) match(value string, found bool) bool {
+	var ok bool
+
+	switch {
+	case m.Exact != "":
+		ok = found && value == m.Exact
+	case m.Prefix != "":
+		ok = found && strings.HasPrefix(value, m.Prefix)
+	case m.re != nil:
+		ok = found && m.re.MatchString(value)
+	default: //present
+		ok = found
+	}
+
+	if m.Invert {
+		return !ok
+	}
+	return ok
+}
+
+//compile prepares the matchers of a rule, it is called when the routing table is loaded
+func (r *routerule) compile() error {
+	for i := range r.Headers {
+		//envoy sends header names in lower case
+		r.Headers[i].Name = strings.ToLower(r.Headers[i].Name)
+		if err := r.Headers[i].compile(); err != nil {
+			return fmt.Errorf("route %s header: %v", r.Name, err)
+		}
+	}
+	for i := range r.QueryParams {
+		if err := r.QueryParams[i].compile(); err != nil {
+			return fmt.Errorf("route %s query parameter: %v", r.Name, err)
+		}
+	}
+	for i := range r.Methods {
+		r.Methods[i] = strings.ToUpper(r.Methods[i])
+	}
+	if err := r.compileBody(); err != nil {
+		return err
+	}
+	if err := r.compileBackends(); err != nil {
+		return err
+	}
+	if r.JWT != nil {
+		if err := r.JWT.Compile(); err != nil {
+			return fmt.Errorf("route %s jwt: %v", r.Name, err)
+		}
+	}
+	if r.APIKey != nil {
+		if err := r.APIKey.Compile(); err != nil {
+			return fmt.Errorf("route %s api key: %v", r.Name, err)
+		}
+	}
+	if r.RateLimit != nil {
+		if err := r.RateLimit.Compile(); err != nil {
+			return fmt.Errorf("route %s rate limit: %v", r.Name, err)
+		}
+	}
+	if r.Quota != nil {
+		if err := r.Quota.Compile(r.Name); err != nil {
+			return fmt.Errorf("route %s quota: %v", r.Name, err)
+		}
+	}
+	if r.RequestTransform != nil {
+		if err := r.RequestTransform.Compile(); err != nil {
+			return fmt.Errorf("route %s request transform: %v", r.Name, err)
+		}
+	}
+	if r.ResponseTransform != nil {
+		if err := r.ResponseTransform.Compile(); err != nil {
+			return fmt.Errorf("route %s response transform: %v", r.Name, err)
+		}
+	}
+	if r.OpenAPI != nil {
+		if err := r.OpenAPI.Compile(); err != nil {
+			return fmt.Errorf("route %s openapi: %v", r.Name, err)
+		}
+	}
+	if r.Mock != nil {
+		if err := r.Mock.Compile(); err != nil {
+			return fmt.Errorf("route %s mock: %v", r.Name, err)
+		}
+	}
+	if err := r.compileResponseHeaders(); err != nil {
+		return err
+	}
+	return r.compileRewrite()
+}
+
+//matchRequest checks the method, header, query parameter and body matchers of a rule
+func (r *routerule) matchRequest(req *auth.AttributeContext_HttpRequest, body *requestBody) bool {
+	if len(r.Methods) > 0 {
+		found := false
+		for _, method := range r.Methods {
+			if method == req.Method {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	for i := range r.Headers {
+		value, found := req.Headers[r.Headers[i].Name]
+		if !r.Headers[i].match(value, found) {
+			return false
+		}
+	}
+
+	if len(r.QueryParams) > 0 {
+		query := getQuery(req)
+		for i := range r.QueryParams {
+			values, found := query[r.QueryParams[i].Name]
+			var value string
+			if found && len(values) > 0 {
+				value = values[0]
+			}
+			if !r.QueryParams[i].match(value, found) {
+				return false
+			}
+		}
+	}
+
+	return r.matchBody(body)
+}
+
+//getQuery returns the query parameters of the request. Older versions of envoy
+//do not populate the query field, in which case it is read from the path
+func getQuery(req *auth.AttributeContext_HttpRequest) url.Values {
+	rawQuery := req.Query
+	if rawQuery == "" {
+		if i := strings.Index(req.Path, "?"); i != -1 {
+			rawQuery = req.Path[i+1:]
+		}
+	}
+	query, _ := url.ParseQuery(rawQuery)
+	return query
+}
@@ -0,0 +1,189 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routes
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//RouteHeader carries the name of the rule matched by ext_authz to ext_proc,
+//which sees the request after its path was rewritten
+const RouteHeader = "x-envoy-router-route"
+
+//responsePolicy sets, appends or removes headers of the responses of a route.
+//It applies to the responses whose status matches one of Status, ex: 2xx, 4xx
+//or 404, and to all responses when Status is empty
+type responsePolicy struct {
+	Status []string          `json:"status,omitempty"`
+	Set    map[string]string `json:"set,omitempty"`
+	Append map[string]string `json:"append,omitempty"`
+	Remove []string          `json:"remove,omitempty"`
+}
+
+//HeaderMutation are the changes to the headers of a response. Header names are
+//lower case
+type HeaderMutation struct {
+	Set    map[string]string
+	Append map[string]string
+	Remove []string
+}
+
+//IsEmpty returns true if the mutation changes nothing
+func (m HeaderMutation) IsEmpty() bool {
+	return len(m.Set) == 0 && len(m.Append) == 0 && len(m.Remove) == 0
+}
+
+//compileResponseHeaders checks the status classes and lower cases header names
+func (r *routerule) compileResponseHeaders() error {
+	for i := range r.ResponseHeaders {
+		p := &r.ResponseHeaders[i]
+		for _, s := range p.Status {
+			if !validStatus(s) {
+				return fmt.Errorf("route %s response headers: invalid status %q, use a class like 2xx or a code like 404", r.Name, s)
+			}
+		}
+
+		var err error
+		if p.Set, err = lowerHeaders(p.Set); err != nil {
+			return fmt.Errorf("route %s response headers: %v", r.Name, err)
+		}
+		if p.Append, err = lowerHeaders(p.Append); err != nil {
+			return fmt.Errorf("route %s response headers: %v", r.Name, err)
+		}
+		for j, name := range p.Remove {
+			if err = checkHeaderName(name); err != nil {
+				return fmt.Errorf("route %s response headers: %v", r.Name, err)
+			}
+			p.Remove[j] = strings.ToLower(name)
+		}
+	}
+	return nil
+}
+
+//validStatus accepts status classes 1xx to 5xx and codes 100 to 599
+func validStatus(s string) bool {
+	s = strings.ToLower(s)
+	if len(s) != 3 || s[0] < '1' || s[0] > '5' {
+		return false
+	}
+	if s[1:] == "xx" {
+		return true
+	}
+	_, err := strconv.Atoi(s)
+	return err == nil
+}
+
+func lowerHeaders(headers map[string]string) (map[string]string, error) {
+	if len(headers) == 0 {
+		return headers, nil
+	}
+	lower := make(map[string]string, len(headers))
+	for name, value := range headers {
+		if err := checkHeaderName(name); err != nil {
+			return nil, err
+		}
+		lower[strings.ToLower(name)] = value
+	}
+	return lower, nil
+}
+
+//checkHeaderName rejects names envoy does not let ext_proc change
+func checkHeaderName(name string) error {
+	if name == "" {
+		return fmt.Errorf("header name is empty")
+	}
+	if strings.HasPrefix(name, ":") || strings.EqualFold(name, "host") {
+		return fmt.Errorf("header %s can't be changed", name)
+	}
+	return nil
+}
+
+//matchStatus returns true if the policy applies to responses with the status
+func (p responsePolicy) matchStatus(status int) bool {
+	if len(p.Status) == 0 {
+		return true
+	}
+	code := strconv.Itoa(status)
+	for _, s := range p.Status {
+		s = strings.ToLower(s)
+		if s == code || (strings.HasSuffix(s, "xx") && len(code) == 3 && s[0] == code[0]) {
+			return true
+		}
+	}
+	return false
+}
+
+//HasResponseHeaders returns true if the rule changes the headers of its responses
+func (r routerule) HasResponseHeaders() bool {
+	return len(r.ResponseHeaders) > 0
+}
+
+//UsesExtProc returns true if the rule has response headers policies, body
+//transforms, OpenAPI validation or a mock, which are applied by the external
+//processing server
+func (r routerule) UsesExtProc() bool {
+	return r.HasResponseHeaders() || r.RequestTransform != nil || r.ResponseTransform != nil || r.OpenAPI != nil ||
+		r.Mock != nil
+}
+
+//GetResponseHeaders merges the policies that apply to a response with the
+//status. When policies set or append the same header, the last one wins. A
+//header removed by a policy and set by a later one is replaced. {name} in values
+//is replaced with the request attribute, ex: {request_id}
+func (r routerule) GetResponseHeaders(status int, attributes map[string]string) HeaderMutation {
+	m := HeaderMutation{Set: map[string]string{}, Append: map[string]string{}}
+	removed := map[string]bool{}
+
+	for _, p := range r.ResponseHeaders {
+		if !p.matchStatus(status) {
+			continue
+		}
+		for _, name := range p.Remove {
+			removed[name] = true
+			delete(m.Set, name)
+			delete(m.Append, name)
+		}
+		for name, value := range p.Set {
+			m.Set[name] = expandAttributes(value, attributes)
+			delete(removed, name)
+		}
+		for name, value := range p.Append {
+			m.Append[name] = expandAttributes(value, attributes)
+			delete(removed, name)
+		}
+	}
+
+	for name := range removed {
+		m.Remove = append(m.Remove, name)
+	}
+	sort.Strings(m.Remove)
+	return m
+}
+
+//expandAttributes replaces {name} with the attribute, unknown names are kept as is
+func expandAttributes(value string, attributes map[string]string) string {
+	if !strings.Contains(value, "{") {
+		return value
+	}
+	return placeholder.ReplaceAllStringFunc(value, func(match string) string {
+		if attribute, ok := attributes[match[1:len(match)-1]]; ok {
+			return attribute
+		}
+		return match
+	})
+}
@@ -0,0 +1,185 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routes
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+//restCapture is the name of the capture holding the path after the prefix
+const restCapture = "rest"
+
+//placeholder matches {name} in prefixes and rewrite templates
+var placeholder = regexp.MustCompile(`\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+//queryRewrite adds, removes or renames query parameters sent to the backend.
+//Values of added parameters can reference captures, ex: {tenant}
+type queryRewrite struct {
+	Add    map[string]string `json:"add,omitempty"`
+	Remove []string          `json:"remove,omitempty"`
+	Rename map[string]string `json:"rename,omitempty"`
+}
+
+//isParam returns true if the prefix segment captures a path segment
+func isParam(segment string) bool {
+	return len(segment) > 2 && segment[0] == '{' && segment[len(segment)-1] == '}'
+}
+
+//compileRewrite checks that the rewrite template only references captures of the prefix
+func (r *routerule) compileRewrite() error {
+	r.segments = splitPath(r.Prefix)
+
+	captures := map[string]bool{restCapture: true}
+	for _, segment := range r.segments {
+		if isParam(segment) {
+			name := segment[1 : len(segment)-1]
+			if !placeholder.MatchString(segment) || name == restCapture {
+				return fmt.Errorf("route %s: invalid capture %s in prefix", r.Name, segment)
+			}
+			captures[name] = true
+		}
+	}
+
+	templates := []string{r.Rewrite}
+	if r.QueryRewrite != nil {
+		for _, value := range r.QueryRewrite.Add {
+			templates = append(templates, value)
+		}
+	}
+
+	for _, template := range templates {
+		for _, m := range placeholder.FindAllStringSubmatch(template, -1) {
+			if !captures[m[1]] {
+				return fmt.Errorf("route %s: rewrite references unknown capture {%s}", r.Name, m[1])
+			}
+		}
+	}
+	return nil
+}
+
+//captures returns the path segments captured by the prefix and the rest of the path
+func (r routerule) captures(path string) map[string]string {
+	segments := splitPath(path)
+	captures := map[string]string{}
+
+	for i, segment := range r.segments {
+		if i >= len(segments) {
+			break
+		}
+		if isParam(segment) {
+			captures[segment[1:len(segment)-1]] = segments[i]
+		}
+	}
+
+	if len(segments) > len(r.segments) {
+		captures[restCapture] = strings.Join(segments[len(r.segments):], "/")
+	}
+	return captures
+}
+
+//GetBackendPath returns the path sent to the backend. If the rule has a rewrite
+//template, it is expanded with the captures. Otherwise the prefix is replaced by
+//backendPrefix. The query string is preserved and rewritten if configured
+func (r routerule) GetBackendPath(path string) string {
+	rawPath, rawQuery := path, ""
+	if i := strings.Index(path, "?"); i != -1 {
+		rawPath, rawQuery = path[:i], path[i+1:]
+	}
+
+	captures := r.captures(rawPath)
+
+	var backendPath string
+	if r.Rewrite != "" {
+		backendPath = expand(r.Rewrite, captures)
+	} else {
+		backendPath = r.BackendPrefix + "/" + captures[restCapture]
+	}
+
+	backendPath = cleanPath(backendPath, strings.HasSuffix(rawPath, "/"))
+
+	if r.QueryRewrite != nil {
+		rawQuery = r.QueryRewrite.apply(rawQuery, captures)
+	}
+
+	if rawQuery != "" {
+		return backendPath + "?" + rawQuery
+	}
+	return backendPath
+}
+
+//apply rewrites the raw query string. Parameters that are not renamed or removed
+//are kept as sent by the client and in the same order
+func (q *queryRewrite) apply(rawQuery string, captures map[string]string) string {
+	var params []string
+
+	remove := map[string]bool{}
+	for _, name := range q.Remove {
+		remove[name] = true
+	}
+
+	for _, param := range strings.Split(rawQuery, "&") {
+		if param == "" {
+			continue
+		}
+		rawName, rawValue, hasValue := strings.Cut(param, "=")
+		name, err := url.QueryUnescape(rawName)
+		if err != nil {
+			name = rawName
+		}
+		if remove[name] {
+			continue
+		}
+		if newName, ok := q.Rename[name]; ok {
+			param = url.QueryEscape(newName)
+			if hasValue {
+				param += "=" + rawValue
+			}
+		}
+		params = append(params, param)
+	}
+
+	names := make([]string, 0, len(q.Add))
+	for name := range q.Add {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		params = append(params, url.QueryEscape(name)+"="+url.QueryEscape(expand(q.Add[name], captures)))
+	}
+
+	return strings.Join(params, "&")
+}
+
+//expand replaces {name} with the captured value
+func expand(template string, captures map[string]string) string {
+	return placeholder.ReplaceAllStringFunc(template, func(m string) string {
+		return captures[m[1:len(m)-1]]
+	})
+}
+
+//cleanPath collapses empty segments left by empty captures and keeps a trailing
+//slash only if the client sent one
+func cleanPath(path string, trailingSlash bool) string {
+	cleaned := "/" + strings.Join(splitPath(path), "/")
+	if trailingSlash && cleaned != "/" {
+		cleaned += "/"
+	}
+	return cleaned
+}
@@ -15,13 +15,27 @@
 package routes
 
 import (
+	"context"
+	"crypto/sha256"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
-	"regexp"
+	"log/slog"
+	"sort"
 	"strings"
-
-	common "github.com/srinandan/sample-apps/common"
+	"sync"
+	"sync/atomic"
+
+	auth "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	apikeys "github.com/srinandan/envoy-router/server/apikeys"
+	jwtauth "github.com/srinandan/envoy-router/server/jwtauth"
+	mock "github.com/srinandan/envoy-router/server/mock"
+	openapi "github.com/srinandan/envoy-router/server/openapi"
+	quota "github.com/srinandan/envoy-router/server/quota"
+	ratelimit "github.com/srinandan/envoy-router/server/ratelimit"
+	tracing "github.com/srinandan/envoy-router/server/tracing"
+	transform "github.com/srinandan/envoy-router/server/transform"
+	watcher "github.com/srinandan/envoy-router/server/watcher"
 )
 
 type Auth uint8
@@ -32,60 +46,203 @@ const (
 	OIDC_TOKEN
 )
 
+func (a Auth) String() string {
+	switch a {
+	case OFF:
+		return "none"
+	case ACCESS_TOKEN:
+		return "access_token"
+	case OIDC_TOKEN:
+		return "oidc_token"
+	}
+	return "unknown"
+}
+
 type routerule struct {
-	Name           string `json:"name,omitempty"`
-	Backend        string `json:"backend,omitempty"`
-	BackendPrefix  string `json:"backendPrefix,omitempty"`
-	Prefix         string `json:"prefix,omitempty"`
-	Authentication Auth   `json:"authentication,omitempty"`
+	Name              string               `json:"name,omitempty"`
+	Backend           string               `json:"backend,omitempty"`
+	BackendPrefix     string               `json:"backendPrefix,omitempty"`
+	Prefix            string               `json:"prefix,omitempty"`
+	Authentication    Auth                 `json:"authentication,omitempty"`
+	Audience          string               `json:"audience,omitempty"`
+	Methods           []string             `json:"methods,omitempty"`
+	Headers           []matcher            `json:"headers,omitempty"`
+	QueryParams       []matcher            `json:"queryParams,omitempty"`
+	Body              []bodyMatcher        `json:"body,omitempty"`
+	Priority          int                  `json:"priority,omitempty"`
+	Rewrite           string               `json:"rewrite,omitempty"`
+	QueryRewrite      *queryRewrite        `json:"queryRewrite,omitempty"`
+	Backends          []weightedBackend    `json:"backends,omitempty"`
+	Sticky            *stickiness          `json:"sticky,omitempty"`
+	JWT               *jwtauth.Requirement `json:"jwt,omitempty"`
+	APIKey            *apikeys.Requirement `json:"apiKey,omitempty"`
+	RateLimit         *ratelimit.Limit     `json:"rateLimit,omitempty"`
+	Quota             *quota.Quota         `json:"quota,omitempty"`
+	ResponseHeaders   []responsePolicy     `json:"responseHeaders,omitempty"`
+	RequestTransform  *transform.Transform `json:"requestTransform,omitempty"`
+	ResponseTransform *transform.Transform `json:"responseTransform,omitempty"`
+	OpenAPI           *openapi.Validation  `json:"openapi,omitempty"`
+	Mock              *mock.Mock           `json:"mock,omitempty"`
+	segments          []string
+	index             int
+	rank              int
+	totalWeight       uint32
 }
 
+//RouteRule is a rule of the routing table, as returned by GetRouteRules
+type RouteRule = routerule
+
 type routeinfo struct {
 	RouteRules []routerule `json:"routerules,omitempty"`
+	trie       *trieNode
+	version    string
 }
 
-var routeInfo = routeinfo{}
+//routeTable holds the active *routeinfo. It is replaced as a whole on reload
+//so readers never see a partially loaded table
+var routeTable atomic.Value
+
+func init() {
+	routeTable.Store(&routeinfo{trie: newTrieNode()})
+}
+
+//reloadListeners are called after a new table is loaded
+var reloadListeners []func()
+var reloadListenersLock sync.Mutex
+
+func getRouteInfo() *routeinfo {
+	return routeTable.Load().(*routeinfo)
+}
 
+//OnReload registers a function that is called every time a new routing table is loaded
+func OnReload(listener func()) {
+	reloadListenersLock.Lock()
+	defer reloadListenersLock.Unlock()
+	reloadListeners = append(reloadListeners, listener)
+}
+
+//GetVersion returns a hash of the active routing table file
+func GetVersion() string {
+	return getRouteInfo().version
+}
+
+//GetRouteRules returns the rules of the active routing table in the order they
+//are evaluated: by priority, then by the longest prefix, then by file order
+func GetRouteRules() []routerule {
+	ri := getRouteInfo()
+	rules := make([]routerule, len(ri.RouteRules))
+	copy(rules, ri.RouteRules)
+
+	sort.Slice(rules, func(i, j int) bool {
+		return rules[i].rank < rules[j].rank
+	})
+	return rules
+}
+
+//ReadRoutesFile loads and validates the routing table. The active table is
+//only replaced if the new one is valid
 func ReadRoutesFile(routeFile string) error {
 	routeListBytes, err := ioutil.ReadFile(routeFile)
 	if err != nil {
 		return err
 	}
 
-	if err = json.Unmarshal(routeListBytes, &routeInfo); err != nil {
+	newRouteInfo := &routeinfo{}
+	if err = json.Unmarshal(routeListBytes, newRouteInfo); err != nil {
 		return err
 	}
 
-	if len(routeInfo.RouteRules) < 1 {
-		return fmt.Errorf("routing table must have at least one route rule")
+	var errs []string
+	for _, issue := range validate(routeFile, newRouteInfo) {
+		if issue.Severity == SeverityError {
+			errs = append(errs, issue.String())
+		} else {
+			slog.Warn("routing table", "issue", issue.String())
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid routing table:\n%s", strings.Join(errs, "\n"))
 	}
 
+	newRouteInfo.trie = buildTrie(newRouteInfo.RouteRules)
+	newRouteInfo.version = fmt.Sprintf("%x", sha256.Sum256(routeListBytes))[:12]
+
+	routeTable.Store(newRouteInfo)
+
+	reloadListenersLock.Lock()
+	listeners := reloadListeners
+	reloadListenersLock.Unlock()
+	for _, listener := range listeners {
+		listener()
+	}
 	return nil
 }
 
-func GetRoute(basePath string) (r routerule, notFound bool) {
-	common.Info.Printf(">>>>> basepath %s", basePath)
+//WatchRoutesFile reloads the routing table when the file changes. If the new
+//file is invalid, the last good table remains active
+func WatchRoutesFile(routeFile string) (stop func(), err error) {
+	return watcher.Watch(routeFile, func() {
+		ReloadRoutesFile(routeFile)
+	})
+}
 
-	for _, routeRule := range routeInfo.RouteRules {
-		matchStr := "^" + routeRule.Prefix + "(/[^/]+)*/?"
-		if ok, _ := regexp.MatchString(matchStr, basePath); ok {
-			common.Info.Printf(">>>>> basepath found. authentication is %d\n", routeRule.Authentication)
-			return routeRule, true
-		}
+//ReloadRoutesFile reloads the routing table and logs the outcome
+func ReloadRoutesFile(routeFile string) {
+	if err := ReadRoutesFile(routeFile); err != nil {
+		slog.Error("unable to reload routing table, keeping the last good table", "file", routeFile, "error", err)
+		return
+	}
+	slog.Info("reloaded routing table", "file", routeFile, "rules", len(getRouteInfo().RouteRules), "version", GetVersion())
+}
+
+//GetRoute returns the most specific rule whose prefix, method, header and query
+//parameter matchers match the request. A higher priority wins over a longer prefix
+func GetRoute(req *auth.AttributeContext_HttpRequest) (r routerule, notFound bool) {
+	basePath := req.Path
+
+	body := newRequestBody(req)
+	routeRule := getRouteInfo().trie.lookup(basePath, func(routeRule *routerule) bool {
+		return routeRule.matchRequest(req, body)
+	})
+	if routeRule != nil {
+		slog.Debug("route found", "path", basePath, "route", routeRule.Name)
+		return *routeRule, true
 	}
-	common.Info.Printf(">>>>> basepath not found\n")
+	slog.Debug("route not found", "path", basePath)
 	return r, false
 }
 
-func ReplacePrefix(basePath string, prefix string) string {
-	common.Info.Printf(">>>>> replace %s with %s", basePath, strings.Replace(basePath, prefix, "", 1))
-	return strings.Replace(basePath, prefix, "", 1)
+//GetRouteContext is GetRoute in a span of the trace in the context
+func GetRouteContext(ctx context.Context, req *auth.AttributeContext_HttpRequest) (routerule, bool) {
+	_, span := tracing.Start(ctx, "routes.GetRoute")
+	defer span.End()
+
+	r, found := GetRoute(req)
+	if found {
+		span.SetAttributes(tracing.RouteKey.String(r.Name))
+	}
+	return r, found
+}
+
+//GetRouteByName returns the rule of the active routing table with the name
+func GetRouteByName(name string) (r routerule, found bool) {
+	if name == "" {
+		return r, false
+	}
+	for _, routeRule := range getRouteInfo().RouteRules {
+		if routeRule.Name == name {
+			return routeRule, true
+		}
+	}
+	return r, false
 }
 
-func GetFullPath(basePath string, backendPrefix string) string {
-	//join the backendPrefix
-	if backendPrefix != "" {
-		return strings.Join([]string{basePath, backendPrefix}, "")
+//GetAudience returns the audience used for OIDC tokens, defaults to the URL of
+//the backend selected for the request
+func (r routerule) GetAudience(backend string) string {
+	if r.Audience != "" {
+		return r.Audience
 	}
-	return basePath
+	return "https://" + backend
 }
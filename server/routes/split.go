@@ -0,0 +1,132 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routes
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"net/http"
+	"strings"
+
+	auth "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+)
+
+//weightedBackend is one of the variants of a rule that splits traffic
+type weightedBackend struct {
+	Name    string `json:"name,omitempty"`
+	Backend string `json:"backend,omitempty"`
+	Weight  uint32 `json:"weight,omitempty"`
+}
+
+//stickiness assigns a client to the same variant across requests. The first
+//non empty key among header, cookie and client id is hashed
+type stickiness struct {
+	Header   string `json:"header,omitempty"`
+	Cookie   string `json:"cookie,omitempty"`
+	ClientID bool   `json:"clientId,omitempty"`
+}
+
+//compileBackends checks the variants of a rule
+func (r *routerule) compileBackends() error {
+	if len(r.Backends) == 0 {
+		return nil
+	}
+
+	var total uint32
+	for i, b := range r.Backends {
+		if b.Backend == "" {
+			return fmt.Errorf("route %s: backends[%d] backend is empty", r.Name, i)
+		}
+		total += b.Weight
+	}
+	if total == 0 {
+		return fmt.Errorf("route %s: backends must have a total weight greater than zero", r.Name)
+	}
+
+	if r.Sticky != nil {
+		r.Sticky.Header = strings.ToLower(r.Sticky.Header)
+	}
+	r.totalWeight = total
+	return nil
+}
+
+//SelectBackend picks the backend for the request. For rules with weighted
+//backends, it also returns the name of the variant picked. clientID identifies
+//the downstream client, ex: its address
+func (r routerule) SelectBackend(req *auth.AttributeContext_HttpRequest, clientID string) (variant string, backend string) {
+	if len(r.Backends) == 0 || r.totalWeight == 0 {
+		return "", r.Backend
+	}
+
+	var n uint32
+	if key := r.stickyKey(req, clientID); key != "" {
+		h := fnv.New32a()
+		_, _ = h.Write([]byte(r.Name + "/" + key))
+		n = h.Sum32() % r.totalWeight
+	} else {
+		n = uint32(rand.Int63n(int64(r.totalWeight)))
+	}
+
+	for _, b := range r.Backends {
+		if n < b.Weight {
+			return b.variantName(), b.Backend
+		}
+		n -= b.Weight
+	}
+
+	//not reachable, the weights add up to totalWeight
+	last := r.Backends[len(r.Backends)-1]
+	return last.variantName(), last.Backend
+}
+
+//TotalWeight returns the sum of the weights of the backends
+func (r routerule) TotalWeight() uint32 {
+	return r.totalWeight
+}
+
+func (b weightedBackend) variantName() string {
+	if b.Name != "" {
+		return b.Name
+	}
+	return b.Backend
+}
+
+func (r routerule) stickyKey(req *auth.AttributeContext_HttpRequest, clientID string) string {
+	if r.Sticky == nil {
+		return ""
+	}
+
+	if r.Sticky.Header != "" {
+		if value := req.Headers[r.Sticky.Header]; value != "" {
+			return value
+		}
+	}
+
+	if r.Sticky.Cookie != "" {
+		if raw := req.Headers["cookie"]; raw != "" {
+			cookies := &http.Request{Header: http.Header{"Cookie": {raw}}}
+			if c, err := cookies.Cookie(r.Sticky.Cookie); err == nil && c.Value != "" {
+				return c.Value
+			}
+		}
+	}
+
+	if r.Sticky.ClientID {
+		return clientID
+	}
+
+	return ""
+}
@@ -0,0 +1,175 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routes
+
+import (
+	"sort"
+	"strings"
+)
+
+//trieNode is a path segment in the prefix trie. Rules are attached to the node
+//of the last segment of their prefix. Captures such as {tenant} share the param child
+type trieNode struct {
+	children map[string]*trieNode
+	param    *trieNode
+	//rules are ordered by rank when the trie is built
+	rules []*routerule
+}
+
+//maxMatchedNodes is the number of matched nodes a lookup holds without allocating
+const maxMatchedNodes = 16
+
+func newTrieNode() *trieNode {
+	return &trieNode{children: map[string]*trieNode{}}
+}
+
+//buildTrie compiles the route rules into a prefix trie. Each rule is ranked by
+//priority, then by the longest prefix, then by the number of literal (not
+//captured) segments, then by its order in the file, and the rules of each
+//node are sorted by rank
+func buildTrie(rules []routerule) *trieNode {
+	root := newTrieNode()
+	depths := make([]int, len(rules))
+	literals := make([]int, len(rules))
+	nodes := map[*trieNode]bool{}
+
+	for i := range rules {
+		rules[i].index = i
+		node := root
+		for _, segment := range splitPath(rules[i].Prefix) {
+			depths[i]++
+			if isParam(segment) {
+				if node.param == nil {
+					node.param = newTrieNode()
+				}
+				node = node.param
+				continue
+			}
+			literals[i]++
+			child, ok := node.children[segment]
+			if !ok {
+				child = newTrieNode()
+				node.children[segment] = child
+			}
+			node = child
+		}
+		node.rules = append(node.rules, &rules[i])
+		nodes[node] = true
+	}
+
+	order := make([]int, len(rules))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool {
+		a, b := order[i], order[j]
+		if rules[a].Priority != rules[b].Priority {
+			return rules[a].Priority > rules[b].Priority
+		}
+		if depths[a] != depths[b] {
+			return depths[a] > depths[b]
+		}
+		if literals[a] != literals[b] {
+			return literals[a] > literals[b]
+		}
+		return a < b
+	})
+	for rank, i := range order {
+		rules[i].rank = rank
+	}
+
+	for node := range nodes {
+		sort.Slice(node.rules, func(i, j int) bool {
+			return node.rules[i].rank < node.rules[j].rank
+		})
+	}
+	return root
+}
+
+//lookup returns the first rule, by rank, whose prefix matches the path and for
+//which match returns true, nil if there is none. The sorted rules of the
+//matched nodes are merged, nothing is sorted per request
+func (t *trieNode) lookup(path string, match func(*routerule) bool) *routerule {
+	var buffer [maxMatchedNodes][]*routerule
+	matched := t.walk(path, buffer[:0])
+
+	for {
+		next := -1
+		for i, rules := range matched {
+			if len(rules) > 0 && (next == -1 || rules[0].rank < matched[next][0].rank) {
+				next = i
+			}
+		}
+		if next == -1 {
+			return nil
+		}
+		rule := matched[next][0]
+		matched[next] = matched[next][1:]
+		if match(rule) {
+			return rule
+		}
+	}
+}
+
+//walk appends the rules of the nodes matching the path to matched
+func (t *trieNode) walk(path string, matched [][]*routerule) [][]*routerule {
+	if len(t.rules) > 0 {
+		matched = append(matched, t.rules)
+	}
+
+	segment, rest := nextSegment(path)
+	if segment == "" {
+		return matched
+	}
+
+	if child, ok := t.children[segment]; ok {
+		matched = child.walk(rest, matched)
+	}
+	if t.param != nil {
+		matched = t.param.walk(rest, matched)
+	}
+	return matched
+}
+
+//nextSegment returns the first non empty segment of the path and the rest of
+//the path. The segment is empty at the end of the path or at the query string
+func nextSegment(path string) (segment string, rest string) {
+	path = strings.TrimLeft(path, "/")
+	end := strings.IndexAny(path, "/?#")
+	switch {
+	case path == "" || end == 0:
+		return "", ""
+	case end == -1:
+		return path, ""
+	}
+	return path[:end], path[end:]
+}
+
+//splitPath returns the segments of a path, ignoring the query string and empty segments
+func splitPath(path string) []string {
+	if i := strings.IndexAny(path, "?#"); i != -1 {
+		path = path[:i]
+	}
+
+	segments := strings.Split(path, "/")
+	n := 0
+	for _, segment := range segments {
+		if segment != "" {
+			segments[n] = segment
+			n++
+		}
+	}
+	return segments[:n]
+}
@@ -0,0 +1,238 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routes
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	auth "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+)
+
+//loadRules makes the rules the active routing table
+func loadRules(tb testing.TB, rules []routerule) {
+	tb.Helper()
+	content, err := json.Marshal(routeinfo{RouteRules: rules})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	file := filepath.Join(tb.TempDir(), "routes.json")
+	if err := os.WriteFile(file, content, 0600); err != nil {
+		tb.Fatal(err)
+	}
+	if err := ReadRoutesFile(file); err != nil {
+		tb.Fatal(err)
+	}
+}
+
+func testRules() []routerule {
+	return []routerule{
+		{Name: "root", Prefix: "/", Backend: "root.example.com"},
+		{Name: "api", Prefix: "/api", Backend: "api.example.com"},
+		{Name: "api-v1", Prefix: "/api/v1", Backend: "v1.example.com"},
+		{Name: "users-any", Prefix: "/api/{version}/users", Backend: "users.example.com"},
+		{Name: "users-v1", Prefix: "/api/v1/users", Backend: "users-v1.example.com"},
+		{Name: "posts-get", Prefix: "/api/v1/posts", Methods: []string{"GET"}, Backend: "read.example.com"},
+		{Name: "posts", Prefix: "/api/v1/posts", Backend: "write.example.com"},
+		{Name: "admin", Prefix: "/admin", Priority: 10, Backend: "admin.example.com"},
+		{Name: "admin-users", Prefix: "/admin/users", Backend: "users.example.com"},
+		{Name: "tenant", Prefix: "/t/{tenant}/{resource}", Backend: "tenant.example.com"},
+		{Name: "tenant-orders", Prefix: "/t/{tenant}/orders", Priority: 1, Backend: "orders.example.com"},
+	}
+}
+
+func TestGetRoute(t *testing.T) {
+	loadRules(t, testRules())
+
+	tests := []struct {
+		method string
+		path   string
+		want   string
+	}{
+		//the longest prefix wins, then the most literal segments
+		{"GET", "/api/v1/users/42", "users-v1"},
+		{"GET", "/api/v2/users", "users-any"},
+		{"GET", "/api/v1/other", "api-v1"},
+		{"GET", "/api/v2/other", "api"},
+		{"GET", "/apis", "root"},
+		{"GET", "/", "root"},
+		//same prefix, the first rule that matches the request in file order
+		{"GET", "/api/v1/posts", "posts-get"},
+		{"POST", "/api/v1/posts", "posts"},
+		//a higher priority wins over a longer prefix
+		{"GET", "/admin/users", "admin"},
+		{"GET", "/t/acme/orders/7", "tenant-orders"},
+		{"GET", "/t/acme/invoices", "tenant"},
+		{"GET", "/t/acme", "root"},
+		//query strings, fragments and empty segments are ignored
+		{"GET", "/api/v1/users?limit=10", "users-v1"},
+		{"GET", "//api//v1/users/", "users-v1"},
+		{"GET", "/api/v1#users", "api-v1"},
+		{"GET", "/api/v1/?/users", "api-v1"},
+	}
+
+	for _, test := range tests {
+		r, found := GetRoute(&auth.AttributeContext_HttpRequest{Method: test.method, Path: test.path})
+		if !found {
+			t.Errorf("%s %s: no route, want %s", test.method, test.path, test.want)
+			continue
+		}
+		if r.Name != test.want {
+			t.Errorf("%s %s: got %s, want %s", test.method, test.path, r.Name, test.want)
+		}
+	}
+}
+
+func TestGetRouteNotFound(t *testing.T) {
+	loadRules(t, []routerule{
+		{Name: "orders", Prefix: "/orders", Methods: []string{"GET"}, Backend: "orders.example.com"},
+	})
+
+	for _, path := range []string{"/", "/order", "/customers/orders"} {
+		if r, found := GetRoute(&auth.AttributeContext_HttpRequest{Method: "GET", Path: path}); found {
+			t.Errorf("%s: got %s, want no route", path, r.Name)
+		}
+	}
+	if r, found := GetRoute(&auth.AttributeContext_HttpRequest{Method: "POST", Path: "/orders"}); found {
+		t.Errorf("POST /orders: got %s, want no route", r.Name)
+	}
+}
+
+func TestGetRouteRulesOrder(t *testing.T) {
+	loadRules(t, testRules())
+
+	want := []string{"admin", "tenant-orders", "users-v1", "posts-get", "posts", "users-any",
+		"tenant", "api-v1", "admin-users", "api", "root"}
+	rules := GetRouteRules()
+	if len(rules) != len(want) {
+		t.Fatalf("got %d rules, want %d", len(rules), len(want))
+	}
+	for i := range want {
+		if rules[i].Name != want[i] {
+			t.Errorf("rules[%d]: got %s, want %s", i, rules[i].Name, want[i])
+		}
+	}
+}
+
+//TestLookupOrder compares the trie with a scan of the rules in evaluation order
+func TestLookupOrder(t *testing.T) {
+	rules := generateRules(500)
+	loadRules(t, rules)
+	ordered := GetRouteRules()
+
+	for _, path := range generatePaths(2000) {
+		req := &auth.AttributeContext_HttpRequest{Method: "GET", Path: path, Headers: map[string]string{"x-canary": "true"}}
+		var want string
+		for i := range ordered {
+			if hasSegmentPrefix(splitPath(path), ordered[i].segments) && ordered[i].matchRequest(req, newRequestBody(req)) {
+				want = ordered[i].Name
+				break
+			}
+		}
+		r, _ := GetRoute(req)
+		if r.Name != want {
+			t.Errorf("%s: got %q, want %q", path, r.Name, want)
+		}
+	}
+}
+
+func TestNextSegment(t *testing.T) {
+	tests := []struct {
+		path    string
+		segment string
+		rest    string
+	}{
+		{"", "", ""},
+		{"/", "", ""},
+		{"/api", "api", ""},
+		{"/api/v1", "api", "/v1"},
+		{"//api//v1", "api", "//v1"},
+		{"api/", "api", "/"},
+		{"/api?q=/x", "api", "?q=/x"},
+		{"/?q=1", "", ""},
+		{"/#top", "", ""},
+	}
+	for _, test := range tests {
+		segment, rest := nextSegment(test.path)
+		if segment != test.segment || rest != test.rest {
+			t.Errorf("%q: got %q, %q, want %q, %q", test.path, segment, rest, test.segment, test.rest)
+		}
+	}
+}
+
+//generateRules returns n rules over a few services and versions, with
+//captures, priorities and header matchers
+func generateRules(n int) []routerule {
+	rules := make([]routerule, 0, n+1)
+	rules = append(rules, routerule{Name: "default", Prefix: "/", Backend: "default.example.com"})
+	for i := 0; len(rules) < n+1; i++ {
+		r := routerule{
+			Name:    fmt.Sprintf("rule-%d", i),
+			Backend: fmt.Sprintf("svc%d.example.com", i),
+		}
+		switch i % 5 {
+		case 0:
+			r.Prefix = fmt.Sprintf("/api/v%d/svc%d", i%3, i)
+		case 1:
+			r.Prefix = fmt.Sprintf("/api/{version}/svc%d/{id}", i-1)
+		case 2:
+			r.Prefix = fmt.Sprintf("/api/v%d/svc%d/items", i%3, i-2)
+			r.Priority = i % 2
+		case 3:
+			r.Prefix = fmt.Sprintf("/tenants/{tenant}/svc%d", i-3)
+			r.Headers = []matcher{{Name: "x-canary", Exact: "true"}}
+		case 4:
+			r.Prefix = fmt.Sprintf("/tenants/{tenant}/svc%d", i-4)
+		}
+		rules = append(rules, r)
+	}
+	return rules
+}
+
+func generatePaths(n int) []string {
+	paths := make([]string, n)
+	for i := range paths {
+		svc := (i * 7) % (n / 4)
+		switch i % 4 {
+		case 0:
+			paths[i] = fmt.Sprintf("/api/v%d/svc%d/items/%d", i%3, svc, i)
+		case 1:
+			paths[i] = fmt.Sprintf("/api/v%d/svc%d", (i+1)%3, svc)
+		case 2:
+			paths[i] = fmt.Sprintf("/tenants/acme/svc%d/orders?page=%d", svc, i)
+		case 3:
+			paths[i] = fmt.Sprintf("/unknown/%d", i)
+		}
+	}
+	return paths
+}
+
+func BenchmarkGetRoute(b *testing.B) {
+	loadRules(b, generateRules(3000))
+	paths := generatePaths(1000)
+	requests := make([]*auth.AttributeContext_HttpRequest, len(paths))
+	for i, path := range paths {
+		requests[i] = &auth.AttributeContext_HttpRequest{Method: "GET", Path: path}
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		GetRoute(requests[i%len(requests)])
+	}
+}
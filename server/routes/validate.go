@@ -0,0 +1,214 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routes
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+type Severity string
+
+const (
+	SeverityError   Severity = "error"
+	SeverityWarning Severity = "warning"
+)
+
+//Issue is a problem found in the routing table. Index is the position of the
+//rule in routerules, or -1 if the issue applies to the whole file
+type Issue struct {
+	File     string   `json:"file,omitempty"`
+	Index    int      `json:"index"`
+	Rule     string   `json:"rule,omitempty"`
+	Severity Severity `json:"severity,omitempty"`
+	Message  string   `json:"message,omitempty"`
+}
+
+func (i Issue) String() string {
+	if i.Index < 0 {
+		return fmt.Sprintf("%s: %s: %s", i.File, i.Severity, i.Message)
+	}
+	return fmt.Sprintf("%s: routerules[%d] (%s): %s: %s", i.File, i.Index, i.Rule, i.Severity, i.Message)
+}
+
+//ValidateRoutesFile reads the routing table and reports every issue found in
+//it without changing the active table
+func ValidateRoutesFile(routeFile string) ([]Issue, error) {
+	routeListBytes, err := ioutil.ReadFile(routeFile)
+	if err != nil {
+		return nil, err
+	}
+
+	ri := &routeinfo{}
+	if err = json.Unmarshal(routeListBytes, ri); err != nil {
+		return nil, fmt.Errorf("%s: %v", routeFile, err)
+	}
+
+	return validate(routeFile, ri), nil
+}
+
+//HasErrors returns true if any of the issues is an error
+func HasErrors(issues []Issue) bool {
+	for _, issue := range issues {
+		if issue.Severity == SeverityError {
+			return true
+		}
+	}
+	return false
+}
+
+//validate compiles the rules and checks them individually and against each other
+func validate(file string, ri *routeinfo) (issues []Issue) {
+	report := func(index int, severity Severity, format string, a ...interface{}) {
+		issue := Issue{File: file, Index: index, Severity: severity, Message: fmt.Sprintf(format, a...)}
+		if index >= 0 {
+			issue.Rule = ri.RouteRules[index].Name
+		}
+		issues = append(issues, issue)
+	}
+
+	if len(ri.RouteRules) < 1 {
+		report(-1, SeverityError, "routing table must have at least one route rule")
+		return issues
+	}
+
+	names := map[string]int{}
+	prefixes := map[string]int{}
+
+	for i := range ri.RouteRules {
+		r := &ri.RouteRules[i]
+
+		//ext_proc finds the rule of the request by the name ext_authz passes
+		if r.Name == "" {
+			if r.UsesExtProc() {
+				report(i, SeverityError, "name is required by responseHeaders, transforms, openapi and mock")
+			} else {
+				report(i, SeverityWarning, "name is empty")
+			}
+		} else if j, ok := names[r.Name]; ok {
+			if r.UsesExtProc() || ri.RouteRules[j].UsesExtProc() {
+				report(i, SeverityError, "name is also used by routerules[%d], names must be unique with responseHeaders, transforms, openapi and mock", j)
+			} else {
+				report(i, SeverityWarning, "name is also used by routerules[%d]", j)
+			}
+		} else {
+			names[r.Name] = i
+		}
+
+		if r.Mock != nil {
+			//mocks answer in place of the backend
+			if r.Backend != "" || len(r.Backends) > 0 {
+				report(i, SeverityWarning, "backend is ignored by mock routes")
+			}
+			if r.Authentication != OFF {
+				report(i, SeverityError, "authentication is not supported by mock routes, they don't call a backend")
+			}
+		} else if r.Backend == "" && len(r.Backends) == 0 {
+			report(i, SeverityError, "backend is empty")
+		} else if r.Backend != "" && len(r.Backends) > 0 {
+			report(i, SeverityWarning, "backend is ignored when backends are set")
+		}
+
+		if r.Authentication > OIDC_TOKEN {
+			report(i, SeverityError, "unknown authentication %d", r.Authentication)
+		}
+
+		if !strings.HasPrefix(r.Prefix, "/") {
+			report(i, SeverityError, "prefix %q must start with /", r.Prefix)
+		}
+
+		if err := r.compile(); err != nil {
+			report(i, SeverityError, "%v", err)
+		}
+
+		prefix := placeholder.ReplaceAllString("/"+strings.Join(splitPath(r.Prefix), "/"), "{}")
+		if j, ok := prefixes[prefix]; ok {
+			report(i, SeverityWarning, "prefix %s is also used by routerules[%d]", r.Prefix, j)
+		} else {
+			prefixes[prefix] = i
+		}
+	}
+
+	for i := range ri.RouteRules {
+		if j, ok := shadowedBy(ri.RouteRules, i); ok {
+			report(i, SeverityWarning, "unreachable, every request it matches is matched first by routerules[%d] (%s)",
+				j, ri.RouteRules[j].Name)
+		}
+	}
+
+	return issues
+}
+
+//shadowedBy returns the rule that matches every request rule i could match and
+//is always evaluated before it
+func shadowedBy(rules []routerule, i int) (int, bool) {
+	b := &rules[i]
+	bSegments := splitPath(b.Prefix)
+
+	for j := range rules {
+		a := &rules[j]
+		if j == i || a.hasRequestMatchers() {
+			continue
+		}
+
+		aSegments := splitPath(a.Prefix)
+		if !hasSegmentPrefix(bSegments, aSegments) {
+			continue
+		}
+
+		if a.Priority > b.Priority {
+			return j, true
+		}
+		//ranked as by buildTrie: the longest prefix wins, then the one with the
+		//most literal segments, then the first in the file. Since a matches every
+		//path b matches, it can't be longer nor have more literal segments
+		if a.Priority == b.Priority && len(aSegments) == len(bSegments) &&
+			literalSegments(aSegments) == literalSegments(bSegments) && j < i {
+			return j, true
+		}
+	}
+	return -1, false
+}
+
+//literalSegments returns the number of segments that are not captures
+func literalSegments(segments []string) int {
+	n := 0
+	for _, segment := range segments {
+		if !isParam(segment) {
+			n++
+		}
+	}
+	return n
+}
+
+func (r *routerule) hasRequestMatchers() bool {
+	return len(r.Methods) > 0 || len(r.Headers) > 0 || len(r.QueryParams) > 0 || r.hasBodyMatchers()
+}
+
+//hasSegmentPrefix returns true if the prefix matches the leading segments. A
+//capture in the prefix matches any segment
+func hasSegmentPrefix(segments []string, prefix []string) bool {
+	if len(prefix) > len(segments) {
+		return false
+	}
+	for i := range prefix {
+		if segments[i] != prefix[i] && !isParam(prefix[i]) {
+			return false
+		}
+	}
+	return true
+}
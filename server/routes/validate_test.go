@@ -0,0 +1,181 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routes
+
+import (
+	"strings"
+	"testing"
+
+	auth "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+)
+
+//issuesOf validates the rules and returns the issues of the rule at index
+func issuesOf(rules []routerule, index int) []Issue {
+	var issues []Issue
+	for _, issue := range validate("routes.json", &routeinfo{RouteRules: rules}) {
+		if issue.Index == index {
+			issues = append(issues, issue)
+		}
+	}
+	return issues
+}
+
+func hasIssue(issues []Issue, severity Severity, message string) bool {
+	for _, issue := range issues {
+		if issue.Severity == severity && strings.Contains(issue.Message, message) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestValidateNames(t *testing.T) {
+	headers := []responsePolicy{{Set: map[string]string{"x-route": "{route}"}}}
+
+	tests := []struct {
+		name     string
+		rules    []routerule
+		severity Severity
+		message  string
+	}{
+		{
+			name: "duplicate",
+			rules: []routerule{
+				{Name: "a", Prefix: "/one", Backend: "one.example.com"},
+				{Name: "a", Prefix: "/two", Backend: "two.example.com"},
+			},
+			severity: SeverityWarning,
+			message:  "name is also used by routerules[0]",
+		},
+		{
+			name: "duplicate of a rule applied by ext_proc",
+			rules: []routerule{
+				{Name: "a", Prefix: "/one", Backend: "one.example.com"},
+				{Name: "a", Prefix: "/two", Backend: "two.example.com", ResponseHeaders: headers},
+			},
+			severity: SeverityError,
+			message:  "name is also used by routerules[0]",
+		},
+		{
+			name: "ext_proc rule first",
+			rules: []routerule{
+				{Name: "a", Prefix: "/one", Backend: "one.example.com", ResponseHeaders: headers},
+				{Name: "a", Prefix: "/two", Backend: "two.example.com"},
+			},
+			severity: SeverityError,
+			message:  "name is also used by routerules[0]",
+		},
+		{
+			name: "empty",
+			rules: []routerule{
+				{Name: "a", Prefix: "/one", Backend: "one.example.com"},
+				{Prefix: "/two", Backend: "two.example.com"},
+			},
+			severity: SeverityWarning,
+			message:  "name is empty",
+		},
+		{
+			name: "empty on a rule applied by ext_proc",
+			rules: []routerule{
+				{Name: "a", Prefix: "/one", Backend: "one.example.com"},
+				{Prefix: "/two", Backend: "two.example.com", ResponseHeaders: headers},
+			},
+			severity: SeverityError,
+			message:  "name is required",
+		},
+	}
+
+	for _, test := range tests {
+		if issues := issuesOf(test.rules, 1); !hasIssue(issues, test.severity, test.message) {
+			t.Errorf("%s: got %v, want %s %q", test.name, issues, test.severity, test.message)
+		}
+	}
+}
+
+func TestValidateUnreachable(t *testing.T) {
+	tests := []struct {
+		name        string
+		rules       []routerule
+		unreachable bool
+	}{
+		{
+			name: "same prefix",
+			rules: []routerule{
+				{Name: "a", Prefix: "/orders", Backend: "a.example.com"},
+				{Name: "b", Prefix: "/orders/", Backend: "b.example.com"},
+			},
+			unreachable: true,
+		},
+		{
+			name: "same prefix with request matchers",
+			rules: []routerule{
+				{Name: "a", Prefix: "/orders", Methods: []string{"GET"}, Backend: "a.example.com"},
+				{Name: "b", Prefix: "/orders", Backend: "b.example.com"},
+			},
+		},
+		{
+			name: "longer prefix",
+			rules: []routerule{
+				{Name: "a", Prefix: "/orders", Backend: "a.example.com"},
+				{Name: "b", Prefix: "/orders/items", Backend: "b.example.com"},
+			},
+		},
+		{
+			name: "higher priority",
+			rules: []routerule{
+				{Name: "a", Prefix: "/orders", Priority: 1, Backend: "a.example.com"},
+				{Name: "b", Prefix: "/orders/items", Backend: "b.example.com"},
+			},
+			unreachable: true,
+		},
+		{
+			name: "literal after a capture",
+			rules: []routerule{
+				{Name: "a", Prefix: "/t/{id}", Backend: "a.example.com"},
+				{Name: "b", Prefix: "/t/me", Backend: "b.example.com"},
+			},
+		},
+		{
+			name: "same captures",
+			rules: []routerule{
+				{Name: "a", Prefix: "/t/{id}", Backend: "a.example.com"},
+				{Name: "b", Prefix: "/t/{name}", Backend: "b.example.com"},
+			},
+			unreachable: true,
+		},
+		{
+			name: "capture in another segment",
+			rules: []routerule{
+				{Name: "a", Prefix: "/{tenant}/orders", Backend: "a.example.com"},
+				{Name: "b", Prefix: "/acme/{resource}", Backend: "b.example.com"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		loadRules(t, test.rules)
+		issues := issuesOf(test.rules, 1)
+		if got := hasIssue(issues, SeverityWarning, "unreachable"); got != test.unreachable {
+			t.Errorf("%s: got unreachable %v, want %v: %v", test.name, got, test.unreachable, issues)
+		}
+
+		//the warning agrees with the rule picked for the prefix of b
+		path := strings.NewReplacer("{", "", "}", "").Replace(test.rules[1].Prefix)
+		r, _ := GetRoute(&auth.AttributeContext_HttpRequest{Method: "POST", Path: path})
+		if reached := r.Name == "b"; reached == test.unreachable {
+			t.Errorf("%s: %s is routed to %s", test.name, path, r.Name)
+		}
+	}
+}
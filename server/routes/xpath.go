@@ -0,0 +1,214 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routes
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+//xmlNode is an element of a parsed xml body. Names are local, namespaces are ignored
+type xmlNode struct {
+	name     string
+	attrs    map[string]string
+	children []*xmlNode
+	text     strings.Builder
+	content  strings.Builder
+	parent   *xmlNode
+}
+
+//xpathStep is a step of an xpath. It selects child elements, or descendants
+//with //, by name or * and optionally by position. The last step may select
+//an attribute (@name) or the text of the element (text())
+type xpathStep struct {
+	descendant bool
+	name       string
+	position   int
+	attr       string
+	text       bool
+}
+
+//parseXPath reads a subset of XPath 1.0 with absolute location paths:
+//  /order/customer/@tier
+//  /order/items/item[2]/sku
+//  //sku/text()
+func parseXPath(expression string) ([]xpathStep, error) {
+	if !strings.HasPrefix(expression, "/") {
+		return nil, fmt.Errorf("xpath must start with /")
+	}
+
+	var steps []xpathStep
+	rest := expression
+	for rest != "" {
+		step := xpathStep{}
+		if strings.HasPrefix(rest, "//") {
+			step.descendant = true
+			rest = rest[2:]
+		} else {
+			rest = rest[1:]
+		}
+
+		end := strings.IndexByte(rest, '/')
+		if end == -1 {
+			end = len(rest)
+		}
+		part := rest[:end]
+		rest = rest[end:]
+
+		if i := strings.IndexByte(part, '['); i != -1 {
+			if !strings.HasSuffix(part, "]") {
+				return nil, fmt.Errorf("missing ] in %s", part)
+			}
+			position, err := strconv.Atoi(part[i+1 : len(part)-1])
+			if err != nil || position < 1 {
+				return nil, fmt.Errorf("only positions are supported in predicates, got %s", part[i:])
+			}
+			step.position = position
+			part = part[:i]
+		}
+
+		switch {
+		case part == "":
+			return nil, fmt.Errorf("empty step in %s", expression)
+		case part == "text()":
+			step.text = true
+		case strings.HasPrefix(part, "@"):
+			step.attr = localName(part[1:])
+		default:
+			step.name = localName(part)
+		}
+
+		if (step.text || step.attr != "") && (rest != "" || step.position != 0) {
+			return nil, fmt.Errorf("%s must be the last step", part)
+		}
+		steps = append(steps, step)
+	}
+
+	return steps, nil
+}
+
+//localName drops the namespace prefix of a name
+func localName(name string) string {
+	if i := strings.IndexByte(name, ':'); i != -1 {
+		return name[i+1:]
+	}
+	return name
+}
+
+//parseXML returns a document node whose children are the root elements
+func parseXML(body []byte) (*xmlNode, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(body))
+	document := &xmlNode{}
+	current := document
+
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			node := &xmlNode{name: t.Name.Local, attrs: map[string]string{}, parent: current}
+			for _, attr := range t.Attr {
+				node.attrs[attr.Name.Local] = attr.Value
+			}
+			current.children = append(current.children, node)
+			current = node
+		case xml.EndElement:
+			current = current.parent
+		case xml.CharData:
+			current.text.Write(t)
+			for n := current; n != nil; n = n.parent {
+				n.content.Write(t)
+			}
+		}
+	}
+
+	if len(document.children) == 0 {
+		return nil, fmt.Errorf("no root element")
+	}
+	return document, nil
+}
+
+//evalXPath returns the text content of the elements, the attribute values or
+//the text selected by the path
+func evalXPath(document *xmlNode, steps []xpathStep) []string {
+	current := []*xmlNode{document}
+
+	for _, step := range steps {
+		if step.attr != "" || step.text {
+			var values []string
+			for _, node := range current {
+				candidates := []*xmlNode{node}
+				if step.descendant {
+					candidates = descendants(node)
+				}
+				for _, n := range candidates {
+					if step.text {
+						values = append(values, strings.TrimSpace(n.text.String()))
+					} else if value, found := n.attrs[step.attr]; found {
+						values = append(values, value)
+					}
+				}
+			}
+			return values
+		}
+
+		var next []*xmlNode
+		for _, node := range current {
+			var candidates []*xmlNode
+			if step.descendant {
+				candidates = descendants(node)[1:]
+			} else {
+				candidates = node.children
+			}
+
+			position := 0
+			for _, n := range candidates {
+				if step.name != "*" && n.name != step.name {
+					continue
+				}
+				position++
+				if step.position == 0 || step.position == position {
+					next = append(next, n)
+				}
+			}
+		}
+		current = next
+	}
+
+	values := make([]string, 0, len(current))
+	for _, node := range current {
+		values = append(values, strings.TrimSpace(node.content.String()))
+	}
+	return values
+}
+
+//descendants returns the node and every element under it, in document order
+func descendants(node *xmlNode) []*xmlNode {
+	nodes := []*xmlNode{node}
+	for _, child := range node.children {
+		nodes = append(nodes, descendants(child)...)
+	}
+	return nodes
+}
@@ -0,0 +1,267 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package token
+
+import (
+	"context"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+
+	metrics "github.com/srinandan/envoy-router/server/metrics"
+	tracing "github.com/srinandan/envoy-router/server/tracing"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+//refreshAhead is how long before expiry a token is refreshed in the background
+var refreshAhead = 5 * time.Minute
+
+//SetRefreshAhead sets how long before expiry tokens are refreshed. It should be
+//called at startup, before tokens are requested
+func SetRefreshAhead(d time.Duration) {
+	refreshAhead = d
+}
+
+type tokenKind uint8
+
+const (
+	accessTokenKind tokenKind = iota
+	idTokenKind
+)
+
+//cacheKey identifies a token by the credential it was minted with and its scope or audience
+type cacheKey struct {
+	credential string
+	kind       tokenKind
+	target     string
+}
+
+type cachedToken struct {
+	token  string
+	expiry time.Time
+}
+
+//inflight is a token fetch other callers can wait on
+type inflight struct {
+	done  chan struct{}
+	token cachedToken
+	err   error
+}
+
+//failure tracks the consecutive failed fetches of a token until one succeeds
+type failure struct {
+	since time.Time
+	last  time.Time
+	fetch func(context.Context) (cachedToken, error)
+}
+
+type tokenCache struct {
+	tokens   map[cacheKey]cachedToken
+	fetching map[cacheKey]*inflight
+	failures map[cacheKey]*failure
+	sync.Mutex
+}
+
+var cache = tokenCache{
+	tokens:   map[cacheKey]cachedToken{},
+	fetching: map[cacheKey]*inflight{},
+	failures: map[cacheKey]*failure{},
+}
+
+//GetAccessToken returns a cached access token, fetching one if missing or expired
+func GetAccessToken(ctx context.Context) (string, error) {
+	key := cacheKey{credential: serviceAccountPath, kind: accessTokenKind}
+	return cache.get(ctx, key, obtainAccessToken)
+}
+
+//GetIDToken returns a cached OIDC token for the audience, fetching one if missing or expired
+func GetIDToken(ctx context.Context, audience string) (string, error) {
+	key := cacheKey{credential: serviceAccountPath, kind: idTokenKind, target: audience}
+	return cache.get(ctx, key, func(ctx context.Context) (cachedToken, error) {
+		return obtainIDToken(ctx, audience)
+	})
+}
+
+func (c *tokenCache) get(ctx context.Context, key cacheKey, fetch func(context.Context) (cachedToken, error)) (string, error) {
+	c.Lock()
+	t, ok := c.tokens[key]
+	now := time.Now()
+
+	if ok && now.Before(t.expiry) {
+		if now.Add(refreshAhead).After(t.expiry) {
+			//still valid, refresh in the background and serve the current token
+			if _, busy := c.fetching[key]; !busy {
+				c.start(ctx, key, fetch)
+			}
+		}
+		c.Unlock()
+		return t.token, nil
+	}
+
+	//missing or expired, join the in-flight fetch or start one
+	f, busy := c.fetching[key]
+	if !busy {
+		f = c.start(ctx, key, fetch)
+	}
+	c.Unlock()
+
+	token, err := c.wait(ctx, f)
+	return token.token, err
+}
+
+//start registers and launches a fetch for the key, the caller must hold the lock.
+//The fetch is traced in the trace of the caller that started it, but it is
+//shared with the other callers so it isn't cancelled with the caller
+func (c *tokenCache) start(ctx context.Context, key cacheKey, fetch func(context.Context) (cachedToken, error)) *inflight {
+	f := &inflight{done: make(chan struct{})}
+	c.fetching[key] = f
+
+	go func() {
+		ctx, span := tracing.Start(context.WithoutCancel(ctx), "token.fetch", trace.WithSpanKind(trace.SpanKindClient),
+			trace.WithAttributes(tracing.TokenKey.String(key.kind.String()), tracing.AudienceKey.String(key.target)))
+		start := time.Now()
+		f.token, f.err = fetch(ctx)
+		metrics.ObserveTokenFetch(key.kind.String(), time.Since(start), f.err)
+		if f.err != nil {
+			span.RecordError(f.err)
+			span.SetStatus(codes.Error, "token fetch failed")
+		}
+		span.End()
+
+		c.Lock()
+		if f.err == nil {
+			c.tokens[key] = f.token
+			delete(c.failures, key)
+		} else {
+			slog.Error("error refreshing token", "kind", key.kind.String(), "audience", key.target, "error", f.err)
+			if _, failing := c.failures[key]; !failing {
+				c.failures[key] = &failure{since: start}
+			}
+			c.failures[key].last = start
+			c.failures[key].fetch = fetch
+		}
+		delete(c.fetching, key)
+		c.Unlock()
+
+		close(f.done)
+	}()
+
+	return f
+}
+
+//wait returns the result of the fetch, or the error of ctx if it is done first.
+//The fetch goes on for the other callers
+func (c *tokenCache) wait(ctx context.Context, f *inflight) (cachedToken, error) {
+	select {
+	case <-f.done:
+		return f.token, f.err
+	case <-ctx.Done():
+		return cachedToken{}, ctx.Err()
+	}
+}
+
+//FailingSince returns when the oldest token whose last fetch failed started
+//failing, zero if the last fetch of every token succeeded
+func FailingSince() time.Time {
+	cache.Lock()
+	defer cache.Unlock()
+
+	var since time.Time
+	for _, f := range cache.failures {
+		if since.IsZero() || f.since.Before(since) {
+			since = f.since
+		}
+	}
+	return since
+}
+
+//RetryFailed fetches again, in the background, the tokens whose last fetch
+//failed more than interval ago. Failed tokens are otherwise only fetched again
+//when a request needs them
+func RetryFailed(interval time.Duration) {
+	cache.Lock()
+	defer cache.Unlock()
+
+	now := time.Now()
+	for key, f := range cache.failures {
+		if _, busy := cache.fetching[key]; !busy && now.Sub(f.last) >= interval {
+			cache.start(context.Background(), key, f.fetch)
+		}
+	}
+}
+
+//TokenState describes a cached token without the token itself
+type TokenState struct {
+	Credential string    `json:"credential"`
+	Kind       string    `json:"kind"`
+	Audience   string    `json:"audience,omitempty"`
+	Expiry     time.Time `json:"expiry"`
+	Expired    bool      `json:"expired"`
+	Refreshing bool      `json:"refreshing"`
+	//FailingSince is set while the fetches of the token fail
+	FailingSince *time.Time `json:"failingSince,omitempty"`
+}
+
+func (k tokenKind) String() string {
+	if k == idTokenKind {
+		return "id_token"
+	}
+	return "access_token"
+}
+
+//GetTokenStates lists the cached tokens and their expiry, never the tokens
+func GetTokenStates() []TokenState {
+	cache.Lock()
+	defer cache.Unlock()
+
+	now := time.Now()
+	states := make([]TokenState, 0, len(cache.tokens))
+	state := func(key cacheKey, t cachedToken) TokenState {
+		_, refreshing := cache.fetching[key]
+		s := TokenState{
+			Credential: key.credential,
+			Kind:       key.kind.String(),
+			Audience:   key.target,
+			Expiry:     t.expiry,
+			Expired:    !now.Before(t.expiry),
+			Refreshing: refreshing,
+		}
+		if f, failing := cache.failures[key]; failing {
+			since := f.since
+			s.FailingSince = &since
+		}
+		return s
+	}
+
+	for key, t := range cache.tokens {
+		states = append(states, state(key, t))
+	}
+	//tokens that were never fetched successfully
+	for key := range cache.failures {
+		if _, cached := cache.tokens[key]; !cached {
+			states = append(states, state(key, cachedToken{}))
+		}
+	}
+
+	sort.Slice(states, func(i, j int) bool {
+		if states[i].Kind != states[j].Kind {
+			return states[i].Kind < states[j].Kind
+		}
+		return states[i].Audience < states[j].Audience
+	})
+	return states
+}
@@ -0,0 +1,117 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package token
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newCache() *tokenCache {
+	return &tokenCache{
+		tokens:   map[cacheKey]cachedToken{},
+		fetching: map[cacheKey]*inflight{},
+		failures: map[cacheKey]*failure{},
+	}
+}
+
+func TestGetSharesFetches(t *testing.T) {
+	c := newCache()
+	key := cacheKey{credential: "sa.json", kind: idTokenKind, target: "https://backend"}
+
+	var fetches int32
+	release := make(chan struct{})
+	fetch := func(ctx context.Context) (cachedToken, error) {
+		atomic.AddInt32(&fetches, 1)
+		<-release
+		return cachedToken{token: "token", expiry: time.Now().Add(time.Hour)}, nil
+	}
+
+	results := make(chan string, 3)
+	for i := 0; i < 3; i++ {
+		go func() {
+			token, _ := c.get(context.Background(), key, fetch)
+			results <- token
+		}()
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+
+	for i := 0; i < 3; i++ {
+		if token := <-results; token != "token" {
+			t.Errorf("got %q, want token", token)
+		}
+	}
+	if fetches := atomic.LoadInt32(&fetches); fetches != 1 {
+		t.Errorf("got %d fetches, want 1", fetches)
+	}
+}
+
+func TestGetStopsWaitingWhenCancelled(t *testing.T) {
+	c := newCache()
+	key := cacheKey{credential: "sa.json", kind: accessTokenKind}
+
+	release := make(chan struct{})
+	fetched := make(chan struct{})
+	fetch := func(ctx context.Context) (cachedToken, error) {
+		<-release
+		if err := ctx.Err(); err != nil {
+			return cachedToken{}, err
+		}
+		defer close(fetched)
+		return cachedToken{token: "token", expiry: time.Now().Add(time.Hour)}, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := c.get(ctx, key, fetch); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	//the fetch is not cancelled with the caller that started it
+	close(release)
+	<-fetched
+	token, err := c.get(context.Background(), key, fetch)
+	if err != nil || token != "token" {
+		t.Errorf("got %q, %v, want token", token, err)
+	}
+}
+
+func TestGetRecordsFailures(t *testing.T) {
+	c := newCache()
+	key := cacheKey{credential: "sa.json", kind: accessTokenKind}
+
+	failed := errors.New("token endpoint unavailable")
+	if _, err := c.get(context.Background(), key, func(context.Context) (cachedToken, error) {
+		return cachedToken{}, failed
+	}); !errors.Is(err, failed) {
+		t.Fatalf("got %v, want %v", err, failed)
+	}
+	if _, failing := c.failures[key]; !failing {
+		t.Error("the failure is not recorded")
+	}
+
+	if _, err := c.get(context.Background(), key, func(context.Context) (cachedToken, error) {
+		return cachedToken{token: "token", expiry: time.Now().Add(time.Hour)}, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, failing := c.failures[key]; failing {
+		t.Error("the failure is not cleared")
+	}
+}
@@ -15,13 +15,14 @@
 package token
 
 import (
+	"context"
 	"crypto/x509"
 	"encoding/json"
 	"encoding/pem"
 	"errors"
 	"fmt"
 	"io/ioutil"
-	"log"
+	"log/slog"
 	"net/http"
 	"net/url"
 	"reflect"
@@ -32,8 +33,6 @@ import (
 
 	"github.com/lestrrat-go/jwx/v2/jwa"
 	"github.com/lestrrat-go/jwx/v2/jwt"
-
-	common "github.com/srinandan/sample-apps/common"
 )
 
 type serviceAccount struct {
@@ -49,15 +48,27 @@ type serviceAccount struct {
 	ClientCertURL       string `json:"client_x509_cert_url,omitempty"`
 }
 
-type AccessToken struct {
-	token string
-	sync.Mutex
-}
-
 var account = serviceAccount{}
 
+//accountLock guards the service account read from disk
+var accountLock sync.RWMutex
+
 const tokenUri = "https://www.googleapis.com/oauth2/v4/token"
 
+//idTokenUri is the endpoint that exchanges a signed assertion for a Google ID token
+const idTokenUri = "https://oauth2.googleapis.com/token"
+
+//tokenLifetime is the validity requested for the signed assertion
+const tokenLifetime = 60 * time.Minute
+
+//defaultExpiry is the lifetime assumed for tokens returned without an expiry
+const defaultExpiry = 10 * time.Minute
+
+//fetchTimeout bounds a call to a token endpoint
+const fetchTimeout = 10 * time.Second
+
+var httpClient = &http.Client{Timeout: fetchTimeout}
+
 var serviceAccountPath string
 
 func getPrivateKey(privateKey string) (interface{}, error) {
@@ -68,15 +79,12 @@ func getPrivateKey(privateKey string) (interface{}, error) {
 	}
 	privKey, err := x509.ParsePKCS8PrivateKey(block.Bytes)
 	if err != nil {
-		common.Error.Println("error parsing Private Key: ", err)
-		return nil, err
+		return nil, fmt.Errorf("error parsing private key: %v", err)
 	}
 	return privKey, nil
 }
 
-func generateJWT(privateKey string) (string, error) {
-
-	const scope = "https://www.googleapis.com/auth/cloud-platform"
+func generateJWT(privateKey string, aud string, claims map[string]interface{}) (string, error) {
 
 	privKey, err := getPrivateKey(privateKey)
 
@@ -90,26 +98,25 @@ func generateJWT(privateKey string) (string, error) {
 	//Google OAuth takes aud as a string, not array
 	jwt.Settings(jwt.WithFlattenAudience(true))
 
-	_ = token.Set("aud", tokenUri)
+	_ = token.Set("aud", aud)
 	_ = token.Set(jwt.IssuerKey, getServiceAccountProperty("ClientEmail"))
-	_ = token.Set("scope", scope)
 	_ = token.Set(jwt.IssuedAtKey, now.Unix())
-	_ = token.Set(jwt.ExpirationKey, now.Unix())
+	_ = token.Set(jwt.ExpirationKey, now.Add(tokenLifetime).Unix())
+	for k, v := range claims {
+		_ = token.Set(k, v)
+	}
 
 	payload, err := jwt.Sign(token, jwt.WithKey(jwa.RS256, privKey))
 	if err != nil {
-		common.Error.Println("error parsing Private Key: ", err)
-		return "", err
+		return "", fmt.Errorf("error signing the assertion: %v", err)
 	}
-	common.Info.Println("jwt token : ", string(payload))
 	return string(payload), nil
 }
 
 //generateAccessToken generates a Google OAuth access token from a service account
-func generateAccessToken(privateKey string) (string, error) {
+func generateAccessToken(ctx context.Context, privateKey string) (cachedToken, error) {
 
-	const grantType = "urn:ietf:params:oauth:grant-type:jwt-bearer"
-	var respBody []byte
+	const scope = "https://www.googleapis.com/auth/cloud-platform"
 
 	//oAuthAccessToken is a structure to hold OAuth response
 	type oAuthAccessToken struct {
@@ -118,30 +125,101 @@ func generateAccessToken(privateKey string) (string, error) {
 		TokenType   string `json:"token_type,omitempty"`
 	}
 
-	token, err := generateJWT(privateKey)
+	token, err := generateJWT(privateKey, tokenUri, map[string]interface{}{"scope": scope})
 
 	if err != nil {
-		return "", err
+		return cachedToken{}, err
+	}
+
+	respBody, err := exchangeAssertion(ctx, tokenUri, token)
+	if err != nil {
+		return cachedToken{}, err
+	}
+
+	accessToken := oAuthAccessToken{}
+	if err = json.Unmarshal(respBody, &accessToken); err != nil {
+		return cachedToken{}, err
+	}
+
+	if accessToken.AccessToken == "" {
+		return cachedToken{}, fmt.Errorf("access_token missing in response")
+	}
+
+	lifetime := time.Duration(accessToken.ExpiresIn) * time.Second
+	if lifetime <= 0 {
+		lifetime = defaultExpiry
+	}
+	return cachedToken{
+		token:  accessToken.AccessToken,
+		expiry: time.Now().Add(lifetime),
+	}, nil
+}
+
+//generateIDToken generates a Google signed OIDC token for the audience from a service account
+func generateIDToken(ctx context.Context, privateKey string, audience string) (cachedToken, error) {
+
+	//oAuthIDToken is a structure to hold the OIDC response
+	type oAuthIDToken struct {
+		IDToken string `json:"id_token,omitempty"`
+	}
+
+	token, err := generateJWT(privateKey, idTokenUri, map[string]interface{}{"target_audience": audience})
+
+	if err != nil {
+		return cachedToken{}, err
+	}
+
+	respBody, err := exchangeAssertion(ctx, idTokenUri, token)
+	if err != nil {
+		return cachedToken{}, err
+	}
+
+	idToken := oAuthIDToken{}
+	if err = json.Unmarshal(respBody, &idToken); err != nil {
+		return cachedToken{}, err
+	}
+
+	if idToken.IDToken == "" {
+		return cachedToken{}, fmt.Errorf("id_token missing in response")
+	}
+
+	//the token endpoint does not return expires_in for id tokens, read it from the token
+	parsed, err := jwt.ParseString(idToken.IDToken, jwt.WithVerify(false), jwt.WithValidate(false))
+	if err != nil {
+		return cachedToken{}, fmt.Errorf("unable to parse id token: %v", err)
+	}
+
+	expiry := parsed.Expiration()
+	if expiry.IsZero() {
+		expiry = time.Now().Add(defaultExpiry)
 	}
+	return cachedToken{
+		token:  idToken.IDToken,
+		expiry: expiry,
+	}, nil
+}
+
+//exchangeAssertion posts a signed JWT to a Google token endpoint and returns the response body
+func exchangeAssertion(ctx context.Context, endpoint string, assertion string) ([]byte, error) {
+
+	const grantType = "urn:ietf:params:oauth:grant-type:jwt-bearer"
+	var respBody []byte
 
 	form := url.Values{}
 	form.Add("grant_type", grantType)
-	form.Add("assertion", token)
+	form.Add("assertion", assertion)
 
-	client := &http.Client{}
-	req, err := http.NewRequest("POST", tokenUri, strings.NewReader(form.Encode()))
+	req, err := http.NewRequestWithContext(ctx, "POST", endpoint, strings.NewReader(form.Encode()))
 	if err != nil {
-		common.Error.Println("error in client: ", err)
-		return "", err
+		return nil, err
 	}
 	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
 	req.Header.Add("Content-Length", strconv.Itoa(len(form.Encode())))
 
-	resp, err := client.Do(req)
+	resp, err := httpClient.Do(req)
 
 	if err != nil {
-		common.Error.Println("failed to generate oauth token: ", err)
-		return "", err
+		return nil, fmt.Errorf("failed to generate oauth token: %v", err)
 	}
 
 	if resp != nil {
@@ -149,29 +227,20 @@ func generateAccessToken(privateKey string) (string, error) {
 	}
 
 	if resp == nil {
-		common.Error.Println("error in response: Response was null")
-		return "", errors.New("error in response: Response was null")
+		return nil, errors.New("error in response: Response was null")
 	}
 
 	respBody, err = ioutil.ReadAll(resp.Body)
-	common.Info.Printf("Response: %s\n", string(respBody))
+	slog.Debug("token endpoint response", "endpoint", endpoint, "status", resp.StatusCode)
 
 	if err != nil {
-		common.Error.Println("error in response: ", err)
-		return "", fmt.Errorf("error in response: %v", err)
+		return nil, fmt.Errorf("error in response: %v", err)
 	} else if resp.StatusCode > 399 {
-		common.Error.Printf("status code %d, error in response: %s\n", resp.StatusCode, string(respBody))
-		return "", fmt.Errorf("status code %d, error in response: %s\n", resp.StatusCode, string(respBody))
+		//error responses carry an error code and description, never a token
+		return nil, fmt.Errorf("status code %d, error in response: %s", resp.StatusCode, string(respBody))
 	}
 
-	accessToken := oAuthAccessToken{}
-	if err = json.Unmarshal(respBody, &accessToken); err != nil {
-		return "", err
-	}
-
-	common.Info.Println("access token object: ", accessToken)
-
-	return accessToken.AccessToken, nil
+	return respBody, nil
 }
 
 func readServiceAccount() error {
@@ -180,6 +249,9 @@ func readServiceAccount() error {
 		return err
 	}
 
+	accountLock.Lock()
+	defer accountLock.Unlock()
+	account = serviceAccount{}
 	err = json.Unmarshal(content, &account)
 	if err != nil {
 		return err
@@ -188,100 +260,67 @@ func readServiceAccount() error {
 }
 
 func getServiceAccountProperty(key string) (value string) {
+	accountLock.RLock()
+	defer accountLock.RUnlock()
 	r := reflect.ValueOf(&account)
 	field := reflect.Indirect(r).FieldByName(key)
 	return field.String()
 }
 
-func checkAccessToken() bool {
+func SetServiceAccountFilePath(saFile string) {
+	serviceAccountPath = saFile
+}
 
-	const tokenInfo = "https://oauth2.googleapis.com/tokeninfo"
+//GetServiceAccountFilePath returns the service account used to sign assertions
+func GetServiceAccountFilePath() string {
+	return serviceAccountPath
+}
 
-	a := AccessToken{}
+//obtainAccessToken will generate a new access token
+func obtainAccessToken(ctx context.Context) (token cachedToken, err error) {
 
-	u, _ := url.Parse(tokenInfo)
-	q := u.Query()
-	q.Set("access_token", a.GetAccessToken())
-	u.RawQuery = q.Encode()
+	privateKey, err := loadPrivateKey()
+	if err != nil {
+		return token, err
+	}
+	if token, err = generateAccessToken(ctx, privateKey); err != nil {
+		return token, fmt.Errorf("fatal error generating access token: %s", err)
+	}
 
-	client := &http.Client{}
+	return token, nil
+}
 
-	log.Println("Connecting to : ", u.String())
-	req, err := http.NewRequest("GET", u.String(), nil)
-	if err != nil {
-		log.Println("error in client:", err)
-		return false
+//obtainIDToken will generate a new OIDC token for the audience
+func obtainIDToken(ctx context.Context, audience string) (token cachedToken, err error) {
+
+	if audience == "" {
+		return token, fmt.Errorf("audience is required to generate an id token")
 	}
 
-	resp, err := client.Do(req)
+	privateKey, err := loadPrivateKey()
 	if err != nil {
-		common.Error.Println("error connecting to token endpoint: ", err)
-		return false
+		return token, err
+	}
+	if token, err = generateIDToken(ctx, privateKey, audience); err != nil {
+		return token, fmt.Errorf("fatal error generating id token: %s", err)
 	}
-	defer resp.Body.Close()
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		common.Error.Println("token info error: ", err)
-		return false
-	} else if resp.StatusCode != 200 {
-		common.Error.Println("token expired: ", string(body))
-		return false
-	}
-	common.Info.Println("Response: ", string(body))
-	common.Info.Println("Reusing the cached token: ", a.GetAccessToken())
-	return true
-}
-
-func SetServiceAccountFilePath(saFile string) {
-	serviceAccountPath = saFile
-}
 
-func (a *AccessToken) GetAccessToken() string {
-	return a.token
+	return token, nil
 }
 
-//ObtainAccessToken will generate a new one
-func (a *AccessToken) ObtainAccessToken() (err error) {
-
-	var token string
+//loadPrivateKey reads the service account and returns the private key
+func loadPrivateKey() (string, error) {
 
-	if err = readServiceAccount(); err != nil { // Handle errors reading the config file
-		return fmt.Errorf("error reading SA file: %s", err)
+	if err := readServiceAccount(); err != nil { // Handle errors reading the config file
+		return "", fmt.Errorf("error reading SA file: %s", err)
 	}
 
 	privateKey := getServiceAccountProperty("PrivateKey")
 	if privateKey == "" {
-		return fmt.Errorf("private key missing in the service account")
+		return "", fmt.Errorf("private key missing in the service account")
 	}
 	if getServiceAccountProperty("ClientEmail") == "" {
-		return fmt.Errorf("client email missing in the service account")
+		return "", fmt.Errorf("client email missing in the service account")
 	}
-	if token, err = generateAccessToken(privateKey); err != nil {
-		return fmt.Errorf("fatal error generating access token: %s", err)
-	}
-
-	a.Lock()
-	defer a.Unlock()
-	a.token = token
-	return nil
-}
-
-func Every(duration time.Duration, work func(time.Time) bool) chan bool {
-	ticker := time.NewTicker(duration)
-	stop := make(chan bool, 1)
-
-	go func() {
-		for {
-			select {
-			case time := <-ticker.C:
-				if !work(time) {
-					stop <- true
-				}
-			case <-stop:
-				return
-			}
-		}
-	}()
-
-	return stop
+	return privateKey, nil
 }
@@ -0,0 +1,103 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tracing
+
+import (
+	"context"
+	"fmt"
+
+	"go.opentelemetry.io/contrib/propagators/b3"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.10.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const instrumentationName = "github.com/srinandan/envoy-router/server"
+
+const serviceName = "envoy-router"
+
+//span attributes
+const (
+	RouteKey    = attribute.Key("envoy_router.route")
+	BackendKey  = attribute.Key("envoy_router.backend")
+	DecisionKey = attribute.Key("envoy_router.decision")
+	PhaseKey    = attribute.Key("envoy_router.ext_proc.phase")
+	TokenKey    = attribute.Key("envoy_router.token.kind")
+	AudienceKey = attribute.Key("envoy_router.token.audience")
+)
+
+//Options configures the exporter
+type Options struct {
+	//Endpoint is the host:port of an OTLP gRPC collector. Spans are not
+	//exported when empty
+	Endpoint string
+	//Insecure sends spans without TLS, for a collector on the same host or pod
+	Insecure bool
+	//SampleRatio is the share of traces sampled when the caller did not decide
+	SampleRatio float64
+}
+
+//propagator reads W3C trace context and B3, single or multi header, as set by envoy
+var propagator = propagation.NewCompositeTextMapPropagator(
+	propagation.TraceContext{},
+	propagation.Baggage{},
+	b3.New(),
+)
+
+//Init installs the tracer provider. The returned function flushes and stops
+//the exporter
+func Init(ctx context.Context, o Options) (shutdown func(context.Context) error, err error) {
+	otel.SetTextMapPropagator(propagator)
+
+	if o.Endpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	options := []otlptracegrpc.Option{otlptracegrpc.WithEndpoint(o.Endpoint)}
+	if o.Insecure {
+		options = append(options, otlptracegrpc.WithInsecure())
+	}
+
+	exporter, err := otlptracegrpc.New(ctx, options...)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create the otlp exporter: %v", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(o.SampleRatio))),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL,
+			semconv.ServiceNameKey.String(serviceName))),
+	)
+	otel.SetTracerProvider(provider)
+
+	return provider.Shutdown, nil
+}
+
+//Start starts a span with the global tracer provider
+func Start(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	return otel.Tracer(instrumentationName).Start(ctx, name, opts...)
+}
+
+//Extract returns a context parented to the trace context in the request
+//headers. Header names are lower case, as sent by envoy
+func Extract(ctx context.Context, headers map[string]string) context.Context {
+	return propagator.Extract(ctx, propagation.MapCarrier(headers))
+}
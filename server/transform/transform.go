@@ -0,0 +1,330 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transform
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+const jsonContentType = "application/json"
+
+//Transform changes a request or response body. Fields are addressed with dot
+//separated paths, ex: customer.address.city or items.0.sku. The steps run in
+//this order: unwrap, rename, remove, set, wrap, then template
+type Transform struct {
+	//Unwrap replaces the body with the value at the path, ex: data
+	Unwrap string `json:"unwrap,omitempty"`
+	//Rename moves fields, from path to path
+	Rename map[string]string `json:"rename,omitempty"`
+	//Remove deletes fields
+	Remove []string `json:"remove,omitempty"`
+	//Set adds or replaces fields with JSON values, missing objects are created
+	Set map[string]interface{} `json:"set,omitempty"`
+	//Wrap replaces the body with an object holding it in the member, ex: data
+	Wrap string `json:"wrap,omitempty"`
+	//Template is a Go text/template rendered with a Context, its output is the body
+	Template string `json:"template,omitempty"`
+	//ContentType is the content type of the body rendered by Template
+	ContentType string `json:"contentType,omitempty"`
+	template    *template.Template
+}
+
+//Context is the data Template is rendered with
+type Context struct {
+	//Body is the decoded JSON body after the other steps, nil if the body is not JSON
+	Body interface{}
+	//Raw is the body as received
+	Raw string
+	//Attributes of the request, ex: route, method, path, request_id
+	Attributes map[string]string
+	//Headers of the request, names are lower case
+	Headers map[string]string
+}
+
+var funcs = template.FuncMap{
+	//json writes a value as JSON, ex: {{ json .Body.items }}
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}
+
+//Compile parses the template and checks paths
+func (t *Transform) Compile() error {
+	paths := append([]string{}, t.Remove...)
+	for from, to := range t.Rename {
+		paths = append(paths, from, to)
+	}
+	for path := range t.Set {
+		paths = append(paths, path)
+	}
+	if t.Unwrap != "" {
+		paths = append(paths, t.Unwrap)
+	}
+	for _, path := range paths {
+		for _, segment := range strings.Split(path, ".") {
+			if segment == "" {
+				return fmt.Errorf("invalid path %q", path)
+			}
+		}
+	}
+	if strings.Contains(t.Wrap, ".") {
+		return fmt.Errorf("wrap must be a member name, not a path: %s", t.Wrap)
+	}
+
+	if !t.hasJSONSteps() && t.Template == "" {
+		return fmt.Errorf("transform is empty")
+	}
+
+	t.template = nil
+	if t.Template != "" {
+		tmpl, err := template.New("body").Funcs(funcs).Option("missingkey=zero").Parse(t.Template)
+		if err != nil {
+			return fmt.Errorf("template: %v", err)
+		}
+		t.template = tmpl
+	} else if t.ContentType != "" {
+		return fmt.Errorf("contentType is only used with template")
+	}
+	return nil
+}
+
+//hasJSONSteps returns true if the transform decodes the body as JSON
+func (t *Transform) hasJSONSteps() bool {
+	return t.Unwrap != "" || len(t.Rename) > 0 || len(t.Remove) > 0 || len(t.Set) > 0 || t.Wrap != ""
+}
+
+//Apply transforms the body. It returns the new body and its content type. The
+//body is left unchanged when an error is returned, or when there is nothing to
+//transform
+func (t *Transform) Apply(body []byte, contentType string, attributes map[string]string, headers map[string]string) ([]byte, string, error) {
+	if !t.hasJSONSteps() && t.template == nil {
+		return body, contentType, nil
+	}
+
+	var doc interface{}
+	isJSON := false
+	if len(bytes.TrimSpace(body)) > 0 {
+		decoder := json.NewDecoder(bytes.NewReader(body))
+		decoder.UseNumber()
+		isJSON = decoder.Decode(&doc) == nil
+	}
+
+	if t.hasJSONSteps() {
+		if len(bytes.TrimSpace(body)) > 0 && !isJSON {
+			return body, contentType, fmt.Errorf("body is not JSON")
+		}
+		var err error
+		if doc, err = t.applyJSON(doc); err != nil {
+			return body, contentType, err
+		}
+		isJSON = true
+	}
+
+	if t.template != nil {
+		var out bytes.Buffer
+		data := Context{Raw: string(body), Attributes: attributes, Headers: headers}
+		if isJSON {
+			data.Body = doc
+		}
+		if err := t.template.Execute(&out, data); err != nil {
+			return body, contentType, fmt.Errorf("template: %v", err)
+		}
+		if t.ContentType != "" {
+			contentType = t.ContentType
+		}
+		return out.Bytes(), contentType, nil
+	}
+
+	if doc == nil && len(bytes.TrimSpace(body)) == 0 {
+		//nothing was set in an empty body
+		return body, contentType, nil
+	}
+	transformed, err := json.Marshal(doc)
+	if err != nil {
+		return body, contentType, err
+	}
+	if contentType == "" {
+		contentType = jsonContentType
+	}
+	return transformed, contentType, nil
+}
+
+func (t *Transform) applyJSON(doc interface{}) (interface{}, error) {
+	if t.Unwrap != "" {
+		value, found := get(doc, split(t.Unwrap))
+		if !found {
+			return nil, fmt.Errorf("unwrap: %s not found", t.Unwrap)
+		}
+		doc = value
+	}
+
+	for _, from := range sortedKeys(t.Rename) {
+		if value, found := get(doc, split(from)); found {
+			remove(doc, split(from))
+			var err error
+			if doc, err = set(doc, split(t.Rename[from]), value); err != nil {
+				return nil, fmt.Errorf("rename %s: %v", from, err)
+			}
+		}
+	}
+
+	for _, path := range t.Remove {
+		remove(doc, split(path))
+	}
+
+	paths := make([]string, 0, len(t.Set))
+	for path := range t.Set {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		var err error
+		//the value is shared by the requests, the document owns a copy
+		if doc, err = set(doc, split(path), clone(t.Set[path])); err != nil {
+			return nil, fmt.Errorf("set %s: %v", path, err)
+		}
+	}
+
+	if t.Wrap != "" {
+		doc = map[string]interface{}{t.Wrap: doc}
+	}
+	return doc, nil
+}
+
+func split(path string) []string {
+	return strings.Split(path, ".")
+}
+
+//get returns the value at the path. Numeric segments index arrays
+func get(doc interface{}, path []string) (interface{}, bool) {
+	for _, segment := range path {
+		switch node := doc.(type) {
+		case map[string]interface{}:
+			value, found := node[segment]
+			if !found {
+				return nil, false
+			}
+			doc = value
+		case []interface{}:
+			i, err := strconv.Atoi(segment)
+			if err != nil || i < 0 || i >= len(node) {
+				return nil, false
+			}
+			doc = node[i]
+		default:
+			return nil, false
+		}
+	}
+	return doc, true
+}
+
+//clone returns a deep copy of a decoded JSON value
+func clone(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		copied := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			copied[key] = clone(item)
+		}
+		return copied
+	case []interface{}:
+		copied := make([]interface{}, len(v))
+		for i, item := range v {
+			copied[i] = clone(item)
+		}
+		return copied
+	}
+	return value
+}
+
+//remove deletes the member or array element at the path, if present
+func remove(doc interface{}, path []string) {
+	parent, found := get(doc, path[:len(path)-1])
+	if !found {
+		return
+	}
+	last := path[len(path)-1]
+	switch node := parent.(type) {
+	case map[string]interface{}:
+		delete(node, last)
+	case []interface{}:
+		//arrays can't shrink in place, the element is set to null
+		if i, err := strconv.Atoi(last); err == nil && i >= 0 && i < len(node) {
+			node[i] = nil
+		}
+	}
+}
+
+//set sets the value at the path, creating missing objects. It returns the
+//document, which is created when nil
+func set(doc interface{}, path []string, value interface{}) (interface{}, error) {
+	if doc == nil {
+		doc = map[string]interface{}{}
+	}
+	node := doc
+	for i, segment := range path {
+		last := i == len(path)-1
+		switch current := node.(type) {
+		case map[string]interface{}:
+			if last {
+				current[segment] = value
+				return doc, nil
+			}
+			child, found := current[segment]
+			if !found || child == nil {
+				child = map[string]interface{}{}
+				current[segment] = child
+			}
+			node = child
+		case []interface{}:
+			index, err := strconv.Atoi(segment)
+			if err != nil || index < 0 || index >= len(current) {
+				return doc, fmt.Errorf("%s is not an index of %s", segment, name(path[:i]))
+			}
+			if last {
+				current[index] = value
+				return doc, nil
+			}
+			node = current[index]
+		default:
+			return doc, fmt.Errorf("%s is not an object", name(path[:i]))
+		}
+	}
+	return doc, nil
+}
+
+//name names the value at the path in errors
+func name(path []string) string {
+	if len(path) == 0 {
+		return "body"
+	}
+	return strings.Join(path, ".")
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,265 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transform
+
+import (
+	"encoding/json"
+	"sync"
+	"testing"
+)
+
+func TestApply(t *testing.T) {
+	tests := []struct {
+		name      string
+		transform Transform
+		body      string
+		want      string
+		wantErr   bool
+	}{
+		{
+			name:      "unwrap",
+			transform: Transform{Unwrap: "data"},
+			body:      `{"data": {"id": 1}, "meta": {}}`,
+			want:      `{"id":1}`,
+		},
+		{
+			name:      "unwrap array element",
+			transform: Transform{Unwrap: "items.1"},
+			body:      `{"items": [{"sku": "a"}, {"sku": "b"}]}`,
+			want:      `{"sku":"b"}`,
+		},
+		{
+			name:      "unwrap missing",
+			transform: Transform{Unwrap: "data"},
+			body:      `{"result": 1}`,
+			wantErr:   true,
+		},
+		{
+			name:      "rename",
+			transform: Transform{Rename: map[string]string{"name": "customer.fullName"}},
+			body:      `{"name": "Ada", "id": 1}`,
+			want:      `{"customer":{"fullName":"Ada"},"id":1}`,
+		},
+		{
+			name:      "rename missing",
+			transform: Transform{Rename: map[string]string{"name": "fullName"}},
+			body:      `{"id": 1}`,
+			want:      `{"id":1}`,
+		},
+		{
+			name:      "rename into a scalar",
+			transform: Transform{Rename: map[string]string{"name": "id.name"}},
+			body:      `{"name": "Ada", "id": 1}`,
+			wantErr:   true,
+		},
+		{
+			name:      "remove",
+			transform: Transform{Remove: []string{"debug", "customer.ssn", "missing.field"}},
+			body:      `{"debug": true, "customer": {"ssn": "x", "id": 1}}`,
+			want:      `{"customer":{"id":1}}`,
+		},
+		{
+			name:      "remove array element",
+			transform: Transform{Remove: []string{"items.0"}},
+			body:      `{"items": [1, 2]}`,
+			want:      `{"items":[null,2]}`,
+		},
+		{
+			name:      "set",
+			transform: Transform{Set: map[string]interface{}{"customer.source": "edge", "version": 2.0}},
+			body:      `{"customer": {"id": 1}}`,
+			want:      `{"customer":{"id":1,"source":"edge"},"version":2}`,
+		},
+		{
+			name:      "set array element",
+			transform: Transform{Set: map[string]interface{}{"items.1.sku": "c"}},
+			body:      `{"items": [{"sku": "a"}, {"sku": "b"}]}`,
+			want:      `{"items":[{"sku":"a"},{"sku":"c"}]}`,
+		},
+		{
+			name:      "set out of range",
+			transform: Transform{Set: map[string]interface{}{"items.5": "c"}},
+			body:      `{"items": []}`,
+			wantErr:   true,
+		},
+		{
+			name:      "set in an empty body",
+			transform: Transform{Set: map[string]interface{}{"source": "edge"}},
+			body:      ``,
+			want:      `{"source":"edge"}`,
+		},
+		{
+			name:      "wrap",
+			transform: Transform{Wrap: "data"},
+			body:      `{"id": 1}`,
+			want:      `{"data":{"id":1}}`,
+		},
+		{
+			name:      "wrap array",
+			transform: Transform{Wrap: "items"},
+			body:      `[1, 2]`,
+			want:      `{"items":[1,2]}`,
+		},
+		{
+			name: "steps in order",
+			transform: Transform{
+				Unwrap: "result",
+				Rename: map[string]string{"name": "fullName"},
+				Remove: []string{"internal"},
+				Set:    map[string]interface{}{"source": "edge"},
+				Wrap:   "data",
+			},
+			body: `{"result": {"name": "Ada", "internal": 1}}`,
+			want: `{"data":{"fullName":"Ada","source":"edge"}}`,
+		},
+		{
+			name:      "large numbers are kept",
+			transform: Transform{Remove: []string{"debug"}},
+			body:      `{"id": 12345678901234567890, "debug": 1}`,
+			want:      `{"id":12345678901234567890}`,
+		},
+		{
+			name:      "not JSON",
+			transform: Transform{Remove: []string{"debug"}},
+			body:      `id=1&debug=true`,
+			want:      `id=1&debug=true`,
+			wantErr:   true,
+		},
+		{
+			name:      "empty body",
+			transform: Transform{Remove: []string{"debug"}},
+			body:      ``,
+			want:      ``,
+		},
+		{
+			name:      "template",
+			transform: Transform{Unwrap: "result", Template: `{"id": {{ json .Body.id }}, "route": "{{ .Attributes.route }}"}`},
+			body:      `{"result": {"id": 7}}`,
+			want:      `{"id": 7, "route": "orders"}`,
+		},
+		{
+			name:      "template of a body that is not JSON",
+			transform: Transform{Template: `{{ .Raw }} {{ .Body }}`},
+			body:      `plain`,
+			want:      `plain <no value>`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := test.transform.Compile(); err != nil {
+				t.Fatal(err)
+			}
+			got, _, err := test.transform.Apply([]byte(test.body), "", map[string]string{"route": "orders"}, nil)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("got error %v, want error %v", err, test.wantErr)
+			}
+			if err != nil {
+				if string(got) != test.body {
+					t.Errorf("the body changed on error: %s", got)
+				}
+				return
+			}
+			if string(got) != test.want {
+				t.Errorf("got %s, want %s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestApplyContentType(t *testing.T) {
+	tests := []struct {
+		transform   Transform
+		contentType string
+		want        string
+	}{
+		{Transform{Wrap: "data"}, "", jsonContentType},
+		{Transform{Wrap: "data"}, "application/vnd.api+json", "application/vnd.api+json"},
+		{Transform{Template: "<id/>", ContentType: "application/xml"}, jsonContentType, "application/xml"},
+		{Transform{Template: "{}"}, "application/problem+json", "application/problem+json"},
+	}
+	for _, test := range tests {
+		if err := test.transform.Compile(); err != nil {
+			t.Fatal(err)
+		}
+		_, got, err := test.transform.Apply([]byte(`{"id": 1}`), test.contentType, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != test.want {
+			t.Errorf("%+v: got %s, want %s", test.transform, got, test.want)
+		}
+	}
+}
+
+func TestCompile(t *testing.T) {
+	tests := []struct {
+		name      string
+		transform Transform
+		wantErr   bool
+	}{
+		{"empty", Transform{}, true},
+		{"empty steps", Transform{Rename: map[string]string{}, Remove: []string{}}, true},
+		{"remove", Transform{Remove: []string{"a.b"}}, false},
+		{"empty segment", Transform{Remove: []string{"a..b"}}, true},
+		{"rename to empty path", Transform{Rename: map[string]string{"a": ""}}, true},
+		{"set empty path", Transform{Set: map[string]interface{}{"": 1}}, true},
+		{"wrap path", Transform{Wrap: "a.b"}, true},
+		{"invalid template", Transform{Template: "{{ .Body"}, true},
+		{"content type without template", Transform{Wrap: "data", ContentType: "application/xml"}, true},
+		{"template", Transform{Template: "{{ json .Body }}", ContentType: "application/json"}, false},
+	}
+	for _, test := range tests {
+		if err := test.transform.Compile(); (err != nil) != test.wantErr {
+			t.Errorf("%s: got error %v, want error %v", test.name, err, test.wantErr)
+		}
+	}
+}
+
+//TestApplyConcurrently sets members of an object set by the same transform in
+//concurrent requests, which must not share the configured value
+func TestApplyConcurrently(t *testing.T) {
+	var transform Transform
+	if err := json.Unmarshal([]byte(`{"set": {"meta": {"source": "edge"}, "meta.id": 1}}`), &transform); err != nil {
+		t.Fatal(err)
+	}
+	if err := transform.Compile(); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				body, _, err := transform.Apply([]byte(`{"id": 1}`), "", nil, nil)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if string(body) != `{"id":1,"meta":{"id":1,"source":"edge"}}` {
+					t.Errorf("got %s", body)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if meta := transform.Set["meta"].(map[string]interface{}); len(meta) != 1 {
+		t.Errorf("the configured value changed: %v", meta)
+	}
+}
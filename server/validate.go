@@ -0,0 +1,53 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	config "github.com/srinandan/envoy-router/server/config"
+	routes "github.com/srinandan/envoy-router/server/routes"
+)
+
+//validate implements the validate subcommand. It reports every issue in the
+//routing table and returns a non-zero exit code if any of them is an error
+func validate(args []string) int {
+	var routeFile string
+	var strict bool
+
+	fs := flag.NewFlagSet("validate", flag.ExitOnError)
+	fs.StringVar(&routeFile, "routes", config.Default().Routes, "A file containing routes")
+	fs.BoolVar(&strict, "strict", false, "Treat warnings as errors")
+	_ = fs.Parse(args)
+
+	issues, err := routes.ValidateRoutesFile(routeFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	for _, issue := range issues {
+		fmt.Println(issue)
+	}
+
+	if routes.HasErrors(issues) || (strict && len(issues) > 0) {
+		return 1
+	}
+
+	fmt.Printf("%s: ok, %d issue(s)\n", routeFile, len(issues))
+	return 0
+}
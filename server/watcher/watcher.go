@@ -0,0 +1,94 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package watcher
+
+import (
+	"log/slog"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+//settle is how long to wait for a burst of file events to finish before reloading
+const settle = 500 * time.Millisecond
+
+//Watch calls onChange when the file is written, created or replaced. The parent
+//directory is watched so Kubernetes ConfigMap updates, which swap a symlink
+//(..data) rather than writing the file, are also detected
+func Watch(file string, onChange func()) (stop func(), err error) {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	dir := filepath.Dir(file)
+	if err = w.Add(dir); err != nil {
+		w.Close()
+		return nil, err
+	}
+
+	done := make(chan struct{})
+
+	go func() {
+		var timer *time.Timer
+		for {
+			select {
+			case event, ok := <-w.Events:
+				if !ok {
+					return
+				}
+				if !relevant(event, file) {
+					continue
+				}
+				if timer != nil {
+					timer.Stop()
+				}
+				timer = time.AfterFunc(settle, onChange)
+			case err, ok := <-w.Errors:
+				if !ok {
+					return
+				}
+				slog.Error("error watching file", "file", file, "error", err)
+			case <-done:
+				if timer != nil {
+					timer.Stop()
+				}
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		w.Close()
+	}, nil
+}
+
+//relevant returns true if the event touches the file, the file it links to or a
+//Kubernetes ConfigMap data directory
+func relevant(event fsnotify.Event, file string) bool {
+	if event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Remove|fsnotify.Rename) == 0 {
+		return false
+	}
+
+	target, _ := filepath.EvalSymlinks(file)
+	name := filepath.Clean(event.Name)
+	if name == filepath.Clean(file) || name == filepath.Clean(target) {
+		return true
+	}
+
+	return filepath.Base(name) == "..data"
+}
@@ -0,0 +1,436 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xds
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	cluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	endpoint "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	route "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	ext_authz "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/ext_authz/v3"
+	ext_proc "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/ext_proc/v3"
+	tls "github.com/envoyproxy/go-control-plane/envoy/extensions/transport_sockets/tls/v3"
+	clusterservice "github.com/envoyproxy/go-control-plane/envoy/service/cluster/v3"
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	routeservice "github.com/envoyproxy/go-control-plane/envoy/service/route/v3"
+	matcher "github.com/envoyproxy/go-control-plane/envoy/type/matcher/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
+	cache "github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/log"
+	resource "github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	xdsserver "github.com/envoyproxy/go-control-plane/pkg/server/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/wellknown"
+	logging "github.com/srinandan/envoy-router/server/logging"
+	routes "github.com/srinandan/envoy-router/server/routes"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+//RouteConfigName is the name of the RouteConfiguration envoy must request over RDS
+const RouteConfigName = "envoy-router"
+
+//variantHeader is returned to the client with the backend variant picked for the request
+const variantHeader = "x-envoy-router-variant"
+
+//extProcFilter is the name of the ext_proc filter in the envoy configuration
+const extProcFilter = "envoy.filters.http.ext_proc"
+
+//trustedCA is used to validate backends
+const trustedCA = "/etc/ssl/certs/ca-certificates.crt"
+
+//nodeGroup is the snapshot served to every envoy, regardless of its node id
+const nodeGroup = "envoy-router"
+
+type allNodes struct{}
+
+func (allNodes) ID(*core.Node) string {
+	return nodeGroup
+}
+
+// Server serves the routing table as RDS and CDS resources
+type Server struct {
+	//DynamicCluster is the cluster used for routes that still need the ext_authz
+	//callout, usually the dynamic forward proxy cluster
+	DynamicCluster string
+	snapshots      cache.SnapshotCache
+	version        int
+	sync.Mutex
+}
+
+// NewServer returns an xDS server. Routes go to dynamicCluster when they
+// cannot be expressed as static envoy routes
+func NewServer(dynamicCluster string) *Server {
+	return &Server{
+		DynamicCluster: dynamicCluster,
+		snapshots: cache.NewSnapshotCache(false, allNodes{}, log.LoggerFuncs{
+			DebugFunc: logging.Printf(slog.LevelDebug),
+			InfoFunc:  logging.Printf(slog.LevelInfo),
+			WarnFunc:  logging.Printf(slog.LevelWarn),
+			ErrorFunc: logging.Printf(slog.LevelError),
+		}),
+	}
+}
+
+// Register registers the RDS, CDS and ADS services and publishes a new snapshot
+// every time the routing table is reloaded
+func (x *Server) Register(s *grpc.Server) {
+	srv := xdsserver.NewServer(context.Background(), x.snapshots, nil)
+	discovery.RegisterAggregatedDiscoveryServiceServer(s, srv)
+	routeservice.RegisterRouteDiscoveryServiceServer(s, srv)
+	clusterservice.RegisterClusterDiscoveryServiceServer(s, srv)
+
+	routes.OnReload(func() {
+		if err := x.Update(); err != nil {
+			slog.Error("unable to publish xds snapshot", "error", err)
+		}
+	})
+}
+
+// Update translates the active routing table and publishes it
+func (x *Server) Update() error {
+	x.Lock()
+	defer x.Unlock()
+
+	routeConfig, clusters := x.translate(routes.GetRouteRules())
+
+	x.version++
+	version := fmt.Sprintf("%s-%d", routes.GetVersion(), x.version)
+
+	snapshot, err := cache.NewSnapshot(version, map[resource.Type][]types.Resource{
+		resource.ClusterType: clusters,
+		resource.RouteType:   {routeConfig},
+	})
+	if err != nil {
+		return err
+	}
+
+	slog.Info("publishing xds snapshot", "version", version, "clusters", len(clusters))
+	return x.snapshots.SetSnapshot(context.Background(), nodeGroup, snapshot)
+}
+
+//translate builds the route configuration and the backend clusters. Rules are
+//emitted in evaluation order since envoy picks the first route that matches
+func (x *Server) translate(rules []routes.RouteRule) (*route.RouteConfiguration, []types.Resource) {
+	var envoyRoutes []*route.Route
+	backends := map[string]bool{}
+
+	for _, r := range rules {
+		if isStatic(r) {
+			envoyRoutes = append(envoyRoutes, staticRoute(r))
+			if len(r.Backends) == 0 {
+				backends[r.Backend] = true
+			}
+			for _, b := range r.Backends {
+				backends[b.Backend] = true
+			}
+		} else {
+			envoyRoutes = append(envoyRoutes, x.dynamicRoute(r))
+		}
+	}
+
+	//everything else goes through ext_authz, which returns NOT_FOUND
+	envoyRoutes = append(envoyRoutes, &route.Route{
+		Name:  "default",
+		Match: &route.RouteMatch{PathSpecifier: &route.RouteMatch_Prefix{Prefix: "/"}},
+		Action: &route.Route_Route{Route: &route.RouteAction{
+			ClusterSpecifier: &route.RouteAction_Cluster{Cluster: x.DynamicCluster},
+		}},
+	})
+
+	names := make([]string, 0, len(backends))
+	for backend := range backends {
+		names = append(names, backend)
+	}
+	sort.Strings(names)
+
+	clusters := make([]types.Resource, 0, len(names))
+	for _, backend := range names {
+		clusters = append(clusters, backendCluster(backend))
+	}
+
+	return &route.RouteConfiguration{
+		Name: RouteConfigName,
+		VirtualHosts: []*route.VirtualHost{{
+			Name:    RouteConfigName,
+			Domains: []string{"*"},
+			Routes:  envoyRoutes,
+		}},
+	}, clusters
+}
+
+//isStatic returns true if envoy can route the rule by itself. Rules that need
+//upstream tokens, client jwt or api key validation, rate limits, quotas, body
+//matchers, inverted query parameter matchers, captures, templates, query
+//rewrites, sticky splits, response headers, body transforms, OpenAPI
+//validation or mocks still need the ext_authz callout. ext_proc is disabled on
+//static routes
+func isStatic(r routes.RouteRule) bool {
+	if r.Authentication != routes.OFF || r.JWT != nil || r.APIKey != nil {
+		return false
+	}
+	if len(r.Body) > 0 {
+		return false
+	}
+	if r.RateLimit != nil || r.Quota != nil {
+		return false
+	}
+	if r.Rewrite != "" || r.QueryRewrite != nil || r.Sticky != nil {
+		return false
+	}
+	//ext_proc finds the rule of the request from the header set by ext_authz
+	if r.UsesExtProc() {
+		return false
+	}
+	//envoy query parameter matchers can't be inverted
+	for _, q := range r.QueryParams {
+		if q.Invert {
+			return false
+		}
+	}
+	return !strings.Contains(r.Prefix, "{")
+}
+
+func staticRoute(r routes.RouteRule) *route.Route {
+	action := &route.RouteAction{
+		RegexRewrite: prefixRewrite(r),
+	}
+
+	if len(r.Backends) == 0 {
+		action.ClusterSpecifier = &route.RouteAction_Cluster{Cluster: clusterName(r.Backend)}
+		action.HostRewriteSpecifier = &route.RouteAction_HostRewriteLiteral{HostRewriteLiteral: r.Backend}
+	} else {
+		//envoy expects the weights to add up to 100 unless the total is set
+		weighted := &route.WeightedCluster{TotalWeight: wrapperspb.UInt32(r.TotalWeight())}
+		for _, b := range r.Backends {
+			variant := b.Name
+			if variant == "" {
+				variant = b.Backend
+			}
+			weighted.Clusters = append(weighted.Clusters, &route.WeightedCluster_ClusterWeight{
+				Name:                 clusterName(b.Backend),
+				Weight:               wrapperspb.UInt32(b.Weight),
+				HostRewriteSpecifier: &route.WeightedCluster_ClusterWeight_HostRewriteLiteral{HostRewriteLiteral: b.Backend},
+				ResponseHeadersToAdd: []*core.HeaderValueOption{setHeader(variantHeader, variant)},
+			})
+		}
+		action.ClusterSpecifier = &route.RouteAction_WeightedClusters{WeightedClusters: weighted}
+	}
+
+	return &route.Route{
+		Name:   r.Name,
+		Match:  routeMatch(r),
+		Action: &route.Route_Route{Route: action},
+		TypedPerFilterConfig: map[string]*anypb.Any{
+			wellknown.HTTPExternalAuthorization: disableExtAuthz,
+			extProcFilter:                       disableExtProc,
+		},
+		//only ext_authz sets the route header, a client could send it
+		RequestHeadersToRemove: []string{routes.RouteHeader},
+	}
+}
+
+//dynamicRoute sends the request through ext_authz, which picks the backend
+func (x *Server) dynamicRoute(r routes.RouteRule) *route.Route {
+	match := routeMatch(r)
+	if strings.Contains(r.Prefix, "{") {
+		//captures are matched by ext_authz, send everything under the literal part
+		literal := r.Prefix[:strings.Index(r.Prefix, "{")]
+		match.PathSpecifier = &route.RouteMatch_Prefix{Prefix: literal}
+	}
+
+	return &route.Route{
+		Name:  r.Name,
+		Match: match,
+		Action: &route.Route_Route{Route: &route.RouteAction{
+			ClusterSpecifier: &route.RouteAction_Cluster{Cluster: x.DynamicCluster},
+		}},
+	}
+}
+
+func routeMatch(r routes.RouteRule) *route.RouteMatch {
+	match := &route.RouteMatch{}
+
+	if prefix := strings.TrimRight(r.Prefix, "/"); prefix == "" {
+		match.PathSpecifier = &route.RouteMatch_Prefix{Prefix: "/"}
+	} else {
+		match.PathSpecifier = &route.RouteMatch_PathSeparatedPrefix{PathSeparatedPrefix: prefix}
+	}
+
+	if len(r.Methods) > 0 {
+		quoted := make([]string, len(r.Methods))
+		for i, method := range r.Methods {
+			quoted[i] = regexp.QuoteMeta(method)
+		}
+		match.Headers = append(match.Headers, &route.HeaderMatcher{
+			Name: ":method",
+			HeaderMatchSpecifier: &route.HeaderMatcher_StringMatch{
+				StringMatch: safeRegex("^(" + strings.Join(quoted, "|") + ")$"),
+			},
+		})
+	}
+
+	for _, h := range r.Headers {
+		headerMatcher := &route.HeaderMatcher{Name: h.Name, InvertMatch: h.Invert}
+		if m := stringMatch(h.Exact, h.Prefix, h.Regex); m != nil {
+			headerMatcher.HeaderMatchSpecifier = &route.HeaderMatcher_StringMatch{StringMatch: m}
+		} else {
+			headerMatcher.HeaderMatchSpecifier = &route.HeaderMatcher_PresentMatch{PresentMatch: true}
+		}
+		match.Headers = append(match.Headers, headerMatcher)
+	}
+
+	for _, q := range r.QueryParams {
+		if q.Invert {
+			//only on dynamic routes, ext_authz evaluates it
+			continue
+		}
+		queryMatcher := &route.QueryParameterMatcher{Name: q.Name}
+		if m := stringMatch(q.Exact, q.Prefix, q.Regex); m != nil {
+			queryMatcher.QueryParameterMatchSpecifier = &route.QueryParameterMatcher_StringMatch{StringMatch: m}
+		} else {
+			queryMatcher.QueryParameterMatchSpecifier = &route.QueryParameterMatcher_PresentMatch{PresentMatch: true}
+		}
+		match.QueryParameters = append(match.QueryParameters, queryMatcher)
+	}
+
+	return match
+}
+
+//prefixRewrite replaces the prefix by backendPrefix, like GetBackendPath
+func prefixRewrite(r routes.RouteRule) *matcher.RegexMatchAndSubstitute {
+	prefix := strings.TrimRight(r.Prefix, "/")
+	if prefix == "" && r.BackendPrefix == "" {
+		return nil
+	}
+
+	if r.BackendPrefix == "" {
+		return &matcher.RegexMatchAndSubstitute{
+			Pattern:      regexMatcher("^" + regexp.QuoteMeta(prefix) + "(/|$)"),
+			Substitution: "/",
+		}
+	}
+
+	return &matcher.RegexMatchAndSubstitute{
+		Pattern:      regexMatcher("^" + regexp.QuoteMeta(prefix)),
+		Substitution: strings.TrimRight(r.BackendPrefix, "/"),
+	}
+}
+
+func stringMatch(exact string, prefix string, regex string) *matcher.StringMatcher {
+	switch {
+	case exact != "":
+		return &matcher.StringMatcher{MatchPattern: &matcher.StringMatcher_Exact{Exact: exact}}
+	case prefix != "":
+		return &matcher.StringMatcher{MatchPattern: &matcher.StringMatcher_Prefix{Prefix: prefix}}
+	case regex != "":
+		return safeRegex(regex)
+	}
+	return nil
+}
+
+func safeRegex(regex string) *matcher.StringMatcher {
+	return &matcher.StringMatcher{MatchPattern: &matcher.StringMatcher_SafeRegex{SafeRegex: regexMatcher(regex)}}
+}
+
+func regexMatcher(regex string) *matcher.RegexMatcher {
+	return &matcher.RegexMatcher{
+		EngineType: &matcher.RegexMatcher_GoogleRe2{GoogleRe2: &matcher.RegexMatcher_GoogleRE2{}},
+		Regex:      regex,
+	}
+}
+
+func clusterName(backend string) string {
+	return "backend_" + backend
+}
+
+//backendCluster resolves the backend with DNS. Backends without a port, or on
+//port 443, are reached over TLS
+func backendCluster(backend string) *cluster.Cluster {
+	host, port := backend, uint32(443)
+	if h, p, err := net.SplitHostPort(backend); err == nil {
+		if n, err := strconv.ParseUint(p, 10, 32); err == nil {
+			host, port = h, uint32(n)
+		}
+	}
+
+	c := &cluster.Cluster{
+		Name:                 clusterName(backend),
+		ConnectTimeout:       durationpb.New(5 * time.Second),
+		ClusterDiscoveryType: &cluster.Cluster_Type{Type: cluster.Cluster_LOGICAL_DNS},
+		DnsLookupFamily:      cluster.Cluster_V4_ONLY,
+		LoadAssignment: &endpoint.ClusterLoadAssignment{
+			ClusterName: clusterName(backend),
+			Endpoints: []*endpoint.LocalityLbEndpoints{{
+				LbEndpoints: []*endpoint.LbEndpoint{{
+					HostIdentifier: &endpoint.LbEndpoint_Endpoint{Endpoint: &endpoint.Endpoint{
+						Address: &core.Address{Address: &core.Address_SocketAddress{SocketAddress: &core.SocketAddress{
+							Address:       host,
+							PortSpecifier: &core.SocketAddress_PortValue{PortValue: port},
+						}}},
+					}},
+				}},
+			}},
+		},
+	}
+
+	if port == 443 {
+		tlsContext, _ := anypb.New(&tls.UpstreamTlsContext{
+			Sni: host,
+			CommonTlsContext: &tls.CommonTlsContext{
+				ValidationContextType: &tls.CommonTlsContext_ValidationContext{
+					ValidationContext: &tls.CertificateValidationContext{
+						TrustedCa: &core.DataSource{Specifier: &core.DataSource_Filename{Filename: trustedCA}},
+					},
+				},
+			},
+		})
+		c.TransportSocket = &core.TransportSocket{
+			Name:       wellknown.TransportSocketTls,
+			ConfigType: &core.TransportSocket_TypedConfig{TypedConfig: tlsContext},
+		}
+	}
+
+	return c
+}
+
+func setHeader(name string, value string) *core.HeaderValueOption {
+	return &core.HeaderValueOption{
+		Header: &core.HeaderValue{Key: name, Value: value},
+		Append: wrapperspb.Bool(false),
+	}
+}
+
+//disableExtAuthz turns off the ext_authz callout on static routes
+var disableExtAuthz, _ = anypb.New(&ext_authz.ExtAuthzPerRoute{
+	Override: &ext_authz.ExtAuthzPerRoute_Disabled{Disabled: true},
+})
+
+//disableExtProc turns off ext_proc on static routes, they don't use it
+var disableExtProc, _ = anypb.New(&ext_proc.ExtProcPerRoute{
+	Override: &ext_proc.ExtProcPerRoute_Disabled{Disabled: true},
+})
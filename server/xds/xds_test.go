@@ -0,0 +1,118 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xds
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	route "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/wellknown"
+	routes "github.com/srinandan/envoy-router/server/routes"
+)
+
+func loadRoutes(t *testing.T, table string) []routes.RouteRule {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "routes.json")
+	if err := os.WriteFile(file, []byte(table), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := routes.ReadRoutesFile(file); err != nil {
+		t.Fatal(err)
+	}
+	return routes.GetRouteRules()
+}
+
+func TestTranslate(t *testing.T) {
+	rules := loadRoutes(t, `{"routerules": [
+		{"name": "orders", "prefix": "/orders", "backend": "orders.example.com"},
+		{"name": "split", "prefix": "/split", "backends": [
+			{"name": "stable", "backend": "v1.example.com", "weight": 3},
+			{"name": "canary", "backend": "v2.example.com", "weight": 1}
+		]},
+		{"name": "secure", "prefix": "/secure", "backend": "secure.example.com", "authentication": 1}
+	]}`)
+
+	x := NewServer("dynamic_forward_proxy_cluster")
+	routeConfig, clusters := x.translate(rules)
+	if err := routeConfig.Validate(); err != nil {
+		t.Fatalf("invalid route configuration: %v", err)
+	}
+	if len(clusters) != 3 {
+		t.Errorf("got %d clusters, want 3", len(clusters))
+	}
+
+	envoyRoutes := routeConfig.VirtualHosts[0].Routes
+	if len(envoyRoutes) != 4 {
+		t.Fatalf("got %d routes, want 4", len(envoyRoutes))
+	}
+
+	for _, r := range envoyRoutes[:2] {
+		for _, filter := range []string{wellknown.HTTPExternalAuthorization, extProcFilter} {
+			if _, ok := r.TypedPerFilterConfig[filter]; !ok {
+				t.Errorf("static route %s: %s is not disabled", r.Name, filter)
+			}
+		}
+		if len(r.RequestHeadersToRemove) != 1 || r.RequestHeadersToRemove[0] != routes.RouteHeader {
+			t.Errorf("static route %s: %s is not removed", r.Name, routes.RouteHeader)
+		}
+	}
+
+	//weights that don't add up to 100 need the total
+	weighted := envoyRoutes[1].GetRoute().GetClusterSpecifier().(*route.RouteAction_WeightedClusters).WeightedClusters
+	if weighted.GetTotalWeight().GetValue() != 4 {
+		t.Errorf("total weight %d, want 4", weighted.GetTotalWeight().GetValue())
+	}
+
+	if secure := envoyRoutes[2]; secure.GetRoute().GetCluster() != "dynamic_forward_proxy_cluster" || len(secure.TypedPerFilterConfig) != 0 {
+		t.Errorf("route with upstream authentication is not sent through ext_authz: %v", secure)
+	}
+}
+
+func TestTranslateInvertedQueryParameter(t *testing.T) {
+	rules := loadRoutes(t, `{"routerules": [
+		{"name": "no-debug", "prefix": "/orders", "backend": "orders.example.com",
+		 "queryParams": [{"name": "debug", "present": true, "invert": true}, {"name": "region", "exact": "eu"}]},
+		{"name": "debug", "prefix": "/orders", "backend": "debug.example.com",
+		 "queryParams": [{"name": "debug", "present": true}]}
+	]}`)
+
+	routeConfig, clusters := NewServer("dynamic_forward_proxy_cluster").translate(rules)
+	if err := routeConfig.Validate(); err != nil {
+		t.Fatalf("invalid route configuration: %v", err)
+	}
+	if len(clusters) != 1 {
+		t.Errorf("got %d clusters, want 1", len(clusters))
+	}
+
+	for _, r := range routeConfig.VirtualHosts[0].Routes {
+		switch r.Name {
+		case "no-debug":
+			//envoy can't invert the matcher, ext_authz must see the request
+			if r.GetRoute().GetCluster() != "dynamic_forward_proxy_cluster" || len(r.TypedPerFilterConfig) != 0 {
+				t.Errorf("route with an inverted query parameter is static: %v", r)
+			}
+			query := r.Match.QueryParameters
+			if len(query) != 1 || query[0].Name != "region" {
+				t.Errorf("got query parameter matchers %v, want region only", query)
+			}
+		case "debug":
+			if r.GetRoute().GetCluster() == "dynamic_forward_proxy_cluster" {
+				t.Errorf("route without inverted matchers is not static: %v", r)
+			}
+		}
+	}
+}